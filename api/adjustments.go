@@ -0,0 +1,425 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"t2cbackend/database"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// maxAdjustmentReasonLength limits the reason recorded with an adjustment
+	maxAdjustmentReasonLength = 500
+
+	// An admin's adjustments to a user within the window are added up, so a
+	// large change cannot be entered as several small ones
+	defaultAdjustmentApprovalPoints = 1000
+	adjustmentApprovalWindow        = 24 * time.Hour
+)
+
+// States of a point adjustment
+const (
+	adjustmentPending  = "pending"
+	adjustmentApplied  = "applied"
+	adjustmentRejected = "rejected"
+)
+
+// AdjustmentRequest represents a staff adjustment to a user's points
+type AdjustmentRequest struct {
+	UserID int    `json:"user_id"`
+	Points int    `json:"points"` // negative to deduct
+	Reason string `json:"reason"`
+}
+
+// ResolveAdjustmentRequest represents a second admin's decision on an adjustment
+type ResolveAdjustmentRequest struct {
+	Decision string `json:"decision"` // approve/reject
+	Note     string `json:"note"`
+}
+
+// adjustmentApprovalPoints returns the size above which adjustments need a
+// second admin, from the global configuration
+func adjustmentApprovalPoints() int {
+	cfg, _, err := globalStationConfig()
+	if err != nil || cfg.AdjustmentApprovalPoints <= 0 {
+		return defaultAdjustmentApprovalPoints
+	}
+	return cfg.AdjustmentApprovalPoints
+}
+
+// recentAdjustmentPoints returns the points, either way, an admin adjusted
+// a user by within the approval window. Rejected adjustments do not count.
+func recentAdjustmentPoints(q rowQuerier, adminID, userID int, now time.Time) int {
+	var points int
+	q.QueryRow(`
+		SELECT COALESCE(SUM(ABS(points)), 0) FROM point_adjustments
+		WHERE created_by = ? AND user_id = ? AND status != ? AND created_at >= ?
+	`, adminID, userID, adjustmentRejected, sqliteTime(now.Add(-adjustmentApprovalWindow))).Scan(&points)
+	return points
+}
+
+// adjustmentColumns lists the columns scanned by scanAdjustment
+const adjustmentColumns = `id, user_id, points, reason, status, created_by, created_at, resolved_by, resolved_at,
+	COALESCE(note, ''), transaction_id`
+
+// scanAdjustment scans a row selected with adjustmentColumns
+func scanAdjustment(row rowScanner) (database.PointAdjustment, error) {
+	var adjustment database.PointAdjustment
+	var resolvedBy, transactionID sql.NullInt64
+	var resolvedAt sql.NullTime
+	err := row.Scan(&adjustment.ID, &adjustment.UserID, &adjustment.Points, &adjustment.Reason,
+		&adjustment.Status, &adjustment.CreatedBy, &adjustment.CreatedAt, &resolvedBy, &resolvedAt,
+		&adjustment.Note, &transactionID)
+	if resolvedBy.Valid {
+		id := int(resolvedBy.Int64)
+		adjustment.ResolvedBy = &id
+	}
+	if resolvedAt.Valid {
+		adjustment.ResolvedAt = &resolvedAt.Time
+	}
+	if transactionID.Valid {
+		id := int(transactionID.Int64)
+		adjustment.TransactionID = &id
+	}
+	return adjustment, err
+}
+
+// applyAdjustmentTx records the adjustment transaction and posts it to the
+// ledger against issuance. approvedBy is nil for adjustments that needed no
+// approval.
+func applyAdjustmentTx(tx *sql.Tx, adjustment database.PointAdjustment, approvedBy interface{}) (int64, error) {
+	// No station is involved, so station_id is 0
+	result, err := tx.Exec(`
+		INSERT INTO transactions (user_id, type, amount, item_type, weight_grams, points_earned, station_id,
+			reason, operator_id, approved_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, adjustment.UserID, "adjustment", 0, "adjustment", 0, adjustment.Points, 0,
+		adjustment.Reason, adjustment.CreatedBy, approvedBy)
+	if err != nil {
+		return 0, err
+	}
+	transactionID, _ := result.LastInsertId()
+
+	// Deductions may not take the balance below zero
+	err = postPointsTx(tx, ledgerPosting{UserID: adjustment.UserID, Points: adjustment.Points,
+		Account: accountIssuance, Kind: journalAdjustment, Reference: "adjustment", ReferenceID: int64(adjustment.ID),
+		Memo: adjustment.Reason})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE point_adjustments SET transaction_id = ? WHERE id = ?", transactionID, adjustment.ID)
+	return transactionID, err
+}
+
+// listAdjustments lists point adjustments, oldest first. Defaults to the
+// pending ones; ?status=applied or rejected lists the others, and ?user_id=
+// narrows them to one user.
+func listAdjustments(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = adjustmentPending
+	}
+
+	query := "SELECT " + adjustmentColumns + " FROM point_adjustments WHERE status = ?"
+	args := []interface{}{status}
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	query += " ORDER BY created_at ASC LIMIT 200"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve adjustments",
+		})
+		return
+	}
+	defer rows.Close()
+
+	adjustments := []database.PointAdjustment{}
+	for rows.Next() {
+		adjustment, err := scanAdjustment(rows)
+		if err != nil {
+			continue
+		}
+		adjustments = append(adjustments, adjustment)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    adjustments,
+	})
+}
+
+// createAdjustment credits or deducts a user's points by hand. Adjustments
+// above the approval threshold are held until a second admin approves them.
+func createAdjustment(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := getUserIDFromHeader(r)
+
+	var req AdjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.UserID <= 0 || req.Points == 0 {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "user_id and a non-zero points are required",
+		})
+		return
+	}
+	if req.Reason == "" || len(req.Reason) > maxAdjustmentReasonLength {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "A reason of up to 500 characters is required",
+		})
+		return
+	}
+
+	if req.UserID == adminID {
+		respondJSON(w, http.StatusForbidden, Response{
+			Success: false,
+			Error:   "Admins cannot adjust their own points",
+		})
+		return
+	}
+
+	var exists int
+	database.DB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", req.UserID).Scan(&exists)
+	if exists == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "User not found",
+		})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record adjustment",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// Counted inside the transaction, so adjustments entered at the same
+	// time are added up too
+	now := time.Now().UTC()
+	size := req.Points
+	if size < 0 {
+		size = -size
+	}
+	needsApproval := recentAdjustmentPoints(tx, adminID, req.UserID, now)+size > adjustmentApprovalPoints()
+
+	adjustment := database.PointAdjustment{
+		UserID:    req.UserID,
+		Points:    req.Points,
+		Reason:    req.Reason,
+		Status:    adjustmentApplied,
+		CreatedBy: adminID,
+		CreatedAt: now,
+	}
+	if needsApproval {
+		adjustment.Status = adjustmentPending
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO point_adjustments (user_id, points, reason, status, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, adjustment.UserID, adjustment.Points, adjustment.Reason, adjustment.Status,
+		adjustment.CreatedBy, adjustment.CreatedAt)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record adjustment",
+		})
+		return
+	}
+	id, _ := result.LastInsertId()
+	adjustment.ID = int(id)
+
+	if !needsApproval {
+		transactionID, err := applyAdjustmentTx(tx, adjustment, nil)
+		if err == errNegativeBalance {
+			respondJSON(w, http.StatusConflict, Response{
+				Success: false,
+				Error:   "Adjustment would make the balance negative",
+			})
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to apply adjustment",
+			})
+			return
+		}
+		txID := int(transactionID)
+		adjustment.TransactionID = &txID
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record adjustment",
+		})
+		return
+	}
+
+	log.Printf("Adjustment %d by admin %d: user=%d, points=%d, status=%s",
+		adjustment.ID, adminID, adjustment.UserID, adjustment.Points, adjustment.Status)
+
+	if needsApproval {
+		respondJSON(w, http.StatusAccepted, Response{
+			Success: true,
+			Message: "Adjustment needs a second admin's approval",
+			Data:    adjustment,
+		})
+		return
+	}
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Adjustment applied",
+		Data:    adjustment,
+	})
+}
+
+// resolveAdjustment approves or rejects a pending adjustment. Only an admin
+// other than the one who entered it may approve it; either may reject it.
+func resolveAdjustment(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := getUserIDFromHeader(r)
+
+	adjustmentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid adjustment ID",
+		})
+		return
+	}
+
+	var req ResolveAdjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+	var status string
+	switch req.Decision {
+	case "approve":
+		status = adjustmentApplied
+	case "reject":
+		status = adjustmentRejected
+	default:
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "decision must be approve or reject",
+		})
+		return
+	}
+
+	adjustment, err := scanAdjustment(database.DB.QueryRow(
+		"SELECT "+adjustmentColumns+" FROM point_adjustments WHERE id = ?", adjustmentID,
+	))
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Adjustment not found",
+		})
+		return
+	}
+	if status == adjustmentApplied && adjustment.CreatedBy == adminID {
+		respondJSON(w, http.StatusForbidden, Response{
+			Success: false,
+			Error:   "Adjustments must be approved by a second admin",
+		})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve adjustment",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// Claim the adjustment first so it cannot be applied twice
+	now := time.Now().UTC()
+	result, err := tx.Exec(`
+		UPDATE point_adjustments SET status = ?, resolved_by = ?, resolved_at = ?, note = ?
+		WHERE id = ? AND status = 'pending'
+	`, status, adminID, now, req.Note, adjustmentID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve adjustment",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Adjustment has already been resolved",
+		})
+		return
+	}
+	adjustment.Status, adjustment.ResolvedBy, adjustment.ResolvedAt, adjustment.Note = status, &adminID, &now, req.Note
+
+	if status == adjustmentApplied {
+		transactionID, err := applyAdjustmentTx(tx, adjustment, adminID)
+		if err == errNegativeBalance {
+			respondJSON(w, http.StatusConflict, Response{
+				Success: false,
+				Error:   "Adjustment would make the balance negative",
+			})
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to apply adjustment",
+			})
+			return
+		}
+		txID := int(transactionID)
+		adjustment.TransactionID = &txID
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve adjustment",
+		})
+		return
+	}
+
+	log.Printf("Adjustment %d %s by admin %d", adjustmentID, status, adminID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Adjustment " + status,
+		Data:    adjustment,
+	})
+}
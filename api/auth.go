@@ -144,8 +144,18 @@ func register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create account",
+		})
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert user
-	result, err := database.DB.Exec(
+	result, err := tx.Exec(
 		"INSERT INTO users (email, password, name, total_points) VALUES (?, ?, ?, ?)",
 		req.Email, hashedPassword, req.Name, 0,
 	)
@@ -159,6 +169,18 @@ func register(w http.ResponseWriter, r *http.Request) {
 
 	userID, _ := result.LastInsertId()
 
+	// Every account has a ledger wallet from the start
+	if _, err = walletAccountTx(tx, int(userID)); err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create account",
+		})
+		return
+	}
+
 	// Generate JWT token for immediate login after registration
 	jwtToken, err := generateJWT(int(userID))
 	if err != nil {
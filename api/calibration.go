@@ -0,0 +1,470 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Calibration limits. A scale that needs more correction than this, or that
+// is not linear, should be repaired rather than calibrated.
+const (
+	minCalibrationReadings = 2
+	maxCalibrationError    = 0.05 // kg, worst reading after correction
+	minCalibrationGain     = 0.8
+	maxCalibrationGain     = 1.2
+	maxCalibrationOffset   = 2.0 // kg
+	calibrationMaxAge      = 180 * 24 * time.Hour
+)
+
+// Fleet deviation report settings
+const (
+	defaultDeviationDays = 30
+	maxDeviationDays     = 365
+	minDeviationSamples  = 20   // deposits a station needs before it is compared
+	minFleetStations     = 3    // stations needed to establish a fleet norm
+	deviationThreshold   = 0.25 // flag average weights 25% away from the fleet median
+	deviationCheckEvery  = 24 * time.Hour
+)
+
+// CalibrationRequest represents a scale calibration recorded by a technician
+type CalibrationRequest struct {
+	Readings []database.CalibrationReading `json:"readings"`
+	TicketID *int                          `json:"ticket_id"`
+	Notes    string                        `json:"notes"`
+}
+
+// fitCalibration computes the gain and offset that best map readings onto
+// their reference weights (least squares) and the worst remaining error
+func fitCalibration(readings []database.CalibrationReading) (gain, offset, maxErr float64, err error) {
+	if len(readings) < minCalibrationReadings {
+		return 0, 0, 0, fmt.Errorf("at least %d readings are required", minCalibrationReadings)
+	}
+
+	var sumRef, sumRead float64
+	for _, reading := range readings {
+		if reading.ReferenceKg <= 0 || reading.ReadingKg < 0 {
+			return 0, 0, 0, errors.New("reference_kg must be positive and reading_kg must not be negative")
+		}
+		sumRef += reading.ReferenceKg
+		sumRead += reading.ReadingKg
+	}
+	n := float64(len(readings))
+	meanRef, meanRead := sumRef/n, sumRead/n
+
+	var covariance, variance float64
+	for _, reading := range readings {
+		covariance += (reading.ReadingKg - meanRead) * (reading.ReferenceKg - meanRef)
+		variance += (reading.ReadingKg - meanRead) * (reading.ReadingKg - meanRead)
+	}
+	if variance == 0 {
+		return 0, 0, 0, errors.New("readings must use at least two different reference weights")
+	}
+
+	gain = math.Round(covariance/variance*1e6) / 1e6
+	offset = math.Round((meanRef-gain*meanRead)*1e4) / 1e4
+	for _, reading := range readings {
+		maxErr = math.Max(maxErr, math.Abs(gain*reading.ReadingKg+offset-reading.ReferenceKg))
+	}
+	maxErr = math.Round(maxErr*1e4) / 1e4
+
+	switch {
+	case gain < minCalibrationGain || gain > maxCalibrationGain:
+		return 0, 0, 0, fmt.Errorf("gain %.3f is outside %.1f-%.1f; the scale needs repair", gain, minCalibrationGain, maxCalibrationGain)
+	case math.Abs(offset) > maxCalibrationOffset:
+		return 0, 0, 0, fmt.Errorf("offset %.3f kg exceeds %.1f kg; the scale needs repair", offset, maxCalibrationOffset)
+	case maxErr > maxCalibrationError:
+		return 0, 0, 0, fmt.Errorf("readings are off by up to %.3f kg after correction; the scale is not linear", maxErr)
+	}
+	return gain, offset, maxErr, nil
+}
+
+// calibrationColumns lists the columns scanned by scanCalibration
+const calibrationColumns = `id, station_id, gain, offset_kg, readings, max_error_kg, ticket_id,
+	COALESCE(technician_id, 0), COALESCE(notes, ''), calibrated_at`
+
+// scanCalibration scans a row selected with calibrationColumns
+func scanCalibration(row rowScanner) (database.ScaleCalibration, error) {
+	var calibration database.ScaleCalibration
+	var readings string
+	var ticketID sql.NullInt64
+	err := row.Scan(&calibration.ID, &calibration.StationID, &calibration.Gain, &calibration.OffsetKg,
+		&readings, &calibration.MaxErrorKg, &ticketID, &calibration.TechnicianID, &calibration.Notes,
+		&calibration.CalibratedAt)
+	if err != nil {
+		return calibration, err
+	}
+	if ticketID.Valid {
+		id := int(ticketID.Int64)
+		calibration.TicketID = &id
+	}
+	err = json.Unmarshal([]byte(readings), &calibration.Readings)
+	return calibration, err
+}
+
+// calibrationAt returns the calibration in force on a station's scale at a
+// point in time, or sql.ErrNoRows if the scale had not been calibrated yet
+func calibrationAt(stationID int, at time.Time) (database.ScaleCalibration, error) {
+	return scanCalibration(database.DB.QueryRow(`
+		SELECT `+calibrationColumns+` FROM scale_calibrations
+		WHERE station_id = ? AND calibrated_at <= ?
+		ORDER BY calibrated_at DESC, id DESC LIMIT 1
+	`, stationID, at.UTC()))
+}
+
+// correctWeight applies the station's calibration at the given time to a raw
+// scale reading. Readings from uncalibrated scales are returned unchanged.
+func correctWeight(stationID int, raw database.Grams, at time.Time) database.Grams {
+	// Counted deposits may have no weight reading
+	if raw <= 0 {
+		return 0
+	}
+	calibration, err := calibrationAt(stationID, at)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("correctWeight: failed to load calibration for station %d: %v", stationID, err)
+		}
+		return raw
+	}
+
+	corrected := math.Round(calibration.Gain*float64(raw) + calibration.OffsetKg*1000)
+	return database.Grams(math.Max(corrected, 0))
+}
+
+// createCalibration records a new calibration for a station's scale. It
+// applies to every deposit weighed from now on.
+func createCalibration(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	if _, err := loadStation(stationID); err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	var req CalibrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	gain, offset, maxErr, err := fitCalibration(req.Readings)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Calibration rejected: " + err.Error(),
+		})
+		return
+	}
+
+	if req.TicketID != nil {
+		ticket, err := loadTicket(*req.TicketID)
+		if err != nil || ticket.StationID != stationID {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "ticket_id must be a ticket for this station",
+			})
+			return
+		}
+		if ticketIsDone(ticket) {
+			respondJSON(w, http.StatusConflict, Response{
+				Success: false,
+				Error:   "Ticket is already " + ticket.Status,
+			})
+			return
+		}
+	}
+
+	readings, _ := json.Marshal(req.Readings)
+	now := time.Now().UTC()
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record calibration",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO scale_calibrations (station_id, gain, offset_kg, readings, max_error_kg, ticket_id,
+			technician_id, notes, calibrated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, stationID, gain, offset, string(readings), maxErr, req.TicketID, userID, strings.TrimSpace(req.Notes), now)
+	if err == nil && req.TicketID != nil {
+		note := fmt.Sprintf("Scale calibrated: gain %.4f, offset %.3f kg, max error %.3f kg", gain, offset, maxErr)
+		err = addTicketNoteTx(tx, *req.TicketID, &userID, note, now)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("createCalibration: failed to record calibration for station %d: %v", stationID, err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record calibration",
+		})
+		return
+	}
+
+	calibrationID, _ := result.LastInsertId()
+	log.Printf("Scale calibrated: station=%d, gain=%.4f, offset=%.3f, by user %d", stationID, gain, offset, userID)
+
+	calibration, _ := scanCalibration(database.DB.QueryRow(
+		"SELECT "+calibrationColumns+" FROM scale_calibrations WHERE id = ?", calibrationID,
+	))
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Calibration recorded",
+		Data:    calibration,
+	})
+}
+
+// listCalibrations lists a station's scale calibrations, newest first
+func listCalibrations(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT `+calibrationColumns+` FROM scale_calibrations
+		WHERE station_id = ?
+		ORDER BY calibrated_at DESC, id DESC
+		LIMIT 100
+	`, stationID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve calibrations",
+		})
+		return
+	}
+	defer rows.Close()
+
+	calibrations := []database.ScaleCalibration{}
+	for rows.Next() {
+		calibration, err := scanCalibration(rows)
+		if err != nil {
+			continue
+		}
+		calibrations = append(calibrations, calibration)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    calibrations,
+	})
+}
+
+// materialDeviation compares a station's average deposit weight for one
+// material with the fleet
+type materialDeviation struct {
+	Material     string  `json:"material"`
+	Deposits     int     `json:"deposits"`
+	AvgWeightKg  float64 `json:"avg_weight_kg"`
+	FleetAvgKg   float64 `json:"fleet_avg_kg,omitempty"`
+	DeviationPct float64 `json:"deviation_pct"`
+	Flagged      bool    `json:"flagged"`
+}
+
+// stationDeviation is one station's entry in the deviation report
+type stationDeviation struct {
+	StationID          int                 `json:"station_id"`
+	Location           string              `json:"location"`
+	Flagged            bool                `json:"flagged"`
+	LastCalibratedAt   *time.Time          `json:"last_calibrated_at"`
+	CalibrationOverdue bool                `json:"calibration_overdue"`
+	Materials          []materialDeviation `json:"materials"`
+}
+
+// median returns the median of a non-empty slice, sorting it in place
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
+
+// scaleDeviations compares each station's average deposit weight per material
+// with the median of all stations. A station whose scale over- or
+// under-reports stands out against stations with similar deposits. Counted
+// deposits are left out, since their weight is optional.
+func scaleDeviations(windowStart, now time.Time) ([]stationDeviation, error) {
+	rows, err := database.DB.Query(`
+		SELECT s.id, s.location, t.item_type, COUNT(*), AVG(t.weight_grams) / 1000.0
+		FROM transactions t
+		JOIN stations s ON s.id = t.station_id
+		WHERE t.type = 'deposit' AND t.item_count IS NULL AND t.timestamp >= ? AND s.status != 'disabled'
+		GROUP BY s.id, t.item_type
+		ORDER BY s.id, t.item_type
+	`, windowStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var report []stationDeviation
+	byStation := make(map[int]int)
+	fleetAverages := make(map[string][]float64)
+	for rows.Next() {
+		var stationID int
+		var location string
+		var deviation materialDeviation
+		if err := rows.Scan(&stationID, &location, &deviation.Material, &deviation.Deposits, &deviation.AvgWeightKg); err != nil {
+			continue
+		}
+		deviation.AvgWeightKg = math.Round(deviation.AvgWeightKg*1000) / 1000
+
+		i, seen := byStation[stationID]
+		if !seen {
+			i = len(report)
+			byStation[stationID] = i
+			report = append(report, stationDeviation{StationID: stationID, Location: location})
+		}
+		report[i].Materials = append(report[i].Materials, deviation)
+
+		if deviation.Deposits >= minDeviationSamples {
+			fleetAverages[deviation.Material] = append(fleetAverages[deviation.Material], deviation.AvgWeightKg)
+		}
+	}
+	rows.Close()
+
+	fleetNorms := make(map[string]float64)
+	for material, averages := range fleetAverages {
+		if len(averages) >= minFleetStations {
+			fleetNorms[material] = median(averages)
+		}
+	}
+
+	for i := range report {
+		station := &report[i]
+		for j := range station.Materials {
+			deviation := &station.Materials[j]
+			norm, ok := fleetNorms[deviation.Material]
+			if !ok || norm == 0 || deviation.Deposits < minDeviationSamples {
+				continue
+			}
+			deviation.FleetAvgKg = norm
+			deviation.DeviationPct = math.Round((deviation.AvgWeightKg/norm-1)*1000) / 10
+			if math.Abs(deviation.AvgWeightKg/norm-1) > deviationThreshold {
+				deviation.Flagged = true
+				station.Flagged = true
+			}
+		}
+
+		if calibration, err := calibrationAt(station.StationID, now); err == nil {
+			station.LastCalibratedAt = &calibration.CalibratedAt
+			station.CalibrationOverdue = now.Sub(calibration.CalibratedAt) > calibrationMaxAge
+		} else {
+			station.CalibrationOverdue = true
+		}
+	}
+
+	return report, nil
+}
+
+// getScaleDeviations reports stations whose deposit weights deviate from the
+// fleet, with the state of their calibration
+func getScaleDeviations(w http.ResponseWriter, r *http.Request) {
+	days := defaultDeviationDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxDeviationDays {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("days must be between 1 and %d", maxDeviationDays),
+			})
+			return
+		}
+		days = parsed
+	}
+
+	now := time.Now().UTC()
+	report, err := scaleDeviations(now.AddDate(0, 0, -days), now)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to build deviation report",
+		})
+		return
+	}
+
+	if r.URL.Query().Get("flagged") == "true" {
+		flagged := []stationDeviation{}
+		for _, station := range report {
+			if station.Flagged {
+				flagged = append(flagged, station)
+			}
+		}
+		report = flagged
+	}
+	if report == nil {
+		report = []stationDeviation{}
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"window_days":   days,
+			"threshold_pct": deviationThreshold * 100,
+			"stations":      report,
+		},
+	})
+}
+
+// checkScaleDeviations raises an alert for each station whose weights
+// deviate from the fleet
+func checkScaleDeviations() {
+	now := time.Now().UTC()
+	report, err := scaleDeviations(now.AddDate(0, 0, -defaultDeviationDays), now)
+	if err != nil {
+		log.Printf("checkScaleDeviations: %v", err)
+		return
+	}
+
+	for _, station := range report {
+		if !station.Flagged {
+			continue
+		}
+		var materials []string
+		for _, deviation := range station.Materials {
+			if deviation.Flagged {
+				materials = append(materials, fmt.Sprintf("%s %+.1f%%", deviation.Material, deviation.DeviationPct))
+			}
+		}
+		raiseAlert(station.StationID, "scale_deviation",
+			fmt.Sprintf("Station %s weighs differently from the fleet (%s); check its calibration",
+				station.Location, strings.Join(materials, ", ")))
+	}
+}
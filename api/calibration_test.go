@@ -0,0 +1,69 @@
+package api
+
+import (
+	"math"
+	"testing"
+
+	"t2cbackend/database"
+)
+
+func calibrationReadings(pairs ...float64) []database.CalibrationReading {
+	var result []database.CalibrationReading
+	for i := 0; i+1 < len(pairs); i += 2 {
+		result = append(result, database.CalibrationReading{ReferenceKg: pairs[i], ReadingKg: pairs[i+1]})
+	}
+	return result
+}
+
+func TestFitCalibration(t *testing.T) {
+	tests := []struct {
+		name     string
+		readings []database.CalibrationReading
+		gain     float64
+		offset   float64
+		maxErr   float64
+	}{
+		{"exact scale", calibrationReadings(1, 1, 5, 5, 10, 10), 1, 0, 0},
+		{"reads 10% high", calibrationReadings(1, 1.1, 5, 5.5, 10, 11), 0.909091, 0, 0.0001},
+		{"fixed offset", calibrationReadings(1, 1.2, 5, 5.2, 10, 10.2), 1, -0.2, 0},
+		{"two readings", calibrationReadings(2, 2.1, 8, 8.1), 1, -0.1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gain, offset, maxErr, err := fitCalibration(tt.readings)
+			if err != nil {
+				t.Fatalf("fitCalibration() error = %v", err)
+			}
+			if math.Abs(gain-tt.gain) > 1e-6 || math.Abs(offset-tt.offset) > 1e-4 {
+				t.Errorf("fitCalibration() = gain %v, offset %v; want %v, %v", gain, offset, tt.gain, tt.offset)
+			}
+			if math.Abs(maxErr-tt.maxErr) > 1e-4 {
+				t.Errorf("fitCalibration() max error = %v, want %v", maxErr, tt.maxErr)
+			}
+		})
+	}
+}
+
+func TestFitCalibrationRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		readings []database.CalibrationReading
+	}{
+		{"one reading", calibrationReadings(5, 5)},
+		{"same reference twice", calibrationReadings(5, 5.1, 5, 5.1)},
+		{"zero reference", calibrationReadings(0, 0, 5, 5)},
+		{"negative reading", calibrationReadings(1, -1, 5, 5)},
+		{"gain too high", calibrationReadings(1, 0.5, 10, 5)},
+		{"offset too large", calibrationReadings(5, 2, 10, 7)},
+		{"not linear", calibrationReadings(1, 1, 5, 5.5, 10, 10)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := fitCalibration(tt.readings); err == nil {
+				t.Errorf("fitCalibration() accepted %v", tt.readings)
+			}
+		})
+	}
+}
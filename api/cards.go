@@ -0,0 +1,396 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// RegisterCardRequest represents a card registration request
+type RegisterCardRequest struct {
+	CardUID string `json:"card_uid"`
+	Label   string `json:"label"`
+}
+
+// BlockCardRequest represents a request to block a card
+type BlockCardRequest struct {
+	Reason string `json:"reason"` // lost/blocked
+}
+
+// CardSessionRequest represents a station posting a scanned card
+type CardSessionRequest struct {
+	CardUID string `json:"card_uid"`
+}
+
+// normalizeCardUID strips separators and upper-cases a card UID so that
+// "04:a2:2b:1c" and "04A22B1C" refer to the same card
+func normalizeCardUID(uid string) string {
+	uid = strings.ToUpper(uid)
+	return strings.NewReplacer(":", "", "-", "", " ", "").Replace(uid)
+}
+
+// getUserCards lists the cards registered to the current user
+func getUserCards(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid user",
+		})
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, user_id, card_uid, COALESCE(label, ''), status, created_at, blocked_at
+		FROM user_cards
+		WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, userID)
+
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve cards",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var cards []database.UserCard
+	for rows.Next() {
+		var card database.UserCard
+		var blockedAt sql.NullTime
+		err := rows.Scan(&card.ID, &card.UserID, &card.CardUID, &card.Label,
+			&card.Status, &card.CreatedAt, &blockedAt)
+		if err != nil {
+			continue
+		}
+		if blockedAt.Valid {
+			card.BlockedAt = &blockedAt.Time
+		}
+		cards = append(cards, card)
+	}
+
+	if cards == nil {
+		cards = []database.UserCard{}
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    cards,
+	})
+}
+
+// registerCard links a new card UID to the current user
+func registerCard(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid user",
+		})
+		return
+	}
+
+	var req RegisterCardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	cardUID := normalizeCardUID(req.CardUID)
+	if cardUID == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Card UID is required",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(
+		"INSERT INTO user_cards (user_id, card_uid, label, status) VALUES (?, ?, ?, ?)",
+		userID, cardUID, req.Label, "active",
+	)
+	if err != nil {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Card already registered",
+		})
+		return
+	}
+
+	cardID, _ := result.LastInsertId()
+
+	log.Printf("Card registered: user=%d, card=%s", userID, cardUID)
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Card registered successfully",
+		Data: map[string]interface{}{
+			"id":       cardID,
+			"card_uid": cardUID,
+			"label":    req.Label,
+			"status":   "active",
+		},
+	})
+}
+
+// blockCard reports a card as lost or blocked so stations stop accepting it
+func blockCard(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid user",
+		})
+		return
+	}
+
+	cardID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid card ID",
+		})
+		return
+	}
+
+	// Body is optional; default to reporting the card as lost
+	var req BlockCardRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	status := req.Reason
+	if status == "" {
+		status = "lost"
+	}
+	if status != "lost" && status != "blocked" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Reason must be lost or blocked",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(
+		"UPDATE user_cards SET status = ?, blocked_at = ? WHERE id = ? AND user_id = ?",
+		status, time.Now(), cardID, userID,
+	)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to block card",
+		})
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Card not found",
+		})
+		return
+	}
+
+	log.Printf("Card blocked: user=%d, card_id=%d, reason=%s", userID, cardID, status)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Card blocked",
+	})
+}
+
+// unblockCard lets admins reactivate a lost or blocked card, e.g. once it
+// has been found
+func unblockCard(w http.ResponseWriter, r *http.Request) {
+	cardID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid card ID",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(
+		"UPDATE user_cards SET status = 'active', blocked_at = NULL WHERE id = ? AND status IN ('lost', 'blocked')",
+		cardID,
+	)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to unblock card",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Blocked card not found",
+		})
+		return
+	}
+
+	adminID, _ := getUserIDFromHeader(r)
+	log.Printf("Card unblocked: card_id=%d, admin=%d", cardID, adminID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Card unblocked",
+	})
+}
+
+// deleteCard removes a card so its UID can be registered again, to the same
+// or another account
+func deleteCard(w http.ResponseWriter, r *http.Request) {
+	cardID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid card ID",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec("DELETE FROM user_cards WHERE id = ?", cardID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete card",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Card not found",
+		})
+		return
+	}
+
+	adminID, _ := getUserIDFromHeader(r)
+	log.Printf("Card deleted: card_id=%d, admin=%d", cardID, adminID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Card deleted",
+	})
+}
+
+// cardSession starts a station session for the owner of a scanned card.
+// The station gets a token that can only deposit into this session, never a
+// user token, so a cloned card gives no access to the account itself.
+func cardSession(w http.ResponseWriter, r *http.Request) {
+	stationID, err := getStationIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid station",
+		})
+		return
+	}
+
+	if _, err := loadOpenStation(stationID); err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	var req CardSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	cardUID := normalizeCardUID(req.CardUID)
+	if cardUID == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Card UID is required",
+		})
+		return
+	}
+
+	// Look up card owner
+	var user database.User
+	var cardStatus string
+	err = database.DB.QueryRow(`
+		SELECT u.id, u.name, u.total_points, c.status
+		FROM user_cards c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.card_uid = ?
+	`, cardUID).Scan(&user.ID, &user.Name, &user.TotalPoints, &cardStatus)
+
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Card not registered",
+		})
+		return
+	}
+
+	if cardStatus != "active" {
+		log.Printf("cardSession: rejected %s card %s at station %d", cardStatus, cardUID, stationID)
+		respondJSON(w, http.StatusForbidden, Response{
+			Success: false,
+			Error:   "Card has been blocked",
+		})
+		return
+	}
+
+	sessionToken := uuid.New().String()
+	expiresAt := stationSessionExpiry(stationID)
+
+	_, err = database.DB.Exec(`
+		INSERT INTO station_sessions (session_token, station_id, user_id, status, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, sessionToken, strconv.Itoa(stationID), user.ID, "connected", expiresAt.Format(time.RFC3339))
+
+	if err != nil {
+		log.Printf("cardSession: failed to insert session: %v", err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create session",
+		})
+		return
+	}
+
+	// Deposits into the session need a token; it is limited to this session
+	authToken, err := generateSessionJWT(user.ID, sessionToken, expiresAt)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate session token",
+		})
+		return
+	}
+
+	log.Printf("User %d connected to session %s by card at station %d", user.ID, sessionToken, stationID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "User connected to station session",
+		Data: map[string]interface{}{
+			"sessionToken": sessionToken,
+			"expiresAt":    expiresAt.Format(time.RFC3339),
+			"status":       "connected",
+			"authToken":    authToken,
+			"userId":       user.ID,
+			"userName":     user.Name,
+			"userBalance":  user.TotalPoints,
+		},
+	})
+}
@@ -0,0 +1,947 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Reconciliation tolerances. A pickup is flagged when the depot weight differs
+// from the recorded deposits by more than the larger of the two.
+const (
+	collectionToleranceKg  = 0.5
+	collectionTolerancePct = 10.0
+	maxRunStops            = 50
+	defaultDiscrepancyDays = 90
+)
+
+// CollectionRunRequest represents a collection run scheduled by an admin
+type CollectionRunRequest struct {
+	HaulerID     int       `json:"hauler_id"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+	StationIDs   []int     `json:"station_ids"` // in visiting order
+	Notes        string    `json:"notes"`
+}
+
+// PickupRequest represents the bins emptied at a stop. All of the station's
+// bins are emptied when no materials are given.
+type PickupRequest struct {
+	Materials []string `json:"materials"`
+}
+
+// SkipStopRequest represents a stop the hauler could not collect from
+type SkipStopRequest struct {
+	Reason string `json:"reason"`
+}
+
+// DepotWeighing is the weight measured at the depot for one pickup
+type DepotWeighing struct {
+	PickupID      int     `json:"pickup_id"`
+	DepotWeightKg float64 `json:"depot_weight_kg"`
+}
+
+// DepotWeightRequest represents the depot weights for a run's pickups
+type DepotWeightRequest struct {
+	Pickups []DepotWeighing `json:"pickups"`
+}
+
+// runSelect selects the columns scanned by scanRun
+const runSelect = `SELECT cr.id, cr.hauler_id, COALESCE(u.name, ''), cr.scheduled_for, cr.status,
+	COALESCE(cr.notes, ''), COALESCE(cr.created_by, 0), cr.created_at, cr.started_at, cr.completed_at
+	FROM collection_runs cr LEFT JOIN users u ON u.id = cr.hauler_id`
+
+// scanRun scans a row selected with runSelect
+func scanRun(row rowScanner) (database.CollectionRun, error) {
+	var run database.CollectionRun
+	var startedAt, completedAt sql.NullTime
+	err := row.Scan(&run.ID, &run.HaulerID, &run.HaulerName, &run.ScheduledFor, &run.Status,
+		&run.Notes, &run.CreatedBy, &run.CreatedAt, &startedAt, &completedAt)
+	if startedAt.Valid {
+		run.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		run.CompletedAt = &completedAt.Time
+	}
+	return run, err
+}
+
+// loadRun retrieves a collection run by ID
+func loadRun(id int) (database.CollectionRun, error) {
+	return scanRun(database.DB.QueryRow(runSelect+" WHERE cr.id = ?", id))
+}
+
+// pickupColumns lists the columns scanned by scanPickup
+const pickupColumns = `id, run_id, station_id, material, deposits, recorded_weight_kg, recorded_raw_kg,
+	fill_percent, period_start, picked_up_at, depot_weight_kg, discrepancy_kg, discrepancy_pct, flagged, weighed_at`
+
+// scanPickup scans a row selected with pickupColumns
+func scanPickup(row rowScanner) (database.CollectionPickup, error) {
+	var pickup database.CollectionPickup
+	var depotWeight, discrepancyKg, discrepancyPct sql.NullFloat64
+	var weighedAt sql.NullTime
+	err := row.Scan(&pickup.ID, &pickup.RunID, &pickup.StationID, &pickup.Material, &pickup.Deposits,
+		&pickup.RecordedWeightKg, &pickup.RecordedRawKg, &pickup.FillPercent, &pickup.PeriodStart,
+		&pickup.PickedUpAt, &depotWeight, &discrepancyKg, &discrepancyPct, &pickup.Flagged, &weighedAt)
+	if depotWeight.Valid {
+		pickup.DepotWeightKg = &depotWeight.Float64
+	}
+	if discrepancyKg.Valid {
+		pickup.DiscrepancyKg = &discrepancyKg.Float64
+	}
+	if discrepancyPct.Valid {
+		pickup.DiscrepancyPct = &discrepancyPct.Float64
+	}
+	if weighedAt.Valid {
+		pickup.WeighedAt = &weighedAt.Time
+	}
+	return pickup, err
+}
+
+// loadRunDetails fills in a run's stops and pickup manifest
+func loadRunDetails(run *database.CollectionRun) error {
+	rows, err := database.DB.Query(`
+		SELECT cs.id, cs.run_id, cs.station_id, COALESCE(s.location, ''), cs.sequence, cs.status,
+			COALESCE(cs.skip_reason, ''), cs.visited_at
+		FROM collection_stops cs
+		LEFT JOIN stations s ON s.id = cs.station_id
+		WHERE cs.run_id = ?
+		ORDER BY cs.sequence
+	`, run.ID)
+	if err != nil {
+		return err
+	}
+	run.Stops = []database.CollectionStop{}
+	for rows.Next() {
+		var stop database.CollectionStop
+		var visitedAt sql.NullTime
+		if err := rows.Scan(&stop.ID, &stop.RunID, &stop.StationID, &stop.Location, &stop.Sequence,
+			&stop.Status, &stop.SkipReason, &visitedAt); err != nil {
+			continue
+		}
+		if visitedAt.Valid {
+			stop.VisitedAt = &visitedAt.Time
+		}
+		run.Stops = append(run.Stops, stop)
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(
+		"SELECT "+pickupColumns+" FROM collection_pickups WHERE run_id = ? ORDER BY id", run.ID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	run.Pickups = []database.CollectionPickup{}
+	for rows.Next() {
+		pickup, err := scanPickup(rows)
+		if err != nil {
+			continue
+		}
+		run.Pickups = append(run.Pickups, pickup)
+	}
+	return rows.Err()
+}
+
+// loadRunForHauler retrieves a run from the URL that the current user may
+// work on. Haulers may only work on runs assigned to them.
+func loadRunForHauler(w http.ResponseWriter, r *http.Request) (database.CollectionRun, bool) {
+	userID, _ := getUserIDFromHeader(r)
+
+	runID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid run ID",
+		})
+		return database.CollectionRun{}, false
+	}
+
+	run, err := loadRun(runID)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Collection run not found",
+		})
+		return run, false
+	}
+
+	if run.HaulerID != userID && userRole(userID) != "admin" {
+		respondJSON(w, http.StatusForbidden, Response{
+			Success: false,
+			Error:   "Collection run is not assigned to you",
+		})
+		return run, false
+	}
+
+	return run, true
+}
+
+// respondRunDetails responds with a run and its stops and pickups
+func respondRunDetails(w http.ResponseWriter, status int, message string, runID int) {
+	run, err := loadRun(runID)
+	if err == nil {
+		err = loadRunDetails(&run)
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to load collection run",
+		})
+		return
+	}
+
+	respondJSON(w, status, Response{
+		Success: true,
+		Message: message,
+		Data:    run,
+	})
+}
+
+// lastPickupAt returns when a bin was last emptied by a hauler
+func lastPickupAt(stationID int, material string) (time.Time, bool) {
+	var last sql.NullTime
+	database.DB.QueryRow(`
+		SELECT picked_up_at FROM collection_pickups
+		WHERE station_id = ? AND material = ?
+		ORDER BY picked_up_at DESC LIMIT 1
+	`, stationID, material).Scan(&last)
+	return last.Time, last.Valid
+}
+
+// reconcilePickup compares a depot weight with the recorded deposits
+func reconcilePickup(recordedKg, depotKg float64) (discrepancyKg float64, discrepancyPct *float64, flagged bool) {
+	discrepancyKg = math.Round((depotKg-recordedKg)*1000) / 1000
+	tolerance := collectionToleranceKg
+	if recordedKg > 0 {
+		pct := math.Round(discrepancyKg/recordedKg*1000) / 10
+		discrepancyPct = &pct
+		tolerance = math.Max(tolerance, recordedKg*collectionTolerancePct/100)
+	}
+	return discrepancyKg, discrepancyPct, math.Abs(discrepancyKg) > tolerance
+}
+
+// createCollectionRun schedules a run for a hauler over a list of stations
+func createCollectionRun(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := getUserIDFromHeader(r)
+
+	var req CollectionRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	if userRole(req.HaulerID) != "hauler" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "hauler_id must be a user with the hauler role",
+		})
+		return
+	}
+	if req.ScheduledFor.IsZero() {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "scheduled_for is required",
+		})
+		return
+	}
+	if len(req.StationIDs) == 0 || len(req.StationIDs) > maxRunStops {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   fmt.Sprintf("station_ids must list 1-%d stations", maxRunStops),
+		})
+		return
+	}
+
+	seen := make(map[int]bool)
+	for _, stationID := range req.StationIDs {
+		if seen[stationID] {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("Station %d is listed twice", stationID),
+			})
+			return
+		}
+		seen[stationID] = true
+
+		if _, err := loadActiveStation(stationID); err != nil {
+			respondStationError(w, err)
+			return
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to schedule collection run",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO collection_runs (hauler_id, scheduled_for, status, notes, created_by, created_at)
+		VALUES (?, ?, 'scheduled', ?, ?, ?)
+	`, req.HaulerID, req.ScheduledFor.UTC(), strings.TrimSpace(req.Notes), adminID, time.Now().UTC())
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to schedule collection run",
+		})
+		return
+	}
+	runID, _ := result.LastInsertId()
+
+	for i, stationID := range req.StationIDs {
+		_, err = tx.Exec(
+			"INSERT INTO collection_stops (run_id, station_id, sequence) VALUES (?, ?, ?)",
+			runID, stationID, i+1,
+		)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to schedule collection run",
+			})
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to schedule collection run",
+		})
+		return
+	}
+
+	log.Printf("Collection run %d scheduled for hauler %d with %d stops", runID, req.HaulerID, len(req.StationIDs))
+	respondRunDetails(w, http.StatusCreated, "Collection run scheduled", int(runID))
+}
+
+// listCollectionRuns lists collection runs, soonest first. Haulers only see
+// their own runs; admins may filter by hauler_id.
+func listCollectionRuns(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	query := runSelect + " WHERE 1 = 1"
+	var args []interface{}
+	if userRole(userID) != "admin" {
+		query += " AND cr.hauler_id = ?"
+		args = append(args, userID)
+	} else if haulerID := r.URL.Query().Get("hauler_id"); haulerID != "" {
+		query += " AND cr.hauler_id = ?"
+		args = append(args, haulerID)
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND cr.status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY cr.scheduled_for, cr.id LIMIT 100"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve collection runs",
+		})
+		return
+	}
+	defer rows.Close()
+
+	runs := []database.CollectionRun{}
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    runs,
+	})
+}
+
+// getCollectionRun returns a run with its stops and pickup manifest
+func getCollectionRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := loadRunForHauler(w, r)
+	if !ok {
+		return
+	}
+	respondRunDetails(w, http.StatusOK, "", run.ID)
+}
+
+// startCollectionRun marks a scheduled run as under way
+func startCollectionRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := loadRunForHauler(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE collection_runs SET status = 'in_progress', started_at = ?
+		WHERE id = ? AND status = 'scheduled'
+	`, time.Now().UTC(), run.ID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to start collection run",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Collection run is already " + run.Status,
+		})
+		return
+	}
+
+	respondRunDetails(w, http.StatusOK, "Collection run started", run.ID)
+}
+
+// loadRunStop retrieves the pending stop for the station in the URL. The run
+// is started automatically by its first stop.
+func loadRunStop(w http.ResponseWriter, r *http.Request, run database.CollectionRun) (database.Station, bool) {
+	if run.Status != "scheduled" && run.Status != "in_progress" {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Collection run is already " + run.Status,
+		})
+		return database.Station{}, false
+	}
+
+	stationID, err := strconv.Atoi(chi.URLParam(r, "stationID"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return database.Station{}, false
+	}
+
+	var status string
+	err = database.DB.QueryRow(
+		"SELECT status FROM collection_stops WHERE run_id = ? AND station_id = ?", run.ID, stationID,
+	).Scan(&status)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Station is not on this run",
+		})
+		return database.Station{}, false
+	}
+	if status != "pending" {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Stop is already " + status,
+		})
+		return database.Station{}, false
+	}
+
+	station, err := loadStation(stationID)
+	if err != nil {
+		respondStationError(w, err)
+		return station, false
+	}
+	return station, true
+}
+
+// recordPickup records the bins emptied at a stop. Each bin's manifest line
+// totals the deposits made since it was last emptied, and the station's fill
+// level is reset.
+func recordPickup(w http.ResponseWriter, r *http.Request) {
+	run, ok := loadRunForHauler(w, r)
+	if !ok {
+		return
+	}
+	station, ok := loadRunStop(w, r, run)
+	if !ok {
+		return
+	}
+
+	var req PickupRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Invalid request body",
+			})
+			return
+		}
+	}
+
+	cfg := stationConfigOrDefault(station.ID)
+	materials := req.Materials
+	if len(materials) == 0 {
+		materials = acceptedMaterialsSorted(cfg)
+	}
+
+	now := time.Now().UTC()
+	forecasts, _ := forecastStation(station, now)
+	fillLevels := make(map[string]float64)
+	for _, forecast := range forecasts {
+		fillLevels[forecast.Material] = forecast.FillPercent
+	}
+
+	// Build the manifest before opening the write transaction
+	var pickups []database.CollectionPickup
+	for _, material := range materials {
+		material = normalizeMaterial(material)
+		if _, known := lookupMaterial(material); !known {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Unknown material: " + material,
+			})
+			return
+		}
+
+		pickup := database.CollectionPickup{
+			RunID:       run.ID,
+			StationID:   station.ID,
+			Material:    material,
+			FillPercent: fillLevels[material],
+			PeriodStart: binEmptiedAt(station, material), // deposits since the bin was last emptied
+			PickedUpAt:  now,
+		}
+		err := database.DB.QueryRow(`
+			SELECT COUNT(*), COALESCE(SUM(weight_grams), 0) / 1000.0, COALESCE(SUM(COALESCE(raw_weight_grams, weight_grams)), 0) / 1000.0
+			FROM transactions
+			WHERE station_id = ? AND type = 'deposit' AND item_type = ? AND timestamp >= ? AND timestamp < ?
+		`, station.ID, material, sqliteTime(pickup.PeriodStart), sqliteTime(now)).Scan(
+			&pickup.Deposits, &pickup.RecordedWeightKg, &pickup.RecordedRawKg)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to total deposits",
+			})
+			return
+		}
+		pickup.RecordedWeightKg = math.Round(pickup.RecordedWeightKg*1000) / 1000
+		pickup.RecordedRawKg = math.Round(pickup.RecordedRawKg*1000) / 1000
+		pickups = append(pickups, pickup)
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record pickup",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	for _, pickup := range pickups {
+		_, err = tx.Exec(`
+			INSERT INTO collection_pickups (run_id, station_id, material, deposits, recorded_weight_kg,
+				recorded_raw_kg, fill_percent, period_start, picked_up_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, pickup.RunID, pickup.StationID, pickup.Material, pickup.Deposits, pickup.RecordedWeightKg,
+			pickup.RecordedRawKg, pickup.FillPercent, pickup.PeriodStart, pickup.PickedUpAt)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE collection_stops SET status = 'collected', visited_at = ?
+			WHERE run_id = ? AND station_id = ? AND status = 'pending'
+		`, now, run.ID, station.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE collection_runs SET status = 'in_progress', started_at = ?
+			WHERE id = ? AND status = 'scheduled'
+		`, now, run.ID)
+	}
+	if err == nil && len(req.Materials) == 0 {
+		// Emptying every bin resets the station's fill level
+		_, err = tx.Exec("UPDATE stations SET bins_emptied_at = ? WHERE id = ?", now, station.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("recordPickup: failed for run %d, station %d: %v", run.ID, station.ID, err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record pickup",
+		})
+		return
+	}
+
+	log.Printf("Pickup recorded: run=%d, station=%d, bins=%d", run.ID, station.ID, len(pickups))
+	respondRunDetails(w, http.StatusOK, "Pickup recorded", run.ID)
+}
+
+// skipCollectionStop records that a stop could not be collected
+func skipCollectionStop(w http.ResponseWriter, r *http.Request) {
+	run, ok := loadRunForHauler(w, r)
+	if !ok {
+		return
+	}
+	station, ok := loadRunStop(w, r, run)
+	if !ok {
+		return
+	}
+
+	var req SkipStopRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "A reason is required",
+		})
+		return
+	}
+
+	_, err := database.DB.Exec(`
+		UPDATE collection_stops SET status = 'skipped', skip_reason = ?, visited_at = ?
+		WHERE run_id = ? AND station_id = ? AND status = 'pending'
+	`, strings.TrimSpace(req.Reason), time.Now().UTC(), run.ID, station.ID)
+	if err == nil {
+		_, err = database.DB.Exec(`
+			UPDATE collection_runs SET status = 'in_progress', started_at = ?
+			WHERE id = ? AND status = 'scheduled'
+		`, time.Now().UTC(), run.ID)
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to skip stop",
+		})
+		return
+	}
+
+	respondRunDetails(w, http.StatusOK, "Stop skipped", run.ID)
+}
+
+// completeCollectionRun closes a run once every stop is collected or skipped
+func completeCollectionRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := loadRunForHauler(w, r)
+	if !ok {
+		return
+	}
+	if run.Status != "in_progress" {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Only runs in progress can be completed",
+		})
+		return
+	}
+
+	var pending int
+	database.DB.QueryRow(
+		"SELECT COUNT(*) FROM collection_stops WHERE run_id = ? AND status = 'pending'", run.ID,
+	).Scan(&pending)
+	if pending > 0 {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   fmt.Sprintf("%d stops have not been collected or skipped", pending),
+		})
+		return
+	}
+
+	_, err := database.DB.Exec(`
+		UPDATE collection_runs SET status = 'completed', completed_at = ?
+		WHERE id = ? AND status = 'in_progress'
+	`, time.Now().UTC(), run.ID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to complete collection run",
+		})
+		return
+	}
+
+	respondRunDetails(w, http.StatusOK, "Collection run completed", run.ID)
+}
+
+// cancelCollectionRun cancels a run before anything has been picked up
+func cancelCollectionRun(w http.ResponseWriter, r *http.Request) {
+	runID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid run ID",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE collection_runs SET status = 'cancelled', completed_at = ?
+		WHERE id = ? AND status IN ('scheduled', 'in_progress')
+			AND NOT EXISTS (SELECT 1 FROM collection_pickups WHERE run_id = ?)
+	`, time.Now().UTC(), runID, runID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to cancel collection run",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Only runs with no pickups can be cancelled",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Collection run cancelled",
+	})
+}
+
+// recordDepotWeights records the weights measured at the depot for a run's
+// pickups and reconciles each against the deposits recorded at the station
+func recordDepotWeights(w http.ResponseWriter, r *http.Request) {
+	run, ok := loadRunForHauler(w, r)
+	if !ok {
+		return
+	}
+	if run.Status != "in_progress" && run.Status != "completed" {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Collection run is " + run.Status,
+		})
+		return
+	}
+
+	var req DepotWeightRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Pickups) == 0 {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "pickups is required",
+		})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record depot weights",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var flagged []database.CollectionPickup
+	for _, weighing := range req.Pickups {
+		if weighing.DepotWeightKg < 0 {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "depot_weight_kg must not be negative",
+			})
+			return
+		}
+
+		pickup, err := scanPickup(tx.QueryRow(
+			"SELECT "+pickupColumns+" FROM collection_pickups WHERE id = ? AND run_id = ?",
+			weighing.PickupID, run.ID,
+		))
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("Pickup %d is not on this run", weighing.PickupID),
+			})
+			return
+		}
+		if pickup.WeighedAt != nil {
+			respondJSON(w, http.StatusConflict, Response{
+				Success: false,
+				Error:   fmt.Sprintf("Pickup %d has already been weighed", weighing.PickupID),
+			})
+			return
+		}
+
+		discrepancyKg, discrepancyPct, isFlagged := reconcilePickup(pickup.RecordedWeightKg, weighing.DepotWeightKg)
+		_, err = tx.Exec(`
+			UPDATE collection_pickups
+			SET depot_weight_kg = ?, discrepancy_kg = ?, discrepancy_pct = ?, flagged = ?, weighed_at = ?
+			WHERE id = ?
+		`, weighing.DepotWeightKg, discrepancyKg, discrepancyPct, isFlagged, now, pickup.ID)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to record depot weights",
+			})
+			return
+		}
+
+		if isFlagged {
+			pickup.DepotWeightKg = &weighing.DepotWeightKg
+			pickup.DiscrepancyKg = &discrepancyKg
+			flagged = append(flagged, pickup)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record depot weights",
+		})
+		return
+	}
+
+	for _, pickup := range flagged {
+		direction := "more"
+		if *pickup.DiscrepancyKg < 0 {
+			direction = "less"
+		}
+		raiseAlert(pickup.StationID, "collection_discrepancy", fmt.Sprintf(
+			"Depot weighed %.2f kg of %s from run %d, %.2f kg %s than the %.2f kg deposited",
+			*pickup.DepotWeightKg, pickup.Material, run.ID, math.Abs(*pickup.DiscrepancyKg), direction,
+			pickup.RecordedWeightKg))
+	}
+
+	respondRunDetails(w, http.StatusOK, "Depot weights recorded", run.ID)
+}
+
+// getCollectionDiscrepancies reports, per station, how depot weights compare
+// with recorded deposits and lists the flagged pickups
+func getCollectionDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	days := defaultDiscrepancyDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxDeviationDays {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("days must be between 1 and %d", maxDeviationDays),
+			})
+			return
+		}
+		days = parsed
+	}
+	windowStart := time.Now().UTC().AddDate(0, 0, -days)
+
+	rows, err := database.DB.Query(`
+		SELECT p.station_id, COALESCE(s.location, ''), COUNT(*), SUM(p.recorded_weight_kg),
+			SUM(p.depot_weight_kg), SUM(CASE WHEN p.flagged THEN 1 ELSE 0 END)
+		FROM collection_pickups p
+		LEFT JOIN stations s ON s.id = p.station_id
+		WHERE p.weighed_at >= ?
+		GROUP BY p.station_id
+		ORDER BY p.station_id
+	`, windowStart)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to build discrepancy report",
+		})
+		return
+	}
+
+	stations := []map[string]interface{}{}
+	for rows.Next() {
+		var stationID, pickups, flaggedCount int
+		var location string
+		var recordedKg, depotKg float64
+		if err := rows.Scan(&stationID, &location, &pickups, &recordedKg, &depotKg, &flaggedCount); err != nil {
+			continue
+		}
+		discrepancyKg, discrepancyPct, _ := reconcilePickup(recordedKg, depotKg)
+		stations = append(stations, map[string]interface{}{
+			"station_id":      stationID,
+			"location":        location,
+			"pickups":         pickups,
+			"flagged_pickups": flaggedCount,
+			"recorded_kg":     math.Round(recordedKg*1000) / 1000,
+			"depot_kg":        math.Round(depotKg*1000) / 1000,
+			"discrepancy_kg":  discrepancyKg,
+			"discrepancy_pct": discrepancyPct,
+		})
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT `+pickupColumns+` FROM collection_pickups
+		WHERE flagged = 1 AND weighed_at >= ?
+		ORDER BY weighed_at DESC
+		LIMIT 200
+	`, windowStart)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to build discrepancy report",
+		})
+		return
+	}
+	defer rows.Close()
+
+	flagged := []database.CollectionPickup{}
+	for rows.Next() {
+		pickup, err := scanPickup(rows)
+		if err != nil {
+			continue
+		}
+		flagged = append(flagged, pickup)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"window_days": days,
+			"stations":    stations,
+			"flagged":     flagged,
+		},
+	})
+}
+
+// listHaulers lists haulers with their count of unfinished runs
+func listHaulers(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.name, COALESCE(u.email, ''), COALESCE(u.phone, ''),
+			(SELECT COUNT(*) FROM collection_runs cr
+			 WHERE cr.hauler_id = u.id AND cr.status IN ('scheduled', 'in_progress'))
+		FROM users u
+		WHERE u.role = 'hauler'
+		ORDER BY u.name
+	`)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve haulers",
+		})
+		return
+	}
+	defer rows.Close()
+
+	haulers := []map[string]interface{}{}
+	for rows.Next() {
+		var id, openRuns int
+		var name, email, phone string
+		if err := rows.Scan(&id, &name, &email, &phone, &openRuns); err != nil {
+			continue
+		}
+		haulers = append(haulers, map[string]interface{}{
+			"id":        id,
+			"name":      name,
+			"email":     email,
+			"phone":     phone,
+			"open_runs": openRuns,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    haulers,
+	})
+}
@@ -0,0 +1,436 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Command delivery settings
+const (
+	commandAckTimeout      = 30 * time.Second // a sent command is redelivered if not acknowledged in time
+	maxCommandAttempts     = 3
+	defaultCommandTTL      = time.Hour // how long a command waits for an offline station
+	maxCommandTTL          = 7 * 24 * time.Hour
+	commandCheckEvery      = 10 * time.Second
+	maxMessageLength       = 200
+	defaultMessageDuration = 60
+	commandHistoryPageSize = 100
+)
+
+// commandTypes lists the commands stations understand
+var commandTypes = map[string]bool{
+	"lock":         true,
+	"unlock":       true,
+	"open_door":    true,
+	"reboot":       true,
+	"show_message": true,
+}
+
+// unsafeCommands are not repeated if their acknowledgement is missing, since
+// carrying them out twice does harm. They are sent at most once.
+var unsafeCommands = map[string]bool{
+	"open_door": true,
+	"reboot":    true,
+}
+
+// CommandRequest represents a command issued to a station
+type CommandRequest struct {
+	Command    string          `json:"command"`
+	Payload    json.RawMessage `json:"payload"`
+	TTLSeconds int             `json:"ttl_seconds"`
+}
+
+// CommandAck is sent by a station after it has carried out a command
+type CommandAck struct {
+	Type      string `json:"type"` // ack
+	CommandID int    `json:"command_id"`
+	Status    string `json:"status"` // ok/error
+	Message   string `json:"message"`
+}
+
+// OpenDoorPayload is the payload of an open_door command
+type OpenDoorPayload struct {
+	Material string `json:"material"`
+}
+
+// ShowMessagePayload is the payload of a show_message command
+type ShowMessagePayload struct {
+	Text            string `json:"text"`
+	DurationSeconds int    `json:"duration_seconds"`
+}
+
+// validateCommand checks a command's payload and returns it normalized
+func validateCommand(command string, payload json.RawMessage) ([]byte, error) {
+	if !commandTypes[command] {
+		return nil, fmt.Errorf("unknown command %q", command)
+	}
+	if len(payload) == 0 || string(payload) == "null" {
+		payload = json.RawMessage("{}")
+	}
+
+	switch command {
+	case "open_door":
+		var p OpenDoorPayload
+		if err := unmarshalStrict(payload, &p); err != nil {
+			return nil, err
+		}
+		p.Material = normalizeMaterial(p.Material)
+		if _, active := activeMaterial(p.Material); !active {
+			return nil, errors.New("payload.material must name a bin")
+		}
+		return json.Marshal(p)
+	case "show_message":
+		var p ShowMessagePayload
+		if err := unmarshalStrict(payload, &p); err != nil {
+			return nil, err
+		}
+		p.Text = strings.TrimSpace(p.Text)
+		if p.Text == "" || len(p.Text) > maxMessageLength {
+			return nil, fmt.Errorf("payload.text must be 1-%d characters", maxMessageLength)
+		}
+		if p.DurationSeconds == 0 {
+			p.DurationSeconds = defaultMessageDuration
+		}
+		if p.DurationSeconds < 0 || p.DurationSeconds > 24*60*60 {
+			return nil, errors.New("payload.duration_seconds must be at most one day")
+		}
+		return json.Marshal(p)
+	default:
+		var p struct{}
+		if err := unmarshalStrict(payload, &p); err != nil {
+			return nil, fmt.Errorf("%s takes no payload", command)
+		}
+		return []byte("{}"), nil
+	}
+}
+
+// commandColumns lists the columns scanned by scanCommand
+const commandColumns = `id, station_id, command, payload, status, attempts, COALESCE(result, ''),
+	COALESCE(issued_by, 0), created_at, sent_at, completed_at, expires_at`
+
+// scanCommand scans a row selected with commandColumns
+func scanCommand(row rowScanner) (database.StationCommand, error) {
+	var cmd database.StationCommand
+	var payload string
+	var sentAt, completedAt sql.NullTime
+	err := row.Scan(&cmd.ID, &cmd.StationID, &cmd.Command, &payload, &cmd.Status, &cmd.Attempts,
+		&cmd.Result, &cmd.IssuedBy, &cmd.CreatedAt, &sentAt, &completedAt, &cmd.ExpiresAt)
+	cmd.Payload = json.RawMessage(payload)
+	if sentAt.Valid {
+		cmd.SentAt = &sentAt.Time
+	}
+	if completedAt.Valid {
+		cmd.CompletedAt = &completedAt.Time
+	}
+	return cmd, err
+}
+
+// loadCommand retrieves a command by ID
+func loadCommand(id int) (database.StationCommand, error) {
+	return scanCommand(database.DB.QueryRow(
+		"SELECT "+commandColumns+" FROM station_commands WHERE id = ?", id,
+	))
+}
+
+// deliverCommand sends a queued command to one connection of a station. The
+// command is marked sent first so a concurrent delivery cannot send it twice,
+// and returned to the queue if no connection accepted it.
+func deliverCommand(cmd database.StationCommand) bool {
+	now := time.Now().UTC()
+	result, err := database.DB.Exec(`
+		UPDATE station_commands SET status = 'sent', attempts = attempts + 1, sent_at = ?
+		WHERE id = ? AND status = 'queued'
+	`, now, cmd.ID)
+	if err != nil {
+		return false
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false
+	}
+
+	delivered := pushToStationOnce(cmd.StationID, map[string]interface{}{
+		"type":       "command",
+		"id":         cmd.ID,
+		"command":    cmd.Command,
+		"payload":    cmd.Payload,
+		"attempt":    cmd.Attempts + 1,
+		"expires_at": cmd.ExpiresAt,
+	})
+	if !delivered {
+		database.DB.Exec(`
+			UPDATE station_commands SET status = 'queued', attempts = attempts - 1, sent_at = NULL
+			WHERE id = ? AND status = 'sent'
+		`, cmd.ID)
+		return false
+	}
+
+	log.Printf("Command %d (%s) sent to station %d", cmd.ID, cmd.Command, cmd.StationID)
+	return true
+}
+
+// deliverQueuedCommands sends a station's queued commands, oldest first
+func deliverQueuedCommands(stationID int) {
+	rows, err := database.DB.Query(`
+		SELECT `+commandColumns+` FROM station_commands
+		WHERE station_id = ? AND status = 'queued' AND expires_at > ?
+		ORDER BY id
+	`, stationID, time.Now().UTC())
+	if err != nil {
+		log.Printf("deliverQueuedCommands: failed to load commands for station %d: %v", stationID, err)
+		return
+	}
+
+	var queued []database.StationCommand
+	for rows.Next() {
+		cmd, err := scanCommand(rows)
+		if err != nil {
+			continue
+		}
+		queued = append(queued, cmd)
+	}
+	rows.Close()
+
+	for _, cmd := range queued {
+		if !deliverCommand(cmd) {
+			// Keep the order: later commands wait for the next attempt
+			return
+		}
+	}
+}
+
+// handleCommandAck records the outcome a station reports for a command. Late
+// acknowledgements are still recorded, since they reflect what the station did.
+func handleCommandAck(stationID int, ack CommandAck) {
+	status := "succeeded"
+	if ack.Status != "ok" {
+		status = "failed"
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE station_commands SET status = ?, result = ?, completed_at = ?
+		WHERE id = ? AND station_id = ? AND status IN ('queued', 'sent', 'timed_out')
+	`, status, ack.Message, time.Now().UTC(), ack.CommandID, stationID)
+	if err != nil {
+		log.Printf("handleCommandAck: failed to record ack for command %d: %v", ack.CommandID, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+
+	log.Printf("Command %d %s on station %d", ack.CommandID, status, stationID)
+}
+
+// checkCommandTimeouts expires commands that waited too long, redelivers
+// unacknowledged safe commands and delivers queued commands to connected
+// stations. Unacknowledged unsafe commands time out after one attempt.
+func checkCommandTimeouts() {
+	now := time.Now().UTC()
+
+	_, err := database.DB.Exec(`
+		UPDATE station_commands SET status = 'expired', completed_at = ?
+		WHERE status = 'queued' AND expires_at <= ?
+	`, now, now)
+	if err != nil {
+		log.Printf("checkCommandTimeouts: failed to expire commands: %v", err)
+	}
+
+	overdue := now.Add(-commandAckTimeout)
+	for command := range unsafeCommands {
+		database.DB.Exec(`
+			UPDATE station_commands SET status = 'timed_out', completed_at = ?
+			WHERE status = 'sent' AND sent_at <= ? AND command = ?
+		`, now, overdue, command)
+	}
+	database.DB.Exec(`
+		UPDATE station_commands SET status = 'timed_out', completed_at = ?
+		WHERE status = 'sent' AND sent_at <= ? AND (attempts >= ? OR expires_at <= ?)
+	`, now, overdue, maxCommandAttempts, now)
+	database.DB.Exec(`
+		UPDATE station_commands SET status = 'queued'
+		WHERE status = 'sent' AND sent_at <= ?
+	`, overdue)
+
+	for _, stationID := range hub.stationIDs() {
+		deliverQueuedCommands(stationID)
+	}
+}
+
+// issueStationCommand queues a command for a station and sends it right away
+// if the station is connected
+func issueStationCommand(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	if _, err := loadStation(stationID); err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	var req CommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	payload, err := validateCommand(req.Command, req.Payload)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid command: " + err.Error(),
+		})
+		return
+	}
+
+	ttl := defaultCommandTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+		if ttl < commandAckTimeout || ttl > maxCommandTTL {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "ttl_seconds must be between 30 and 604800",
+			})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	result, err := database.DB.Exec(`
+		INSERT INTO station_commands (station_id, command, payload, status, issued_by, created_at, expires_at)
+		VALUES (?, ?, ?, 'queued', ?, ?, ?)
+	`, stationID, req.Command, string(payload), userID, now, now.Add(ttl))
+	if err != nil {
+		log.Printf("issueStationCommand: failed to queue command: %v", err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to queue command",
+		})
+		return
+	}
+
+	commandID, _ := result.LastInsertId()
+	log.Printf("Command %d (%s) issued to station %d by user %d", commandID, req.Command, stationID, userID)
+
+	// Deliver in order behind anything already queued
+	deliverQueuedCommands(stationID)
+
+	cmd, _ := loadCommand(int(commandID))
+
+	message := "Command sent"
+	if cmd.Status == "queued" {
+		message = "Station is not connected; command queued"
+	}
+
+	respondJSON(w, http.StatusAccepted, Response{
+		Success: true,
+		Message: message,
+		Data:    cmd,
+	})
+}
+
+// getStationCommands lists a station's command history, newest first
+func getStationCommands(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	query := "SELECT " + commandColumns + " FROM station_commands WHERE station_id = ?"
+	args := []interface{}{stationID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, commandHistoryPageSize)
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve commands",
+		})
+		return
+	}
+	defer rows.Close()
+
+	commands := []database.StationCommand{}
+	for rows.Next() {
+		cmd, err := scanCommand(rows)
+		if err != nil {
+			continue
+		}
+		commands = append(commands, cmd)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"station_id": stationID,
+			"connected":  len(hub.connections(stationID)) > 0,
+			"commands":   commands,
+		},
+	})
+}
+
+// cancelStationCommand cancels a command that has not been sent yet
+func cancelStationCommand(w http.ResponseWriter, r *http.Request) {
+	stationID, stationErr := strconv.Atoi(chi.URLParam(r, "id"))
+	commandID, commandErr := strconv.Atoi(chi.URLParam(r, "commandID"))
+	if err := errors.Join(stationErr, commandErr); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station or command ID",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE station_commands SET status = 'cancelled', completed_at = ?
+		WHERE id = ? AND station_id = ? AND status = 'queued'
+	`, time.Now().UTC(), commandID, stationID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to cancel command",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Only queued commands can be cancelled",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Command cancelled",
+	})
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"os"
+	"testing"
+
+	"t2cbackend/database"
+)
+
+// openTestDB initializes a fresh database in a temporary directory. InitDB
+// always opens ./trash2cash.db, so the test runs from that directory.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitDB(); err != nil {
+		os.Chdir(wd)
+		t.Fatalf("InitDB() error = %v", err)
+	}
+	materialCatalog.invalidate()
+
+	t.Cleanup(func() {
+		database.CloseDB()
+		materialCatalog.invalidate()
+		os.Chdir(wd)
+	})
+}
@@ -0,0 +1,372 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"t2cbackend/database"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxDepositLines limits the line items in one multi-item deposit
+const maxDepositLines = 50
+
+// DepositLineRequest represents one line item of a multi-item deposit
+type DepositLineRequest struct {
+	Material        string         `json:"material"`
+	Weight          database.Grams `json:"weight"`
+	Count           int            `json:"count,omitempty"`           // counted materials
+	ContainerSizeML int            `json:"containerSizeMl,omitempty"` // counted materials
+	Barcode         string         `json:"barcode,omitempty"`         // sets the material for catalogued products
+}
+
+// amount returns what the station measured for the line
+func (line DepositLineRequest) amount() depositAmount {
+	return depositAmount{Weight: line.Weight, Count: line.Count, ContainerSizeML: line.ContainerSizeML}
+}
+
+// BatchDepositRequest represents a multi-item deposit during an active session
+type BatchDepositRequest struct {
+	SessionToken string               `json:"sessionToken"`
+	Items        []DepositLineRequest `json:"items"`
+}
+
+// pricedLine is a validated line item priced at the station's rates
+type pricedLine struct {
+	Item            DepositLineRequest
+	Weight          database.Grams // corrected by the station's scale calibration
+	Price           depositPrice
+	ItemCount       interface{} // nil for weighed materials
+	ContainerSizeML interface{}
+	Product         productMatch
+	Fraud           fraudAssessment
+}
+
+// depositColumns lists the columns scanned by scanDeposit
+const depositColumns = `id, user_id, station_id, COALESCE(session_token, ''), item_lines, points_earned, milli_points, created_at`
+
+// scanDeposit scans a row selected with depositColumns
+func scanDeposit(row rowScanner) (database.Deposit, error) {
+	var deposit database.Deposit
+	var milliPoints int64
+	err := row.Scan(&deposit.ID, &deposit.UserID, &deposit.StationID, &deposit.SessionToken,
+		&deposit.ItemLines, &deposit.PointsEarned, &milliPoints, &deposit.CreatedAt)
+	deposit.ExactPoints = formatMilliPoints(milliPoints)
+	return deposit, err
+}
+
+// batchDeposit processes a multi-item deposit during an active session. All
+// lines are recorded in one database transaction with a single balance update.
+func batchDeposit(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid user authentication",
+		})
+		return
+	}
+
+	var req BatchDepositRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	// Validate input
+	if req.SessionToken == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Session token is required",
+		})
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxDepositLines {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   fmt.Sprintf("A deposit must have between 1 and %d items", maxDepositLines),
+		})
+		return
+	}
+	matches := make([]productMatch, len(req.Items))
+	for i := range req.Items {
+		item := &req.Items[i]
+		amount := item.amount()
+		match, err := classifyDeposit(item.Material, item.Barcode, &amount)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("Item %d: %v", i+1, err),
+			})
+			return
+		}
+		item.Material, item.ContainerSizeML = match.Material, amount.ContainerSizeML
+		matches[i] = match
+
+		if _, active := activeMaterial(item.Material); !active {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("Item %d: invalid material", i+1),
+			})
+			return
+		}
+		if err := validateDepositAmount(item.Material, item.amount()); err != nil {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("Item %d: %v", i+1, err),
+			})
+			return
+		}
+	}
+
+	if !sessionScopeAllows(r, req.SessionToken) {
+		respondJSON(w, http.StatusForbidden, Response{
+			Success: false,
+			Error:   "Token is not valid for this session",
+		})
+		return
+	}
+
+	// Verify session is active and linked to the user
+	sessionID, sessionStation, err := loadDepositSession(database.DB, req.SessionToken, userID)
+	if err != nil {
+		respondDepositSessionError(w, err)
+		return
+	}
+
+	// Check and price every line before anything is recorded
+	now := time.Now()
+	stationID := sessionStationID(sessionStation)
+	lines := make([]pricedLine, len(req.Items))
+	checks := make([]fraudCheck, len(req.Items))
+	for i, item := range req.Items {
+		station, err := loadStationForDeposit(stationID, item.Material, item.amount().quantity(item.Material))
+		if err != nil {
+			respondStationError(w, err)
+			return
+		}
+		weight := depositWeight(stationID, item.Material, item.amount(), matches[i], now)
+		if err := matches[i].checkWeight(item.amount(), weight); err != nil {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("Item %d: %v", i+1, err),
+			})
+			return
+		}
+		price := priceDeposit(stationID, item.Material, weight, item.Count, now)
+		itemCount, containerSize := item.amount().countColumns(item.Material)
+		checks[i] = fraudCheck{UserID: userID, Station: station, Material: item.Material, Weight: weight,
+			RawWeight: item.Weight, Quantity: item.amount().quantity(item.Material), Points: price.Points, At: now}
+		lines[i] = pricedLine{Item: item, Weight: weight, Price: price,
+			ItemCount: itemCount, ContainerSizeML: containerSize, Product: matches[i]}
+	}
+
+	// Begin database transaction
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to process deposit",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// Score the lines inside the transaction, so deposits made at the same
+	// time count against each other's limits. Lines held for review are
+	// credited if an admin approves them.
+	milli := make([]int64, len(lines))
+	var totalMilli int64
+	for i := range lines {
+		checks[i].Earlier = checks[:i]
+		lines[i].Fraud = scoreDeposit(tx, checks[i])
+		if !lines[i].Fraud.Held {
+			milli[i] = lines[i].Price.MilliPoints
+			totalMilli += lines[i].Price.MilliPoints
+		}
+	}
+
+	// Work out the points of all lines together; they are posted to the
+	// ledger as one journal
+	points, err := creditLinePointsTx(tx, userID, milli)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update user balance",
+		})
+		return
+	}
+	totalPoints := 0
+	for _, p := range points {
+		totalPoints += p
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO deposits (user_id, station_id, session_token, item_lines, points_earned, milli_points, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, userID, stationID, req.SessionToken, len(lines), totalPoints, totalMilli, now)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record deposit",
+		})
+		return
+	}
+	depositID, _ := result.LastInsertId()
+
+	err = postPointsTx(tx, ledgerPosting{UserID: userID, Points: totalPoints, Account: accountIssuance,
+		Kind: journalDeposit, Reference: "deposit", ReferenceID: depositID})
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update user balance",
+		})
+		return
+	}
+
+	breakdown := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		result, err := tx.Exec(`
+			INSERT INTO transactions (user_id, type, item_type, weight_grams, raw_weight_grams, points_earned, station_id, session_token,
+				rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, deposit_id, barcode, brand,
+				fraud_score, review_status)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, userID, "deposit", line.Item.Material, line.Weight, line.Item.Weight, points[i], stationID, req.SessionToken,
+			line.Price.RateVersionID, line.Price.Rate, line.Price.Multiplier, line.Price.MilliPoints,
+			line.ItemCount, line.ContainerSizeML, depositID, line.Product.Barcode, line.Product.Brand,
+			line.Fraud.Score, line.Fraud.reviewStatus())
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to record transaction",
+			})
+			return
+		}
+		transactionID, _ := result.LastInsertId()
+		if line.Fraud.Held {
+			if err := recordReviewTx(tx, transactionID, userID, stationID, line.Fraud); err != nil {
+				respondJSON(w, http.StatusInternalServerError, Response{
+					Success: false,
+					Error:   "Failed to queue deposit for review",
+				})
+				return
+			}
+		}
+
+		breakdown[i] = map[string]interface{}{
+			"line":          i + 1,
+			"transactionId": transactionID,
+			"material":      line.Item.Material,
+			"weight":        line.Weight,
+			"rawWeight":     line.Item.Weight,
+			"itemCount":     line.ItemCount,
+			"barcode":       line.Product.Barcode,
+			"brand":         line.Product.Brand,
+			"rate":          line.Price.Rate,
+			"exactPoints":   formatMilliPoints(line.Price.MilliPoints),
+			"pointsEarned":  points[i],
+			"heldForReview": line.Fraud.Held,
+		}
+	}
+
+	// Update session status to active
+	_, err = tx.Exec(
+		"UPDATE station_sessions SET status = ? WHERE id = ?",
+		"active", sessionID,
+	)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update session",
+		})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to complete deposit",
+		})
+		return
+	}
+
+	// Get updated user balance
+	var newBalance int
+	database.DB.QueryRow("SELECT total_points FROM users WHERE id = ?", userID).Scan(&newBalance)
+
+	log.Printf("Deposit recorded: user=%d, deposit=%d, lines=%d, points=%d",
+		userID, depositID, len(lines), totalPoints)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Deposit recorded successfully",
+		Data: map[string]interface{}{
+			"depositId":    depositID,
+			"items":        breakdown,
+			"exactPoints":  formatMilliPoints(totalMilli),
+			"pointsEarned": totalPoints,
+			"newBalance":   newBalance,
+		},
+	})
+}
+
+// getDeposit returns a multi-item deposit with its line items
+func getDeposit(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid user",
+		})
+		return
+	}
+
+	deposit, err := scanDeposit(database.DB.QueryRow(`
+		SELECT `+depositColumns+`
+		FROM deposits
+		WHERE id = ? AND user_id = ?
+	`, chi.URLParam(r, "id"), userID))
+
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Deposit not found",
+		})
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT `+transactionColumns+`
+		FROM transactions
+		WHERE deposit_id = ?
+		ORDER BY id
+	`, deposit.ID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve deposit",
+		})
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tx, err := scanTransaction(rows)
+		if err != nil {
+			continue
+		}
+		deposit.Items = append(deposit.Items, tx)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    deposit,
+	})
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"t2cbackend/database"
+	"time"
+)
+
+// Search radius limits for the station finder, in kilometres
+const (
+	defaultNearbyRadiusKm = 5.0
+	maxNearbyRadiusKm     = 50.0
+)
+
+// haversineKm returns the great-circle distance between two points in kilometres
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// stationFillLevel returns how full a station is as a percentage. Stations
+// that report telemetry use their fullest bin; others are estimated from the
+// weight deposited since they were last serviced against their capacity in kg.
+func stationFillLevel(station database.Station) float64 {
+	if levels, err := latestBinLevels(station); err == nil && len(levels) > 0 {
+		var fullest float64
+		for _, level := range levels {
+			fullest = math.Max(fullest, level.FillPercent)
+		}
+		return fullest
+	}
+
+	if station.Capacity <= 0 {
+		return 0
+	}
+
+	var weight float64
+	database.DB.QueryRow(`
+		SELECT COALESCE(SUM(weight_grams), 0) / 1000.0
+		FROM transactions
+		WHERE station_id = ? AND type = 'deposit' AND timestamp >= ?
+	`, station.ID, sqliteTime(station.BinsEmptiedAt)).Scan(&weight)
+
+	level := weight / float64(station.Capacity) * 100
+	return math.Min(math.Round(level*10)/10, 100)
+}
+
+// stationLiveInfo returns the live details shown in the finder and on the map
+func stationLiveInfo(station database.Station) map[string]interface{} {
+	cfg := stationConfigOrDefault(station.ID)
+	open, next := stationOpenState(station, time.Now().UTC())
+	return map[string]interface{}{
+		"id":                 station.ID,
+		"location":           station.Location,
+		"address":            station.Address,
+		"latitude":           station.Latitude,
+		"longitude":          station.Longitude,
+		"status":             station.Status,
+		"connectivity":       station.Connectivity,
+		"fill_level":         stationFillLevel(station),
+		"accepted_materials": acceptedMaterialsSorted(cfg),
+		"operating_hours":    cfg.OperatingHours,
+		"is_open":            open,
+		"next_open":          next,
+	}
+}
+
+// loadLocatedStations retrieves all non-disabled stations that have coordinates
+func loadLocatedStations() ([]database.Station, error) {
+	rows, err := database.DB.Query(`
+		SELECT ` + stationColumns + ` FROM stations
+		WHERE latitude IS NOT NULL AND longitude IS NOT NULL AND status != 'disabled'
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stations []database.Station
+	for rows.Next() {
+		station, err := scanStation(rows)
+		if err != nil {
+			continue
+		}
+		stations = append(stations, station)
+	}
+	return stations, rows.Err()
+}
+
+// getNearbyStations lists stations within a radius, nearest first
+func getNearbyStations(w http.ResponseWriter, r *http.Request) {
+	lat, latErr := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, lonErr := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	if latErr != nil || lonErr != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Valid lat and lon are required",
+		})
+		return
+	}
+
+	radius := defaultNearbyRadiusKm
+	if rad := r.URL.Query().Get("radius"); rad != "" {
+		parsed, err := strconv.ParseFloat(rad, 64)
+		if err != nil || parsed <= 0 {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Radius must be a positive number of kilometres",
+			})
+			return
+		}
+		radius = math.Min(parsed, maxNearbyRadiusKm)
+	}
+
+	stations, err := loadLocatedStations()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve stations",
+		})
+		return
+	}
+
+	type nearbyStation struct {
+		distance float64
+		info     map[string]interface{}
+	}
+
+	var nearby []nearbyStation
+	for _, station := range stations {
+		distance := haversineKm(lat, lon, *station.Latitude, *station.Longitude)
+		if distance > radius {
+			continue
+		}
+		info := stationLiveInfo(station)
+		info["distance_km"] = math.Round(distance*100) / 100
+		nearby = append(nearby, nearbyStation{distance: distance, info: info})
+	}
+
+	sort.Slice(nearby, func(i, j int) bool {
+		return nearby[i].distance < nearby[j].distance
+	})
+
+	results := make([]map[string]interface{}, 0, len(nearby))
+	for _, n := range nearby {
+		results = append(results, n.info)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"radius_km": radius,
+			"stations":  results,
+		},
+	})
+}
+
+// getStationsGeoJSON exports stations as a GeoJSON FeatureCollection for the map
+func getStationsGeoJSON(w http.ResponseWriter, r *http.Request) {
+	stations, err := loadLocatedStations()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve stations",
+		})
+		return
+	}
+
+	features := make([]map[string]interface{}, 0, len(stations))
+	for _, station := range stations {
+		properties := stationLiveInfo(station)
+		delete(properties, "latitude")
+		delete(properties, "longitude")
+
+		features = append(features, map[string]interface{}{
+			"type": "Feature",
+			"id":   station.ID,
+			"geometry": map[string]interface{}{
+				"type": "Point",
+				// GeoJSON positions are [longitude, latitude]
+				"coordinates": []float64{*station.Longitude, *station.Latitude},
+			},
+			"properties": properties,
+		})
+	}
+
+	// GeoJSON is served bare so map libraries can load it directly
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	})
+}
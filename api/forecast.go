@@ -0,0 +1,295 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Forecast settings
+const (
+	forecastHistoryDays  = 28 // deposit history used to estimate fill rates
+	minTelemetrySpan     = 12 * time.Hour
+	defaultDueWithinDays = 2
+	maxDueWithinDays     = 30
+	maxForecastDays      = 365 // predictions further out than this are dropped
+)
+
+// binForecast is the predicted fill state of one material bin
+type binForecast struct {
+	Material        string     `json:"material"`
+	FillPercent     float64    `json:"fill_percent"`
+	LevelSource     string     `json:"level_source"` // telemetry/deposits
+	FillRatePerDay  float64    `json:"fill_rate_per_day"`
+	RateSource      string     `json:"rate_source"` // telemetry/deposits
+	PredictedFullAt *time.Time `json:"predicted_full_at"`
+	DaysUntilFull   *float64   `json:"days_until_full"`
+	Full            bool       `json:"full"`
+}
+
+// collectionDue is a bin on the due-for-collection list
+type collectionDue struct {
+	StationID int      `json:"station_id"`
+	Location  string   `json:"location"`
+	Address   string   `json:"address,omitempty"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	binForecast
+}
+
+// binCapacityKg returns the capacity of one bin. Station capacity is the
+// total across its bins, which are assumed to be the same size.
+func binCapacityKg(station database.Station, cfg database.StationConfig) float64 {
+	if station.Capacity <= 0 || len(cfg.AcceptedMaterials) == 0 {
+		return 0
+	}
+	return float64(station.Capacity) / float64(len(cfg.AcceptedMaterials))
+}
+
+// depositFillRate returns how many percent of a bin's capacity is deposited
+// per day, averaged over the recent deposit history
+func depositFillRate(station database.Station, material string, capacityKg float64, now time.Time) (float64, error) {
+	if capacityKg <= 0 {
+		return 0, nil
+	}
+
+	// Stations with a short history are averaged over the days they have data for
+	var weight float64
+	var days sql.NullFloat64
+	err := database.DB.QueryRow(`
+		SELECT COALESCE(SUM(weight_grams), 0) / 1000.0, julianday(?) - julianday(MIN(timestamp))
+		FROM transactions
+		WHERE station_id = ? AND type = 'deposit' AND item_type = ? AND timestamp >= ?
+	`, sqliteTime(now), station.ID, material, sqliteTime(now.AddDate(0, 0, -forecastHistoryDays))).Scan(&weight, &days)
+	if err != nil || !days.Valid {
+		return 0, err
+	}
+
+	return weight / capacityKg * 100 / math.Max(days.Float64, 1), nil
+}
+
+// binEmptiedAt returns when a bin was last emptied, either by a hauler
+// pickup of the bin or when all of the station's bins were emptied
+func binEmptiedAt(station database.Station, material string) time.Time {
+	if last, ok := lastPickupAt(station.ID, material); ok && last.After(station.BinsEmptiedAt) {
+		return last
+	}
+	return station.BinsEmptiedAt
+}
+
+// telemetryFillRate returns the fill rate measured by a bin's sensor since
+// it was last emptied, or false if there are too few readings to tell
+func telemetryFillRate(station database.Station, material string) (float64, bool) {
+	emptiedAt := binEmptiedAt(station, material)
+	var firstLevel, lastLevel float64
+	var firstAt, lastAt time.Time
+	err := database.DB.QueryRow(`
+		SELECT fill_percent, recorded_at FROM station_bin_levels
+		WHERE station_id = ? AND material = ? AND recorded_at >= ?
+		ORDER BY recorded_at ASC LIMIT 1
+	`, station.ID, material, emptiedAt).Scan(&firstLevel, &firstAt)
+	if err != nil {
+		return 0, false
+	}
+	err = database.DB.QueryRow(`
+		SELECT fill_percent, recorded_at FROM station_bin_levels
+		WHERE station_id = ? AND material = ? AND recorded_at >= ?
+		ORDER BY recorded_at DESC LIMIT 1
+	`, station.ID, material, emptiedAt).Scan(&lastLevel, &lastAt)
+	if err != nil {
+		return 0, false
+	}
+
+	span := lastAt.Sub(firstAt)
+	if span < minTelemetrySpan || lastLevel < firstLevel {
+		return 0, false
+	}
+	return (lastLevel - firstLevel) / (span.Hours() / 24), true
+}
+
+// forecastStation predicts when each of a station's bins will be full. Bins
+// with sensors use their latest reading and measured fill rate; other bins
+// are estimated from the weight deposited since they were last emptied.
+func forecastStation(station database.Station, now time.Time) ([]binForecast, error) {
+	cfg := stationConfigOrDefault(station.ID)
+	capacityKg := binCapacityKg(station, cfg)
+
+	levels, err := latestBinLevels(station)
+	if err != nil {
+		return nil, err
+	}
+
+	forecasts := make([]binForecast, 0, len(cfg.AcceptedMaterials))
+	for _, material := range acceptedMaterialsSorted(cfg) {
+		forecast := binForecast{Material: material, LevelSource: "deposits", RateSource: "deposits"}
+
+		emptiedAt := binEmptiedAt(station, material)
+		if level, ok := levels[material]; ok && !level.RecordedAt.Before(emptiedAt) {
+			forecast.FillPercent = level.FillPercent
+			forecast.LevelSource = "telemetry"
+		} else if capacityKg > 0 {
+			var weight float64
+			database.DB.QueryRow(`
+				SELECT COALESCE(SUM(weight_grams), 0) / 1000.0
+				FROM transactions
+				WHERE station_id = ? AND type = 'deposit' AND item_type = ? AND timestamp >= ?
+			`, station.ID, material, sqliteTime(emptiedAt)).Scan(&weight)
+			forecast.FillPercent = math.Min(weight/capacityKg*100, 100)
+		}
+
+		if rate, ok := telemetryFillRate(station, material); ok {
+			forecast.FillRatePerDay = rate
+			forecast.RateSource = "telemetry"
+		} else {
+			rate, err := depositFillRate(station, material, capacityKg, now)
+			if err != nil {
+				return nil, err
+			}
+			forecast.FillRatePerDay = rate
+		}
+
+		forecast.FillPercent = math.Round(forecast.FillPercent*10) / 10
+		forecast.FillRatePerDay = math.Round(forecast.FillRatePerDay*100) / 100
+		forecast.Full = forecast.FillPercent >= binFullThreshold
+
+		remaining := binFullThreshold - forecast.FillPercent
+		switch {
+		case remaining <= 0:
+			days := 0.0
+			forecast.DaysUntilFull = &days
+			forecast.PredictedFullAt = &now
+		case forecast.FillRatePerDay > 0:
+			days := remaining / forecast.FillRatePerDay
+			if days <= maxForecastDays {
+				fullAt := now.Add(time.Duration(days * 24 * float64(time.Hour))).Truncate(time.Minute)
+				days = math.Round(days*10) / 10
+				forecast.DaysUntilFull = &days
+				forecast.PredictedFullAt = &fullAt
+			}
+		}
+
+		forecasts = append(forecasts, forecast)
+	}
+
+	return forecasts, nil
+}
+
+// getStationForecast returns the fill forecast for each of a station's bins
+func getStationForecast(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	station, err := loadStation(stationID)
+	if err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	forecasts, err := forecastStation(station, now)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to forecast fill levels",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"station_id":       station.ID,
+			"location":         station.Location,
+			"last_maintenance": station.LastMaintenance,
+			"bins_emptied_at":  station.BinsEmptiedAt,
+			"generated_at":     now,
+			"bins":             forecasts,
+		},
+	})
+}
+
+// getCollectionsDue lists the bins predicted to be full within the requested
+// number of days, soonest first
+func getCollectionsDue(w http.ResponseWriter, r *http.Request) {
+	withinDays := defaultDueWithinDays
+	if raw := r.URL.Query().Get("within_days"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxDueWithinDays {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("within_days must be between 1 and %d", maxDueWithinDays),
+			})
+			return
+		}
+		withinDays = parsed
+	}
+
+	rows, err := database.DB.Query("SELECT " + stationColumns + " FROM stations WHERE status != 'disabled' ORDER BY id")
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve stations",
+		})
+		return
+	}
+	var stations []database.Station
+	for rows.Next() {
+		station, err := scanStation(rows)
+		if err != nil {
+			continue
+		}
+		stations = append(stations, station)
+	}
+	rows.Close()
+
+	now := time.Now().UTC()
+	cutoff := now.AddDate(0, 0, withinDays)
+	due := []collectionDue{}
+	for _, station := range stations {
+		forecasts, err := forecastStation(station, now)
+		if err != nil {
+			log.Printf("getCollectionsDue: failed for station %d: %v", station.ID, err)
+			continue
+		}
+		for _, forecast := range forecasts {
+			if forecast.PredictedFullAt == nil || forecast.PredictedFullAt.After(cutoff) {
+				continue
+			}
+			due = append(due, collectionDue{
+				StationID:   station.ID,
+				Location:    station.Location,
+				Address:     station.Address,
+				Latitude:    station.Latitude,
+				Longitude:   station.Longitude,
+				binForecast: forecast,
+			})
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].PredictedFullAt.Before(*due[j].PredictedFullAt)
+	})
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"within_days":  withinDays,
+			"generated_at": now,
+			"bins":         due,
+		},
+	})
+}
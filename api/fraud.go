@@ -0,0 +1,462 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"t2cbackend/database"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Fraud scoring. Each rule a deposit triggers adds to its score, capped at
+// maxFraudScore. Deposits scoring at or above the review threshold are held
+// for an admin to review instead of being credited.
+const (
+	maxFraudScore               = 100
+	defaultFraudReviewThreshold = 60
+
+	scoreOverQuantity    = 60
+	scoreUserVelocity    = 30
+	scoreStationVelocity = 20
+	scoreRepeatedWeight  = 30
+	scoreAfterHours      = 25
+	scoreOverCapacity    = 40
+	scoreHourlyPoints    = maxFraudScore // always held, whatever the threshold
+
+	maxUserDepositsPerHour    = 20
+	maxStationDepositsPerHour = 120
+	maxUserPointsPerHour      = 500
+	repeatedWeightWindow      = 24 * time.Hour
+	repeatedWeightLimit       = 3 // earlier deposits with about the same scale reading
+
+	// Scale readings this close count as the same: 1% of the reading, and
+	// at least 5 g, so nudging the weight by a gram does not escape the rule
+	repeatedWeightTolerancePct = 1
+	minRepeatedWeightTolerance = 5 // grams
+)
+
+// defaultReviewQuantities applies to materials without a review_quantity
+var defaultReviewQuantities = map[string]float64{unitKg: 25, unitItem: 100}
+
+// Review states of a held deposit's transaction
+const (
+	reviewHeld     = "held"
+	reviewApproved = "approved"
+	reviewRejected = "rejected"
+)
+
+// ResolveReviewRequest represents an admin's decision on a held deposit
+type ResolveReviewRequest struct {
+	Decision string `json:"decision"` // approve/reject
+	Note     string `json:"note"`
+}
+
+// fraudCheck describes a deposit about to be credited
+type fraudCheck struct {
+	UserID       int
+	GuestSession string // set instead of UserID for guest deposits
+	Station      database.Station
+	Material     string
+	Weight       database.Grams // corrected by the station's scale calibration
+	RawWeight    database.Grams
+	Quantity     float64 // in the material's unit
+	Points       int     // before carry-over
+	At           time.Time
+
+	// Earlier lines of the same multi-item deposit. They are scored before
+	// any of them is recorded, so they are counted here instead.
+	Earlier []fraudCheck
+}
+
+// depositor returns the table and condition that select the depositor's
+// earlier deposits, and the argument for the condition: the user's deposit
+// transactions, or the deposits of a guest session
+func (check fraudCheck) depositor() (string, interface{}) {
+	if check.GuestSession != "" {
+		return "guest_deposits WHERE session_token = ?", check.GuestSession
+	}
+	return "transactions WHERE type = 'deposit' AND user_id = ?", check.UserID
+}
+
+// repeatedWeightTolerance returns how far a scale reading may be from
+// another and still count as the same reading
+func repeatedWeightTolerance(raw database.Grams) database.Grams {
+	tolerance := raw * repeatedWeightTolerancePct / 100
+	if tolerance < minRepeatedWeightTolerance {
+		return minRepeatedWeightTolerance
+	}
+	return tolerance
+}
+
+// fraudAssessment is a deposit's fraud score and the rules behind it
+type fraudAssessment struct {
+	Score   int
+	Reasons []database.DepositReviewReason
+	Held    bool
+}
+
+// add records a triggered rule
+func (a *fraudAssessment) add(rule string, score int, detail string) {
+	a.Score += score
+	a.Reasons = append(a.Reasons, database.DepositReviewReason{Rule: rule, Score: score, Detail: detail})
+}
+
+// reviewStatus returns the review_status stored on the deposit's transaction
+func (a fraudAssessment) reviewStatus() interface{} {
+	if a.Held {
+		return reviewHeld
+	}
+	return nil
+}
+
+// heldReasons returns the rules a held deposit triggered as JSON, for
+// deposits queued for review later, or nil when it is not held
+func (a fraudAssessment) heldReasons() interface{} {
+	if !a.Held {
+		return nil
+	}
+	reasons, _ := json.Marshal(a.Reasons)
+	return string(reasons)
+}
+
+// fraudReviewThreshold returns the score at which deposits are held, from
+// the global configuration
+func fraudReviewThreshold() int {
+	cfg, _, err := globalStationConfig()
+	if err != nil || cfg.FraudReviewThreshold <= 0 {
+		return defaultFraudReviewThreshold
+	}
+	return cfg.FraudReviewThreshold
+}
+
+// scoreDeposit runs the fraud rules against a deposit. q is the transaction
+// the deposit is recorded in, so deposits made at the same time cannot each
+// slip under a limit.
+func scoreDeposit(q rowQuerier, check fraudCheck) fraudAssessment {
+	var a fraudAssessment
+	material, _ := lookupMaterial(check.Material)
+	// Offline deposits are scored at the time they were recorded
+	until := sqliteTime(check.At.Add(time.Second))
+	since := sqliteTime(check.At.Add(-time.Hour))
+	depositor, depositorID := check.depositor()
+
+	// Earlier lines of the same deposit
+	tolerance := repeatedWeightTolerance(check.RawWeight)
+	var earlierPoints, earlierRepeats int
+	var earlierWeight database.Grams
+	for _, line := range check.Earlier {
+		earlierPoints += line.Points
+		if line.Material != check.Material {
+			continue
+		}
+		earlierWeight += line.Weight
+		if diff := line.RawWeight - check.RawWeight; diff >= -tolerance && diff <= tolerance {
+			earlierRepeats++
+		}
+	}
+
+	// Implausibly large deposits
+	limit := defaultReviewQuantities[material.Unit]
+	if material.ReviewQuantity != nil {
+		limit = *material.ReviewQuantity
+	}
+	if limit > 0 && check.Quantity > limit {
+		a.add("quantity", scoreOverQuantity,
+			fmt.Sprintf("%g %s is above the review limit of %g", check.Quantity, material.Unit, limit))
+	}
+
+	// Too many deposits, or too many points, in the last hour
+	var userDeposits, userPoints, stationDeposits int
+	q.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(points_earned), 0) FROM `+depositor+` AND timestamp >= ? AND timestamp < ?
+	`, depositorID, since, until).Scan(&userDeposits, &userPoints)
+	userDeposits += len(check.Earlier)
+	if userDeposits >= maxUserDepositsPerHour {
+		a.add("user_velocity", scoreUserVelocity,
+			fmt.Sprintf("user made %d deposits in the last hour", userDeposits))
+	}
+	if total := userPoints + earlierPoints + check.Points; total > maxUserPointsPerHour {
+		a.add("hourly_points", scoreHourlyPoints,
+			fmt.Sprintf("%d points in the last hour is above the limit of %d", total, maxUserPointsPerHour))
+	}
+	q.QueryRow(`
+		SELECT COUNT(*) FROM transactions WHERE station_id = ? AND type = 'deposit' AND timestamp >= ? AND timestamp < ?
+	`, check.Station.ID, since, until).Scan(&stationDeposits)
+	stationDeposits += len(check.Earlier)
+	if stationDeposits >= maxStationDepositsPerHour {
+		a.add("station_velocity", scoreStationVelocity,
+			fmt.Sprintf("station took %d deposits in the last hour", stationDeposits))
+	}
+
+	// About the same scale reading over and over suggests a replayed request
+	if !counted(check.Material) && check.RawWeight > 0 {
+		var repeats int
+		q.QueryRow(`
+			SELECT COUNT(*) FROM `+depositor+`
+			AND item_type = ? AND raw_weight_grams BETWEEN ? AND ? AND timestamp >= ? AND timestamp < ?
+		`, depositorID, check.Material, check.RawWeight-tolerance, check.RawWeight+tolerance,
+			sqliteTime(check.At.Add(-repeatedWeightWindow)), until).Scan(&repeats)
+		repeats += earlierRepeats
+		if repeats >= repeatedWeightLimit {
+			a.add("repeated_weight", scoreRepeatedWeight,
+				fmt.Sprintf("%d earlier deposits weighed within %d g of %g kg", repeats, tolerance, check.RawWeight.Kg()))
+		}
+	}
+
+	// Sessions may finish after closing; deposits then are worth a second look
+	if checkStationOpen(check.Station, check.At) != nil {
+		a.add("after_hours", scoreAfterHours, "station is outside its opening hours")
+	}
+
+	if binOverCapacity(q, check.Station, check.Material, earlierWeight+check.Weight) {
+		a.add("over_capacity", scoreOverCapacity, "bin would be over its capacity since it was last emptied")
+	}
+
+	if a.Score > maxFraudScore {
+		a.Score = maxFraudScore
+	}
+	a.Held = a.Score >= fraudReviewThreshold()
+	return a
+}
+
+// binOverCapacity reports whether a deposit takes its bin past its share of
+// the station's capacity, counting what was deposited since it was emptied.
+// Counted deposits the station did not weigh are recorded with their
+// expected weight, so they count too.
+func binOverCapacity(q rowQuerier, station database.Station, material string, weight database.Grams) bool {
+	capacityKg := binCapacityKg(station, stationConfigOrDefault(station.ID))
+	if capacityKg <= 0 {
+		return false
+	}
+
+	var deposited float64
+	q.QueryRow(`
+		SELECT COALESCE(SUM(weight_grams), 0) / 1000.0
+		FROM transactions
+		WHERE station_id = ? AND type = 'deposit' AND item_type = ? AND timestamp >= ?
+	`, station.ID, material, sqliteTime(binEmptiedAt(station, material))).Scan(&deposited)
+	return deposited+weight.Kg() > capacityKg
+}
+
+// recordReviewTx queues a held deposit for review
+func recordReviewTx(tx *sql.Tx, transactionID int64, userID, stationID int, a fraudAssessment) error {
+	reasons, err := json.Marshal(a.Reasons)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO deposit_reviews (transaction_id, user_id, station_id, score, reasons, status, created_at)
+		VALUES (?, ?, ?, ?, ?, 'pending', ?)
+	`, transactionID, userID, stationID, a.Score, string(reasons), time.Now().UTC())
+	if err == nil {
+		log.Printf("Deposit %d held for review: user=%d, station=%d, score=%d", transactionID, userID, stationID, a.Score)
+	}
+	return err
+}
+
+// depositReviewColumns lists the columns scanned by scanDepositReview
+const depositReviewColumns = `id, transaction_id, user_id, station_id, score, reasons, status, COALESCE(note, ''),
+	created_at, reviewed_by, reviewed_at`
+
+// scanDepositReview scans a row selected with depositReviewColumns
+func scanDepositReview(row rowScanner) (database.DepositReview, error) {
+	var review database.DepositReview
+	var reasons string
+	var reviewedBy sql.NullInt64
+	var reviewedAt sql.NullTime
+	err := row.Scan(&review.ID, &review.TransactionID, &review.UserID, &review.StationID, &review.Score,
+		&reasons, &review.Status, &review.Note, &review.CreatedAt, &reviewedBy, &reviewedAt)
+	if err != nil {
+		return review, err
+	}
+	json.Unmarshal([]byte(reasons), &review.Reasons)
+	if reviewedBy.Valid {
+		id := int(reviewedBy.Int64)
+		review.ReviewedBy = &id
+	}
+	if reviewedAt.Valid {
+		review.ReviewedAt = &reviewedAt.Time
+	}
+	return review, nil
+}
+
+// listDepositReviews lists held deposits, oldest first. Defaults to the
+// pending ones; ?status=approved or rejected lists decided reviews.
+func listDepositReviews(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT `+depositReviewColumns+`
+		FROM deposit_reviews
+		WHERE status = ?
+		ORDER BY created_at ASC
+		LIMIT 200
+	`, status)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve reviews",
+		})
+		return
+	}
+	reviews := []database.DepositReview{}
+	for rows.Next() {
+		review, err := scanDepositReview(rows)
+		if err != nil {
+			continue
+		}
+		reviews = append(reviews, review)
+	}
+	rows.Close()
+
+	for i := range reviews {
+		tx, err := scanTransaction(database.DB.QueryRow(
+			"SELECT "+transactionColumns+" FROM transactions WHERE id = ?", reviews[i].TransactionID,
+		))
+		if err == nil {
+			reviews[i].Transaction = &tx
+		}
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    reviews,
+	})
+}
+
+// resolveDepositReview approves or rejects a held deposit. Approved deposits
+// are credited to the user now; rejected deposits are never credited.
+func resolveDepositReview(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := getUserIDFromHeader(r)
+
+	reviewID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid review ID",
+		})
+		return
+	}
+
+	var req ResolveReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+	var status string
+	switch req.Decision {
+	case "approve":
+		status = reviewApproved
+	case "reject":
+		status = reviewRejected
+	default:
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "decision must be approve or reject",
+		})
+		return
+	}
+
+	review, err := scanDepositReview(database.DB.QueryRow(
+		"SELECT "+depositReviewColumns+" FROM deposit_reviews WHERE id = ?", reviewID,
+	))
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Review not found",
+		})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve review",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// Claim the review first so two admins cannot both credit it
+	result, err := tx.Exec(`
+		UPDATE deposit_reviews SET status = ?, note = ?, reviewed_by = ?, reviewed_at = ?
+		WHERE id = ? AND status = 'pending'
+	`, status, req.Note, adminID, time.Now().UTC(), reviewID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve review",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Review has already been resolved",
+		})
+		return
+	}
+
+	points := 0
+	if status == reviewApproved {
+		var milliPoints int64
+		var depositID sql.NullInt64
+		err = tx.QueryRow(
+			"SELECT COALESCE(milli_points, 0), deposit_id FROM transactions WHERE id = ?", review.TransactionID,
+		).Scan(&milliPoints, &depositID)
+		if err == nil {
+			points, err = creditPointsTx(tx, review.UserID, milliPoints)
+		}
+		if err == nil {
+			err = postPointsTx(tx, ledgerPosting{UserID: review.UserID, Points: points, Account: accountIssuance,
+				Kind: journalDeposit, Reference: "transaction", ReferenceID: int64(review.TransactionID)})
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE transactions SET points_earned = ? WHERE id = ?", points, review.TransactionID)
+		}
+		// Lines of a multi-item deposit add to its total once approved
+		if err == nil && depositID.Valid {
+			_, err = tx.Exec(`
+				UPDATE deposits SET points_earned = points_earned + ?, milli_points = milli_points + ? WHERE id = ?
+			`, points, milliPoints, depositID.Int64)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE transactions SET review_status = ? WHERE id = ?", status, review.TransactionID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve review",
+		})
+		return
+	}
+
+	log.Printf("Deposit review %d %s by admin %d, points=%d", reviewID, status, adminID, points)
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Review " + status,
+		Data: map[string]interface{}{
+			"id":             reviewID,
+			"transaction_id": review.TransactionID,
+			"status":         status,
+			"points_earned":  points,
+		},
+	})
+}
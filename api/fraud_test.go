@@ -0,0 +1,120 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"t2cbackend/database"
+)
+
+func TestRepeatedWeightTolerance(t *testing.T) {
+	tests := []struct {
+		raw  database.Grams
+		want database.Grams
+	}{
+		{0, minRepeatedWeightTolerance},
+		{200, minRepeatedWeightTolerance},
+		{1000, 10},
+		{2550, 25},
+	}
+
+	for _, tt := range tests {
+		if got := repeatedWeightTolerance(tt.raw); got != tt.want {
+			t.Errorf("repeatedWeightTolerance(%d) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
+
+// hasRule reports whether an assessment triggered a rule
+func hasRule(a fraudAssessment, rule string) bool {
+	for _, reason := range a.Reasons {
+		if reason.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func TestScoreDeposit(t *testing.T) {
+	openTestDB(t)
+	station, err := loadStation(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+
+	// Earlier deposits by the demo user, a gram or two apart
+	for _, raw := range []database.Grams{1000, 1004, 996} {
+		_, err := database.DB.Exec(`
+			INSERT INTO transactions (user_id, type, item_type, weight_grams, raw_weight_grams, points_earned, station_id, timestamp)
+			VALUES (2, 'deposit', 'plastic', ?, ?, 10, 1, ?)
+		`, raw, raw, sqliteTime(now.Add(-10*time.Minute)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deposit := func(raw database.Grams, points int) fraudCheck {
+		return fraudCheck{UserID: 2, Station: station, Material: "plastic", Weight: raw, RawWeight: raw,
+			Quantity: raw.Kg(), Points: points, At: now}
+	}
+
+	t.Run("nudged weight is still repeated", func(t *testing.T) {
+		a := scoreDeposit(database.DB, deposit(1002, 10))
+		if !hasRule(a, "repeated_weight") {
+			t.Errorf("scoreDeposit() reasons = %v, want repeated_weight", a.Reasons)
+		}
+	})
+
+	t.Run("different weight", func(t *testing.T) {
+		a := scoreDeposit(database.DB, deposit(1100, 10))
+		if hasRule(a, "repeated_weight") || a.Held {
+			t.Errorf("scoreDeposit() = %+v, want no repeated_weight and not held", a)
+		}
+	})
+
+	t.Run("hourly points ceiling", func(t *testing.T) {
+		// 30 points already earned this hour
+		a := scoreDeposit(database.DB, deposit(1500, maxUserPointsPerHour-29))
+		if !hasRule(a, "hourly_points") || !a.Held {
+			t.Errorf("scoreDeposit() = %+v, want held for hourly_points", a)
+		}
+		a = scoreDeposit(database.DB, deposit(1500, maxUserPointsPerHour-30))
+		if hasRule(a, "hourly_points") {
+			t.Errorf("scoreDeposit() reasons = %v, want no hourly_points at the limit", a.Reasons)
+		}
+	})
+
+	t.Run("earlier lines of the same deposit", func(t *testing.T) {
+		check := deposit(2000, 10)
+		for i := 0; i < maxUserDepositsPerHour; i++ {
+			check.Earlier = append(check.Earlier, deposit(database.Grams(3000+100*i), 10))
+		}
+		a := scoreDeposit(database.DB, check)
+		if !hasRule(a, "user_velocity") {
+			t.Errorf("scoreDeposit() reasons = %v, want user_velocity", a.Reasons)
+		}
+	})
+
+	t.Run("guest session", func(t *testing.T) {
+		for _, raw := range []database.Grams{700, 701, 702} {
+			_, err := database.DB.Exec(`
+				INSERT INTO guest_deposits (session_token, item_type, weight_grams, raw_weight_grams, points_earned, station_id, timestamp)
+				VALUES ('guest-1', 'plastic', ?, ?, 7, 1, ?)
+			`, raw, raw, sqliteTime(now.Add(-time.Minute)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		check := deposit(700, 7)
+		check.UserID, check.GuestSession = 0, "guest-1"
+		a := scoreDeposit(database.DB, check)
+		if !hasRule(a, "repeated_weight") {
+			t.Errorf("scoreDeposit() reasons = %v, want repeated_weight", a.Reasons)
+		}
+		// The guest's deposits are not the demo user's
+		if a := scoreDeposit(database.DB, deposit(700, 7)); hasRule(a, "repeated_weight") {
+			t.Errorf("scoreDeposit() reasons = %v, want no repeated_weight for the user", a.Reasons)
+		}
+	})
+}
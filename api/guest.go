@@ -0,0 +1,631 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/google/uuid"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Guest claim codes stay redeemable for 30 days
+const guestClaimExpiry = 30 * 24 * time.Hour
+
+// Claim codes avoid characters that are easy to misread on a receipt
+const claimCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// GuestSessionRequest represents a guest session request or end request
+type GuestSessionRequest struct {
+	SessionToken string `json:"sessionToken"`
+}
+
+// errGuestSessionExpired is returned for guest sessions past their expiry
+var errGuestSessionExpired = errors.New("guest session has expired")
+
+// RedeemClaimRequest represents a request to claim guest points
+type RedeemClaimRequest struct {
+	Code string `json:"code"`
+}
+
+// generateClaimCode returns a random 10-character claim code
+func generateClaimCode() (string, error) {
+	code := make([]byte, 10)
+	max := big.NewInt(int64(len(claimCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = claimCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// loadGuestSession returns the ID of an open guest session owned by the station
+func loadGuestSession(q rowQuerier, sessionToken string, stationID int) (int, error) {
+	var sessionID int
+	var status, sessionStation string
+	var expiresAt time.Time
+
+	err := q.QueryRow(
+		"SELECT id, status, station_id, expires_at FROM station_sessions WHERE session_token = ?",
+		sessionToken,
+	).Scan(&sessionID, &status, &sessionStation, &expiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	if status != "guest" || sessionStation != strconv.Itoa(stationID) {
+		return 0, sql.ErrNoRows
+	}
+	if time.Now().After(expiresAt) {
+		return 0, errGuestSessionExpired
+	}
+	return sessionID, nil
+}
+
+// respondGuestSessionError maps loadGuestSession errors to API responses
+func respondGuestSessionError(w http.ResponseWriter, err error) {
+	if err == errGuestSessionExpired {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Session has expired",
+		})
+		return
+	}
+	respondJSON(w, http.StatusNotFound, Response{
+		Success: false,
+		Error:   "Guest session not found",
+	})
+}
+
+// requestGuestSession starts a session with no user attached
+func requestGuestSession(w http.ResponseWriter, r *http.Request) {
+	stationID, err := getStationIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid station",
+		})
+		return
+	}
+
+	if _, err := loadOpenStation(stationID); err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	sessionToken := uuid.New().String()
+	expiresAt := stationSessionExpiry(stationID)
+
+	_, err = database.DB.Exec(
+		"INSERT INTO station_sessions (session_token, station_id, status, expires_at) VALUES (?, ?, ?, ?)",
+		sessionToken, strconv.Itoa(stationID), "guest", expiresAt.Format(time.RFC3339),
+	)
+	if err != nil {
+		log.Printf("requestGuestSession: failed to insert session: %v", err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create session",
+		})
+		return
+	}
+
+	log.Printf("Guest session started: token=%s, station=%d", sessionToken, stationID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Guest session started",
+		Data: map[string]interface{}{
+			"sessionToken": sessionToken,
+			"expiresAt":    expiresAt.Format(time.RFC3339),
+			"status":       "guest",
+		},
+	})
+}
+
+// scoreGuestDepositTx scores a guest deposit and works out the points it adds
+// to the session. Held deposits add none; they are queued for review when the
+// session is claimed.
+func scoreGuestDepositTx(tx *sql.Tx, check fraudCheck, price depositPrice) (fraudAssessment, int) {
+	assessment := scoreDeposit(tx, check)
+	if assessment.Held {
+		return assessment, 0
+	}
+	sessionMilli := guestSessionMilliPoints(tx, check.GuestSession)
+	return assessment, pointsIncrement(sessionMilli, price.MilliPoints, pointsRoundingMode())
+}
+
+// guestDeposit records a deposit against a guest session's pending balance
+func guestDeposit(w http.ResponseWriter, r *http.Request) {
+	stationID, err := getStationIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid station",
+		})
+		return
+	}
+
+	var req SessionDepositRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	if (req.Material == "" && req.Barcode == "") || req.SessionToken == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Material or barcode and session token are required",
+		})
+		return
+	}
+	match, err := req.classify()
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validateDepositAmount(req.Material, req.amount()); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if _, err := loadGuestSession(database.DB, req.SessionToken, stationID); err != nil {
+		respondGuestSessionError(w, err)
+		return
+	}
+
+	station, err := loadStationForDeposit(stationID, req.Material, req.amount().quantity(req.Material))
+	if err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	weight := depositWeight(stationID, req.Material, req.amount(), match, time.Now())
+	if err := match.checkWeight(req.amount(), weight); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	price := priceDeposit(stationID, req.Material, weight, req.Count, time.Now())
+	itemCount, containerSize := req.amount().countColumns(req.Material)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record deposit",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// Check the session again inside the transaction, so a deposit cannot
+	// land after the session was ended and its points summed
+	if _, err := loadGuestSession(tx, req.SessionToken, stationID); err != nil {
+		respondGuestSessionError(w, err)
+		return
+	}
+
+	assessment, points := scoreGuestDepositTx(tx, fraudCheck{GuestSession: req.SessionToken, Station: station,
+		Material: req.Material, Weight: weight, RawWeight: req.Weight, Quantity: req.amount().quantity(req.Material),
+		Points: price.Points, At: time.Now()}, price)
+
+	result, err := tx.Exec(`
+		INSERT INTO guest_deposits (session_token, item_type, weight_grams, raw_weight_grams, points_earned, station_id,
+			rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, barcode, brand,
+			fraud_score, review_status, fraud_reasons)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.SessionToken, req.Material, weight, req.Weight, points, stationID,
+		price.RateVersionID, price.Rate, price.Multiplier, price.MilliPoints, itemCount, containerSize,
+		match.Barcode, match.Brand, assessment.Score, assessment.reviewStatus(), assessment.heldReasons())
+
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record deposit",
+		})
+		return
+	}
+
+	depositID, _ := result.LastInsertId()
+
+	var pendingPoints int
+	tx.QueryRow(
+		"SELECT COALESCE(SUM(points_earned), 0) FROM guest_deposits WHERE session_token = ?",
+		req.SessionToken,
+	).Scan(&pendingPoints)
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record deposit",
+		})
+		return
+	}
+
+	log.Printf("Guest deposit recorded: session=%s, material=%s, weight=%.2f, points=%d",
+		req.SessionToken, req.Material, weight.Kg(), points)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Deposit recorded successfully",
+		Data: map[string]interface{}{
+			"depositId":     depositID,
+			"pointsEarned":  points,
+			"pendingPoints": pendingPoints,
+			"heldForReview": assessment.Held,
+		},
+	})
+}
+
+// claimHeldGuestDepositsTx copies a claimed session's held deposits into the
+// user's transaction history and queues them for review. They are credited
+// to the user if an admin approves them.
+func claimHeldGuestDepositsTx(tx *sql.Tx, userID int, sessionToken string) error {
+	rows, err := tx.Query(`
+		SELECT id, station_id, fraud_score, COALESCE(fraud_reasons, '[]')
+		FROM guest_deposits WHERE session_token = ? AND review_status = 'held'
+	`, sessionToken)
+	if err != nil {
+		return err
+	}
+	type heldDeposit struct {
+		id, stationID int
+		assessment    fraudAssessment
+	}
+	var held []heldDeposit
+	for rows.Next() {
+		var deposit heldDeposit
+		var reasons string
+		if err := rows.Scan(&deposit.id, &deposit.stationID, &deposit.assessment.Score, &reasons); err != nil {
+			rows.Close()
+			return err
+		}
+		json.Unmarshal([]byte(reasons), &deposit.assessment.Reasons)
+		deposit.assessment.Held = true
+		held = append(held, deposit)
+	}
+	rows.Close()
+
+	for _, deposit := range held {
+		result, err := tx.Exec(`
+			INSERT INTO transactions (user_id, type, item_type, weight_grams, raw_weight_grams, points_earned, station_id, session_token, timestamp,
+				rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, barcode, brand, fraud_score, review_status)
+			SELECT ?, 'deposit', item_type, weight_grams, COALESCE(raw_weight_grams, weight_grams), 0, station_id, session_token, timestamp,
+				rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, barcode, brand, fraud_score, ?
+			FROM guest_deposits WHERE id = ?
+		`, userID, reviewHeld, deposit.id)
+		if err != nil {
+			return err
+		}
+		transactionID, _ := result.LastInsertId()
+		if err := recordReviewTx(tx, transactionID, userID, deposit.stationID, deposit.assessment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endGuestSession closes a guest session and issues a claim code for its points
+func endGuestSession(w http.ResponseWriter, r *http.Request) {
+	stationID, err := getStationIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid station",
+		})
+		return
+	}
+
+	var req GuestSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	sessionID, err := loadGuestSession(database.DB, req.SessionToken, stationID)
+	if err != nil {
+		respondGuestSessionError(w, err)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to end session",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// Guard against a concurrent end of the same session
+	result, err := tx.Exec(
+		"UPDATE station_sessions SET status = ?, ended_at = ? WHERE id = ? AND status = ?",
+		"expired", time.Now().Format(time.RFC3339), sessionID, "guest",
+	)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to end session",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Guest session not found",
+		})
+		return
+	}
+
+	// Sum the points in the transaction that closed the session, so no
+	// deposit can be added after the total is taken
+	var pendingPoints, heldDeposits int
+	err = tx.QueryRow(`
+		SELECT COALESCE(SUM(points_earned), 0), COUNT(CASE WHEN review_status = 'held' THEN 1 END)
+		FROM guest_deposits WHERE session_token = ?
+	`, req.SessionToken).Scan(&pendingPoints, &heldDeposits)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to end session",
+		})
+		return
+	}
+
+	// Nothing to claim. Held deposits, and fractions of a point, are claimed
+	// too, so they still reach the user's account.
+	if pendingPoints == 0 && heldDeposits == 0 && guestSessionMilliPoints(tx, req.SessionToken) == 0 {
+		if err = tx.Commit(); err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to end session",
+			})
+			return
+		}
+		respondJSON(w, http.StatusOK, Response{
+			Success: true,
+			Message: "Session ended",
+			Data: map[string]interface{}{
+				"points": 0,
+			},
+		})
+		return
+	}
+
+	claimCode, err := generateClaimCode()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate claim code",
+		})
+		return
+	}
+
+	expiresAt := time.Now().Add(guestClaimExpiry)
+	_, err = tx.Exec(`
+		INSERT INTO guest_claims (claim_code, session_token, station_id, points, status, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, claimCode, req.SessionToken, stationID, pendingPoints, "open", expiresAt)
+
+	if err != nil {
+		log.Printf("endGuestSession: failed to insert claim: %v", err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create claim",
+		})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to end session",
+		})
+		return
+	}
+
+	qrBytes, err := qrcode.Encode(claimCode, qrcode.Medium, 256)
+	if err != nil {
+		log.Printf("Failed to generate QR code: %v", err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate QR code",
+		})
+		return
+	}
+	qrBase64 := base64.StdEncoding.EncodeToString(qrBytes)
+
+	log.Printf("Guest session ended: token=%s, points=%d, held=%d, claim=%s",
+		req.SessionToken, pendingPoints, heldDeposits, claimCode)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Session ended",
+		Data: map[string]interface{}{
+			"points":       pendingPoints,
+			"heldDeposits": heldDeposits,
+			"claimCode":    claimCode,
+			"qrCode":       "data:image/png;base64," + qrBase64,
+			"expiresAt":    expiresAt.Format(time.RFC3339),
+		},
+	})
+}
+
+// redeemClaim moves the points behind a guest claim code into the user's account
+func redeemClaim(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid user",
+		})
+		return
+	}
+
+	var req RedeemClaimRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	if code == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Claim code is required",
+		})
+		return
+	}
+
+	var claim database.GuestClaim
+	err = database.DB.QueryRow(`
+		SELECT id, session_token, station_id, points, status, expires_at
+		FROM guest_claims WHERE claim_code = ?
+	`, code).Scan(&claim.ID, &claim.SessionToken, &claim.StationID, &claim.Points,
+		&claim.Status, &claim.ExpiresAt)
+
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Invalid claim code",
+		})
+		return
+	}
+
+	if claim.Status != "open" {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Claim code has already been used",
+		})
+		return
+	}
+
+	if time.Now().After(claim.ExpiresAt) {
+		respondJSON(w, http.StatusGone, Response{
+			Success: false,
+			Error:   "Claim code has expired",
+		})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to redeem claim",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// Only one redeemer can flip the claim from open to claimed
+	result, err := tx.Exec(
+		"UPDATE guest_claims SET status = ?, claimed_by = ?, claimed_at = ? WHERE id = ? AND status = ?",
+		"claimed", userID, time.Now(), claim.ID, "open",
+	)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to redeem claim",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Claim code has already been used",
+		})
+		return
+	}
+
+	// Copy the guest deposits into the user's transaction history
+	_, err = tx.Exec(`
+		INSERT INTO transactions (user_id, type, item_type, weight_grams, raw_weight_grams, points_earned, station_id, session_token, timestamp,
+			rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, barcode, brand, fraud_score)
+		SELECT ?, 'deposit', item_type, weight_grams, COALESCE(raw_weight_grams, weight_grams), points_earned, station_id, session_token, timestamp,
+			rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, barcode, brand, fraud_score
+		FROM guest_deposits WHERE session_token = ? AND COALESCE(review_status, '') != 'held'
+	`, userID, claim.SessionToken)
+	if err == nil {
+		err = claimHeldGuestDepositsTx(tx, userID, claim.SessionToken)
+	}
+
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record transactions",
+		})
+		return
+	}
+
+	// The fraction of a point left over in the session is carried to the user
+	carried := guestSessionMilliPoints(tx, claim.SessionToken) - int64(claim.Points)*milliPerPoint
+	_, err = tx.Exec(
+		"UPDATE users SET point_remainder = point_remainder + ?, updated_at = ? WHERE id = ?",
+		carried, time.Now(), userID,
+	)
+	if err == nil {
+		err = postPointsTx(tx, ledgerPosting{UserID: userID, Points: claim.Points, Account: accountIssuance,
+			Kind: journalClaim, Reference: "guest_claim", ReferenceID: int64(claim.ID)})
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update user balance",
+		})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to complete claim",
+		})
+		return
+	}
+
+	var newBalance int
+	database.DB.QueryRow("SELECT total_points FROM users WHERE id = ?", userID).Scan(&newBalance)
+
+	log.Printf("Guest claim redeemed: user=%d, claim=%s, points=%d", userID, code, claim.Points)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Points claimed successfully",
+		Data: map[string]interface{}{
+			"points_claimed": claim.Points,
+			"total_points":   newBalance,
+			"station_id":     claim.StationID,
+		},
+	})
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"t2cbackend/database"
+)
+
+// A session whose only deposit was held still gets a claim code, so the
+// deposit can reach a user's review queue
+func TestEndGuestSessionHeldOnly(t *testing.T) {
+	openTestDB(t)
+	token := "guest-held"
+	_, err := database.DB.Exec(
+		"INSERT INTO station_sessions (session_token, station_id, status, expires_at) VALUES (?, ?, ?, ?)",
+		token, "1", "guest", time.Now().Add(time.Hour).Format(time.RFC3339),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.DB.Exec(`
+		INSERT INTO guest_deposits (session_token, item_type, weight_grams, raw_weight_grams, points_earned, station_id,
+			milli_points, fraud_score, review_status, fraud_reasons)
+		VALUES (?, 'plastic', 30000, 30000, 0, 1, 300000, 60, 'held', '[{"rule":"quantity","score":60}]')
+	`, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/session/guest/end", strings.NewReader(`{"sessionToken":"`+token+`"}`))
+	req.Header.Set("X-Station-ID", "1")
+	rec := httptest.NewRecorder()
+	endGuestSession(rec, req)
+
+	var resp struct {
+		Data struct {
+			Points       int    `json:"points"`
+			HeldDeposits int    `json:"heldDeposits"`
+			ClaimCode    string `json:"claimCode"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("endGuestSession() = %d %s", rec.Code, rec.Body)
+	}
+	if rec.Code != http.StatusOK || resp.Data.ClaimCode == "" {
+		t.Fatalf("endGuestSession() = %d %s, want a claim code", rec.Code, rec.Body)
+	}
+	if resp.Data.Points != 0 || resp.Data.HeldDeposits != 1 {
+		t.Errorf("endGuestSession() points = %d, held = %d, want 0 and 1", resp.Data.Points, resp.Data.HeldDeposits)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/claims/redeem", strings.NewReader(`{"code":"`+resp.Data.ClaimCode+`"}`))
+	req.Header.Set("X-User-ID", "2")
+	rec = httptest.NewRecorder()
+	redeemClaim(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("redeemClaim() = %d %s", rec.Code, rec.Body)
+	}
+
+	var reviews int
+	database.DB.QueryRow(`
+		SELECT COUNT(*) FROM deposit_reviews r JOIN transactions t ON t.id = r.transaction_id
+		WHERE t.user_id = 2 AND t.review_status = 'held' AND r.status = 'pending'
+	`).Scan(&reviews)
+	if reviews != 1 {
+		t.Errorf("%d pending reviews for the claimed deposit, want 1", reviews)
+	}
+	// Nothing is credited until the review approves it
+	if _, cached := walletBalance(t, 2); cached != 2500 {
+		t.Errorf("total_points = %d, want 2500", cached)
+	}
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Heartbeat settings. Stations are degraded after missing two heartbeats and
+// offline after missing five.
+const (
+	heartbeatInterval     = time.Minute
+	degradedAfter         = 2 * heartbeatInterval
+	offlineAfter          = 5 * heartbeatInterval
+	heartbeatCheckEvery   = 30 * time.Second
+	statusHistoryPageSize = 100
+)
+
+// HeartbeatRequest represents a station heartbeat
+type HeartbeatRequest struct {
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+	UptimeSeconds   int64  `json:"uptime_seconds,omitempty"`
+}
+
+// deriveConnectivity returns the connectivity state implied by the time since
+// the last heartbeat
+func deriveConnectivity(lastHeartbeat time.Time, now time.Time) string {
+	elapsed := now.Sub(lastHeartbeat)
+	switch {
+	case elapsed > offlineAfter:
+		return "offline"
+	case elapsed > degradedAfter:
+		return "degraded"
+	default:
+		return "online"
+	}
+}
+
+// recordConnectivityChange moves a station from one connectivity state to
+// another and records the transition. It returns false if the station was no
+// longer in the expected state.
+func recordConnectivityChange(stationID int, from, to, reason string, at time.Time) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE stations SET connectivity = ? WHERE id = ? AND COALESCE(connectivity, 'unknown') = ?",
+		to, stationID, from,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO station_status_history (station_id, from_state, to_state, reason, changed_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, stationID, from, to, reason, at)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// stationHeartbeat records that the authenticated station is powered on
+func stationHeartbeat(w http.ResponseWriter, r *http.Request) {
+	stationID, err := getStationIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid station",
+		})
+		return
+	}
+
+	// Body is optional
+	var req HeartbeatRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	now := time.Now().UTC()
+	var previous string
+	err = database.DB.QueryRow(
+		"SELECT COALESCE(connectivity, 'unknown') FROM stations WHERE id = ?",
+		stationID,
+	).Scan(&previous)
+	if err != nil {
+		respondStationError(w, errStationNotFound)
+		return
+	}
+
+	_, err = database.DB.Exec("UPDATE stations SET last_heartbeat = ? WHERE id = ?", now, stationID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record heartbeat",
+		})
+		return
+	}
+
+	if previous != "online" {
+		reason := "Heartbeat received"
+		if req.FirmwareVersion != "" {
+			reason = fmt.Sprintf("Heartbeat received (firmware %s, uptime %ds)", req.FirmwareVersion, req.UptimeSeconds)
+		}
+		if _, err := recordConnectivityChange(stationID, previous, "online", reason, now); err != nil {
+			log.Printf("stationHeartbeat: failed to record status change for station %d: %v", stationID, err)
+		} else {
+			log.Printf("Station %d is online (was %s)", stationID, previous)
+		}
+	}
+
+	// Stations compare these with their cached versions and refetch
+	// /api/stations/{id}/config when either has moved on
+	effective, err := effectiveStationConfig(stationID)
+	if err != nil {
+		log.Printf("stationHeartbeat: failed to load configuration for station %d: %v", stationID, err)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"connectivity":           "online",
+			"server_time":            now.Format(time.RFC3339),
+			"heartbeat_interval_s":   int(heartbeatInterval.Seconds()),
+			"config_global_version":  effective.GlobalVersion,
+			"config_station_version": effective.StationVersion,
+		},
+	})
+}
+
+// checkStationHeartbeats downgrades stations that have stopped heartbeating
+// and alerts when one is offline during operating hours. A station that went
+// offline while closed is reported as soon as it opens.
+func checkStationHeartbeats() {
+	rows, err := database.DB.Query(
+		"SELECT " + stationColumns + " FROM stations WHERE status != 'disabled' AND last_heartbeat IS NOT NULL",
+	)
+	if err != nil {
+		log.Printf("checkStationHeartbeats: failed to load stations: %v", err)
+		return
+	}
+
+	var stations []database.Station
+	for rows.Next() {
+		station, err := scanStation(rows)
+		if err != nil {
+			continue
+		}
+		stations = append(stations, station)
+	}
+	rows.Close()
+
+	now := time.Now().UTC()
+	for _, station := range stations {
+		state := deriveConnectivity(*station.LastHeartbeat, now)
+		// Only a heartbeat can bring a station back online
+		if state != station.Connectivity && state != "online" {
+			missed := int(now.Sub(*station.LastHeartbeat) / heartbeatInterval)
+			reason := fmt.Sprintf("Missed %d heartbeats", missed)
+			changed, err := recordConnectivityChange(station.ID, station.Connectivity, state, reason, now)
+			if err != nil {
+				log.Printf("checkStationHeartbeats: failed to record status change for station %d: %v", station.ID, err)
+				continue
+			}
+			if changed {
+				log.Printf("Station %d is %s (was %s)", station.ID, state, station.Connectivity)
+			}
+		}
+
+		if state == "offline" && stationOpenAt(station, now) {
+			alertStationOffline(station, now)
+		}
+	}
+}
+
+// alertStationOffline raises the offline alert for a station once per outage.
+// An outage ends with the next heartbeat.
+func alertStationOffline(station database.Station, now time.Time) {
+	result, err := database.DB.Exec(`
+		UPDATE stations SET offline_alerted_at = ?
+		WHERE id = ? AND (offline_alerted_at IS NULL OR offline_alerted_at < last_heartbeat)
+	`, now, station.ID)
+	if err != nil {
+		log.Printf("checkStationHeartbeats: failed to record offline alert for station %d: %v", station.ID, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+
+	raiseAlert(station.ID, "station_offline", fmt.Sprintf(
+		"%s has been offline since %s, during operating hours",
+		station.Location, station.LastHeartbeat.Format(time.RFC3339),
+	))
+}
+
+// getStationStatusHistory lists a station's connectivity transitions, newest first
+func getStationStatusHistory(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, station_id, from_state, to_state, COALESCE(reason, ''), changed_at
+		FROM station_status_history
+		WHERE station_id = ?
+		ORDER BY changed_at DESC, id DESC
+		LIMIT ?
+	`, stationID, statusHistoryPageSize)
+
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve history",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var history []database.StationStatusChange
+	for rows.Next() {
+		var change database.StationStatusChange
+		err := rows.Scan(&change.ID, &change.StationID, &change.FromState, &change.ToState,
+			&change.Reason, &change.ChangedAt)
+		if err != nil {
+			continue
+		}
+		history = append(history, change)
+	}
+
+	if history == nil {
+		history = []database.StationStatusChange{}
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    history,
+	})
+}
@@ -0,0 +1,609 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Schedule limits
+const (
+	nextOpenSearchDays = 14 // give up looking for the next opening after this
+	scheduleLookahead  = 60 // days of holidays shown in a station's schedule
+	maxClosureDuration = 90 * 24 * time.Hour
+	holidayDateLayout  = "2006-01-02"
+	closedAllDay       = "closed"
+	minutesPerDay      = 24 * 60
+)
+
+// dayNames maps weekdays to the operating_hours keys that override the
+// weekday/weekend hours for a single day
+var dayNames = map[time.Weekday]string{
+	time.Monday:    "monday",
+	time.Tuesday:   "tuesday",
+	time.Wednesday: "wednesday",
+	time.Thursday:  "thursday",
+	time.Friday:    "friday",
+	time.Saturday:  "saturday",
+	time.Sunday:    "sunday",
+}
+
+// stationClosedError is returned when a station is outside its opening hours
+type stationClosedError struct {
+	nextOpen *time.Time
+	loc      *time.Location
+}
+
+func (e *stationClosedError) Error() string {
+	if e.nextOpen == nil {
+		return "station is closed"
+	}
+	return "station is closed until " + e.nextOpen.In(e.loc).Format(time.RFC3339)
+}
+
+// HolidayRequest represents a holiday to add to the calendar
+type HolidayRequest struct {
+	StationID int    `json:"station_id"` // 0 for every station
+	Date      string `json:"date"`
+	Name      string `json:"name"`
+	Hours     string `json:"hours"` // empty to close all day
+}
+
+// ClosureRequest represents a temporary station closure
+type ClosureRequest struct {
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Reason   string    `json:"reason"`
+}
+
+// parseHoursRange parses an "HH:MM-HH:MM" range into minutes after midnight.
+// A range may close at "24:00", and one that closes before it opens runs
+// past midnight: "22:00-06:00" closes at minute 1800 of the day it opens.
+func parseHoursRange(hours string) (int, int, bool) {
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	open, err := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	openMinute := open.Hour()*60 + open.Minute()
+
+	closeMinute := minutesPerDay
+	if closing := strings.TrimSpace(parts[1]); closing != "24:00" {
+		closeAt, err := time.Parse("15:04", closing)
+		if err != nil {
+			return 0, 0, false
+		}
+		closeMinute = closeAt.Hour()*60 + closeAt.Minute()
+	}
+	if closeMinute == openMinute {
+		return 0, 0, false
+	}
+	if closeMinute < openMinute {
+		closeMinute += minutesPerDay
+	}
+	return openMinute, closeMinute, true
+}
+
+// stationLocation returns a station's time zone, falling back to UTC
+func stationLocation(station database.Station) *time.Location {
+	loc, err := time.LoadLocation(station.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// hoursOn returns the opening hours for a local date. A holiday for the
+// station, or for every station, replaces the regular hours. ok is false
+// when the station is closed all day.
+func hoursOn(stationID int, hours map[string]string, date time.Time) (int, int, bool) {
+	var holidayHours sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT hours FROM holidays
+		WHERE date = ? AND station_id IN (0, ?)
+		ORDER BY station_id DESC LIMIT 1
+	`, date.Format(holidayDateLayout), stationID).Scan(&holidayHours)
+	if err == nil {
+		return parseHoursRange(holidayHours.String)
+	}
+
+	regular, found := hours[dayNames[date.Weekday()]]
+	if !found {
+		regular = hours["weekday"]
+		if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+			regular = hours["weekend"]
+		}
+	}
+	if regular == closedAllDay {
+		return 0, 0, false
+	}
+	return parseHoursRange(regular)
+}
+
+// activeClosure returns the temporary closure covering t, or nil
+func activeClosure(stationID int, t time.Time) *database.StationClosure {
+	var closure database.StationClosure
+	err := database.DB.QueryRow(`
+		SELECT id, station_id, starts_at, ends_at, COALESCE(reason, '')
+		FROM station_closures
+		WHERE station_id = ? AND starts_at <= ? AND ends_at > ?
+		ORDER BY ends_at DESC LIMIT 1
+	`, stationID, t.UTC(), t.UTC()).Scan(&closure.ID, &closure.StationID, &closure.StartsAt,
+		&closure.EndsAt, &closure.Reason)
+	if err != nil {
+		return nil
+	}
+	return &closure
+}
+
+// nextStationOpening returns the first time at or after t when the station is
+// open, or nil if it stays closed for the next two weeks
+func nextStationOpening(station database.Station, t time.Time) *time.Time {
+	loc := stationLocation(station)
+	hours := stationConfigOrDefault(station.ID).OperatingHours
+	limit := t.Add(nextOpenSearchDays * 24 * time.Hour)
+
+	candidate := t
+	for candidate.Before(limit) {
+		local := candidate.In(loc)
+		midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		nextMidnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc)
+
+		minute := local.Hour()*60 + local.Minute()
+
+		// Hours that run past midnight carry over from the previous day
+		yesterday := time.Date(local.Year(), local.Month(), local.Day()-1, 0, 0, 0, 0, loc)
+		_, carriedClose, carried := hoursOn(station.ID, hours, yesterday)
+		if !carried || minute+minutesPerDay >= carriedClose {
+			open, closeAt, ok := hoursOn(station.ID, hours, midnight)
+			if !ok || minute >= closeAt {
+				candidate = nextMidnight
+				continue
+			}
+			if minute < open {
+				candidate = midnight.Add(time.Duration(open) * time.Minute)
+			}
+		}
+
+		if closure := activeClosure(station.ID, candidate); closure != nil {
+			candidate = closure.EndsAt
+			continue
+		}
+
+		next := candidate.UTC()
+		return &next
+	}
+	return nil
+}
+
+// stationOpenState reports whether a station is open at t and, if it is not,
+// when it next opens
+func stationOpenState(station database.Station, t time.Time) (bool, *time.Time) {
+	next := nextStationOpening(station, t)
+	if next != nil && !next.After(t) {
+		return true, nil
+	}
+	return false, next
+}
+
+// stationOpenAt reports whether a station is within its opening hours at t,
+// taking its time zone, holidays and temporary closures into account
+func stationOpenAt(station database.Station, t time.Time) bool {
+	open, _ := stationOpenState(station, t)
+	return open
+}
+
+// checkStationOpen returns a stationClosedError if the station is closed at t
+func checkStationOpen(station database.Station, t time.Time) error {
+	open, next := stationOpenState(station, t)
+	if open {
+		return nil
+	}
+	return &stationClosedError{nextOpen: next, loc: stationLocation(station)}
+}
+
+// loadOpenStation retrieves a station that is active and within its opening hours
+func loadOpenStation(id int) (database.Station, error) {
+	station, err := loadActiveStation(id)
+	if err != nil {
+		return station, err
+	}
+	return station, checkStationOpen(station, time.Now().UTC())
+}
+
+// withOpenState sets the is_open and next_open fields shown in listings
+func withOpenState(station database.Station, t time.Time) database.Station {
+	open, next := stationOpenState(station, t)
+	station.IsOpen = &open
+	station.NextOpen = next
+	return station
+}
+
+// respondStationClosed responds to a request made outside opening hours
+func respondStationClosed(w http.ResponseWriter, closed *stationClosedError) {
+	message := "Station is closed"
+	data := map[string]interface{}{"next_open": nil}
+	if closed.nextOpen != nil {
+		local := closed.nextOpen.In(closed.loc)
+		message = fmt.Sprintf("Station is closed. It opens again at %s", local.Format("Mon 2 Jan 15:04 MST"))
+		data["next_open"] = local.Format(time.RFC3339)
+	}
+	respondJSON(w, http.StatusConflict, Response{
+		Success: false,
+		Error:   message,
+		Data:    data,
+	})
+}
+
+// getStationSchedule returns a station's hours, whether it is open now, and
+// its upcoming holidays and closures
+func getStationSchedule(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	station, err := loadStation(stationID)
+	if err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	loc := stationLocation(station)
+	today := now.In(loc).Format(holidayDateLayout)
+	until := now.In(loc).AddDate(0, 0, scheduleLookahead).Format(holidayDateLayout)
+
+	holidays := []database.Holiday{}
+	rows, err := database.DB.Query(`
+		SELECT id, station_id, date, name, COALESCE(hours, ''), created_at
+		FROM holidays
+		WHERE station_id IN (0, ?) AND date >= ? AND date <= ?
+		ORDER BY date, station_id DESC
+	`, stationID, today, until)
+	if err == nil {
+		for rows.Next() {
+			var holiday database.Holiday
+			err := rows.Scan(&holiday.ID, &holiday.StationID, &holiday.Date, &holiday.Name,
+				&holiday.Hours, &holiday.CreatedAt)
+			if err != nil {
+				continue
+			}
+			// A station's own holiday replaces a global one on the same date
+			if n := len(holidays); n > 0 && holidays[n-1].Date == holiday.Date {
+				continue
+			}
+			holidays = append(holidays, holiday)
+		}
+		rows.Close()
+	}
+
+	closures := []database.StationClosure{}
+	rows, err = database.DB.Query(`
+		SELECT id, station_id, starts_at, ends_at, COALESCE(reason, ''), COALESCE(created_by, 0), created_at
+		FROM station_closures
+		WHERE station_id = ? AND ends_at > ?
+		ORDER BY starts_at
+	`, stationID, now)
+	if err == nil {
+		for rows.Next() {
+			var closure database.StationClosure
+			err := rows.Scan(&closure.ID, &closure.StationID, &closure.StartsAt, &closure.EndsAt,
+				&closure.Reason, &closure.CreatedBy, &closure.CreatedAt)
+			if err != nil {
+				continue
+			}
+			closures = append(closures, closure)
+		}
+		rows.Close()
+	}
+
+	open, next := stationOpenState(station, now)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"station_id":      stationID,
+			"timezone":        loc.String(),
+			"operating_hours": stationConfigOrDefault(stationID).OperatingHours,
+			"is_open":         open,
+			"next_open":       next,
+			"holidays":        holidays,
+			"closures":        closures,
+		},
+	})
+}
+
+// listHolidays lists holidays from today onwards, optionally for one station
+func listHolidays(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT id, station_id, date, name, COALESCE(hours, ''), created_at
+		FROM holidays WHERE date >= ?`
+	args := []interface{}{time.Now().UTC().AddDate(0, 0, -1).Format(holidayDateLayout)}
+	if station := r.URL.Query().Get("station_id"); station != "" {
+		stationID, err := strconv.Atoi(station)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Invalid station ID",
+			})
+			return
+		}
+		query += " AND station_id = ?"
+		args = append(args, stationID)
+	}
+	query += " ORDER BY date, station_id"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve holidays",
+		})
+		return
+	}
+	defer rows.Close()
+
+	holidays := []database.Holiday{}
+	for rows.Next() {
+		var holiday database.Holiday
+		err := rows.Scan(&holiday.ID, &holiday.StationID, &holiday.Date, &holiday.Name,
+			&holiday.Hours, &holiday.CreatedAt)
+		if err != nil {
+			continue
+		}
+		holidays = append(holidays, holiday)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    holidays,
+	})
+}
+
+// createHoliday adds a holiday for one station or every station
+func createHoliday(w http.ResponseWriter, r *http.Request) {
+	var req HolidayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Name is required",
+		})
+		return
+	}
+	if _, err := time.Parse(holidayDateLayout, req.Date); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Date must be YYYY-MM-DD",
+		})
+		return
+	}
+	if req.Hours != "" {
+		if _, _, ok := parseHoursRange(req.Hours); !ok {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Hours must be HH:MM-HH:MM",
+			})
+			return
+		}
+	}
+	if req.StationID != 0 {
+		if _, err := loadStation(req.StationID); err != nil {
+			respondStationError(w, err)
+			return
+		}
+	}
+
+	var hours interface{}
+	if req.Hours != "" {
+		hours = req.Hours
+	}
+
+	result, err := database.DB.Exec(
+		"INSERT INTO holidays (station_id, date, name, hours) VALUES (?, ?, ?, ?)",
+		req.StationID, req.Date, req.Name, hours,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			respondJSON(w, http.StatusConflict, Response{
+				Success: false,
+				Error:   "A holiday already exists on this date",
+			})
+			return
+		}
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create holiday",
+		})
+		return
+	}
+
+	id, _ := result.LastInsertId()
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Holiday created",
+		Data: database.Holiday{
+			ID:        int(id),
+			StationID: req.StationID,
+			Date:      req.Date,
+			Name:      req.Name,
+			Hours:     req.Hours,
+			CreatedAt: time.Now().UTC(),
+		},
+	})
+}
+
+// deleteHoliday removes a holiday
+func deleteHoliday(w http.ResponseWriter, r *http.Request) {
+	holidayID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid holiday ID",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec("DELETE FROM holidays WHERE id = ?", holidayID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete holiday",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Holiday not found",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Holiday deleted",
+	})
+}
+
+// createClosure closes a station temporarily
+func createClosure(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	if _, err := loadStation(stationID); err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	var req ClosureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	if req.StartsAt.IsZero() {
+		req.StartsAt = now
+	}
+	req.StartsAt = req.StartsAt.UTC()
+	req.EndsAt = req.EndsAt.UTC()
+	if !req.EndsAt.After(req.StartsAt) || !req.EndsAt.After(now) {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "ends_at must be in the future and after starts_at",
+		})
+		return
+	}
+	if req.EndsAt.Sub(req.StartsAt) > maxClosureDuration {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Closures can last at most 90 days; set the station to maintenance instead",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		INSERT INTO station_closures (station_id, starts_at, ends_at, reason, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, stationID, req.StartsAt, req.EndsAt, req.Reason, userID, now)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create closure",
+		})
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	log.Printf("Station %d closed from %s to %s: %s", stationID,
+		req.StartsAt.Format(time.RFC3339), req.EndsAt.Format(time.RFC3339), req.Reason)
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Closure created",
+		Data: database.StationClosure{
+			ID:        int(id),
+			StationID: stationID,
+			StartsAt:  req.StartsAt,
+			EndsAt:    req.EndsAt,
+			Reason:    req.Reason,
+			CreatedBy: userID,
+			CreatedAt: now,
+		},
+	})
+}
+
+// deleteClosure ends or cancels a temporary closure
+func deleteClosure(w http.ResponseWriter, r *http.Request) {
+	stationID, stationErr := strconv.Atoi(chi.URLParam(r, "id"))
+	closureID, closureErr := strconv.Atoi(chi.URLParam(r, "closureID"))
+	if err := errors.Join(stationErr, closureErr); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station or closure ID",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(
+		"DELETE FROM station_closures WHERE id = ? AND station_id = ?",
+		closureID, stationID,
+	)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete closure",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Closure not found",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Closure deleted",
+	})
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"t2cbackend/database"
+)
+
+// Idempotency keys let clients retry requests that move points without
+// applying them twice. Responses are kept per key and caller for a day.
+const (
+	idempotencyKeyTTL       = 24 * time.Hour
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBodyBytes  = 1 << 20
+)
+
+// idempotencyRecorder captures a handler's response so it can be replayed
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotencyCaller returns the user a key is stored under and the key as
+// stored, or false if the caller is not known
+type idempotencyCaller func(r *http.Request, key string) (int, string, bool)
+
+// idempotencyMiddleware replays the stored response when a request is retried
+// with the same Idempotency-Key. A key reused with a different request is
+// refused. Requests without the header are handled as usual. It must run
+// after authMiddleware.
+func idempotencyMiddleware(next http.Handler) http.Handler {
+	return idempotentHandler(next, "Invalid user", func(r *http.Request, key string) (int, string, bool) {
+		userID, err := getUserIDFromHeader(r)
+		return userID, key, err == nil
+	})
+}
+
+// stationIdempotencyMiddleware is idempotencyMiddleware for station routes. It
+// must run after stationAuthMiddleware. Stations have no user, so their keys
+// are stored under user 0 with the station's ID in front.
+func stationIdempotencyMiddleware(next http.Handler) http.Handler {
+	return idempotentHandler(next, "Invalid station", func(r *http.Request, key string) (int, string, bool) {
+		stationID, err := getStationIDFromHeader(r)
+		return 0, fmt.Sprintf("station:%d:%s", stationID, key), err == nil
+	})
+}
+
+// idempotentHandler wraps next with Idempotency-Key handling, storing keys
+// per caller. invalid is the error returned when the caller is not known.
+func idempotentHandler(next http.Handler, invalid string, caller idempotencyCaller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Idempotency-Key must be at most 255 characters",
+			})
+			return
+		}
+
+		userID, key, ok := caller(r, key)
+		if !ok {
+			respondJSON(w, http.StatusUnauthorized, Response{
+				Success: false,
+				Error:   invalid,
+			})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodyBytes))
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Invalid request body",
+			})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// The same key on another endpoint counts as a different request
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		// Claim the key. Expired keys are released first; the primary key
+		// stops two concurrent requests from both claiming it.
+		now := time.Now().UTC()
+		database.DB.Exec(
+			"DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ? AND created_at < ?",
+			userID, key, now.Add(-idempotencyKeyTTL),
+		)
+		result, err := database.DB.Exec(`
+			INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash, created_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, idempotency_key) DO NOTHING
+		`, userID, key, requestHash, now)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to check Idempotency-Key",
+			})
+			return
+		}
+
+		if n, _ := result.RowsAffected(); n == 0 {
+			replayIdempotentResponse(w, userID, key, requestHash)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		defer func() {
+			// Server errors and panics are not kept, so the client can retry them
+			if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+				database.DB.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?", userID, key)
+				return
+			}
+			_, err := database.DB.Exec(`
+				UPDATE idempotency_keys SET status_code = ?, response = ?
+				WHERE user_id = ? AND idempotency_key = ?
+			`, rec.status, rec.body.String(), userID, key)
+			if err != nil {
+				log.Printf("Failed to store response for Idempotency-Key %q of user %d: %v", key, userID, err)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// replayIdempotentResponse answers a request whose key was already claimed
+func replayIdempotentResponse(w http.ResponseWriter, userID int, key, requestHash string) {
+	var storedHash, response string
+	var status *int
+	err := database.DB.QueryRow(`
+		SELECT request_hash, status_code, COALESCE(response, '')
+		FROM idempotency_keys
+		WHERE user_id = ? AND idempotency_key = ?
+	`, userID, key).Scan(&storedHash, &status, &response)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to check Idempotency-Key",
+		})
+		return
+	}
+
+	if storedHash != requestHash {
+		respondJSON(w, http.StatusUnprocessableEntity, Response{
+			Success: false,
+			Error:   "Idempotency-Key was already used with a different request",
+		})
+		return
+	}
+	if status == nil {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "A request with this Idempotency-Key is still being processed",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(*status)
+	io.WriteString(w, response)
+}
+
+// pruneIdempotencyKeys deletes keys older than idempotencyKeyTTL
+func pruneIdempotencyKeys() {
+	result, err := database.DB.Exec(
+		"DELETE FROM idempotency_keys WHERE created_at < ?", time.Now().UTC().Add(-idempotencyKeyTTL),
+	)
+	if err != nil {
+		log.Printf("pruneIdempotencyKeys: failed to prune keys: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Pruned %d expired idempotency keys", n)
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// countedHandler counts the requests that reach it and answers with
+// status, or 201 with the call number
+func countedHandler(calls *int, status int) http.Handler {
+	return idempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if status != 0 {
+			respondJSON(w, status, Response{Success: false, Error: "failed"})
+			return
+		}
+		respondJSON(w, http.StatusCreated, Response{Success: true, Data: *calls})
+	}))
+}
+
+// idempotentRequest sends a request with an Idempotency-Key as the demo user
+func idempotentRequest(h http.Handler, path, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("X-User-ID", "2")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	openTestDB(t)
+	var calls int
+	h := countedHandler(&calls, 0)
+
+	first := idempotentRequest(h, "/api/deposit", "key-1", `{"material":"plastic","weight":1.5}`)
+	second := idempotentRequest(h, "/api/deposit", "key-1", `{"material":"plastic","weight":1.5}`)
+	if calls != 1 {
+		t.Fatalf("handler called %d times, want 1", calls)
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %s, want %d %s", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay is missing Idempotent-Replayed: true")
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("first response has Idempotent-Replayed set")
+	}
+
+	// Without a key every request is handled
+	idempotentRequest(h, "/api/deposit", "", `{}`)
+	idempotentRequest(h, "/api/deposit", "", `{}`)
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+}
+
+func TestIdempotencyMismatch(t *testing.T) {
+	openTestDB(t)
+	var calls int
+	h := countedHandler(&calls, 0)
+
+	idempotentRequest(h, "/api/deposit", "key-1", `{"weight":1.5}`)
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"different body", "/api/deposit", `{"weight":15}`},
+		{"different endpoint", "/api/redemption/redeem", `{"weight":1.5}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := idempotentRequest(h, tt.path, "key-1", tt.body)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+			}
+		})
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+// Server errors are not stored, so the request can be retried with its key
+func TestIdempotencyServerError(t *testing.T) {
+	openTestDB(t)
+	var calls int
+	h := countedHandler(&calls, http.StatusInternalServerError)
+
+	idempotentRequest(h, "/api/deposit", "key-1", `{}`)
+	rec := idempotentRequest(h, "/api/deposit", "key-1", `{}`)
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+	if rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("server error was replayed")
+	}
+}
+
+// Stations keep their keys apart from each other and from users
+func TestStationIdempotency(t *testing.T) {
+	openTestDB(t)
+	var calls int
+	h := stationIdempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		respondJSON(w, http.StatusCreated, Response{Success: true, Data: calls})
+	}))
+	send := func(stationID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/station/deposit", strings.NewReader(`{"weight":1.5}`))
+		req.Header.Set("X-Station-ID", stationID)
+		req.Header.Set("Idempotency-Key", "key-1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	send("1")
+	if rec := send("1"); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry from the same station was not replayed: %d %s", rec.Code, rec.Body)
+	}
+	if rec := send("2"); rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("same key from another station = %d %s, want it handled", rec.Code, rec.Body)
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,27 @@
+package api
+
+import "time"
+
+// StartBackgroundJobs starts the periodic maintenance jobs. It should be
+// called once, after the database is initialized.
+func StartBackgroundJobs() {
+	// Balances from before the ledger are opened before anything is posted
+	openLedgerWallets()
+
+	go runEvery(time.Hour, pruneTelemetry)
+	go runEvery(heartbeatCheckEvery, checkStationHeartbeats)
+	go runEvery(commandCheckEvery, checkCommandTimeouts)
+	go runEvery(deviationCheckEvery, checkScaleDeviations)
+	go runEvery(time.Hour, pruneIdempotencyKeys)
+	go runEvery(time.Hour, checkLedgerDrift)
+}
+
+// runEvery calls fn immediately and then once per interval
+func runEvery(interval time.Duration, fn func()) {
+	fn()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fn()
+	}
+}
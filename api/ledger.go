@@ -0,0 +1,483 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"t2cbackend/database"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Ledger system accounts. Every user also has a wallet account, and each
+// journal moves points between a wallet and one of these.
+const (
+	accountIssuance   = "issuance"             // points created by deposits, claims and adjustments
+	accountRedemption = "redemption_liability" // points redeemed and owed as payouts
+	accountExpiry     = "expiry"               // points that expired unused
+)
+
+// systemAccounts lists the accounts the ledger cannot work without
+var systemAccounts = []string{accountIssuance, accountRedemption, accountExpiry}
+
+// Journal kinds
+const (
+	journalOpening    = "opening" // balance from before the ledger
+	journalDeposit    = "deposit"
+	journalClaim      = "claim"
+	journalRedemption = "redemption"
+	journalAdjustment = "adjustment"
+)
+
+var (
+	// errNegativeBalance is returned when a deduction exceeds the user's balance
+	errNegativeBalance = errors.New("balance would become negative")
+
+	// errUnbalancedJournal is returned for a journal whose entries do not add up to zero
+	errUnbalancedJournal = errors.New("journal entries must add up to zero")
+)
+
+// ledgerPosting moves points between a user's wallet and a system account.
+// Positive points go to the wallet.
+type ledgerPosting struct {
+	UserID      int
+	Points      int
+	Account     string
+	Kind        string
+	Reference   string // table the journal is about, e.g. "transaction"
+	ReferenceID int64
+	Memo        string
+}
+
+// ledgerLine is one entry of a journal
+type ledgerLine struct {
+	AccountID int64
+	Amount    int
+}
+
+// walletCode returns the ledger account code of a user's wallet
+func walletCode(userID int) string {
+	return fmt.Sprintf("wallet:%d", userID)
+}
+
+// accountIDTx returns a ledger account's ID by code
+func accountIDTx(tx *sql.Tx, code string) (int64, error) {
+	var id int64
+	err := tx.QueryRow("SELECT id FROM ledger_accounts WHERE code = ?", code).Scan(&id)
+	return id, err
+}
+
+// walletAccountTx returns a user's wallet account, opening it on first use.
+// A balance the user had from before the ledger is posted as an opening
+// journal, so the wallet starts level with users.total_points.
+func walletAccountTx(tx *sql.Tx, userID int) (int64, error) {
+	// Only the posting that opens the wallet adds the opening journal, even
+	// if another opens it at the same time
+	result, err := tx.Exec(
+		"INSERT OR IGNORE INTO ledger_accounts (code, user_id) VALUES (?, ?)", walletCode(userID), userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := accountIDTx(tx, walletCode(userID))
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return id, nil
+	}
+
+	var balance int
+	if err = tx.QueryRow("SELECT total_points FROM users WHERE id = ?", userID).Scan(&balance); err != nil {
+		return 0, err
+	}
+	if balance != 0 {
+		issuance, err := accountIDTx(tx, accountIssuance)
+		if err != nil {
+			return 0, err
+		}
+		err = postJournalTx(tx, journalOpening, "user", int64(userID), "Balance before the ledger",
+			ledgerLine{AccountID: id, Amount: balance}, ledgerLine{AccountID: issuance, Amount: -balance})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// postJournalTx records a balanced journal
+func postJournalTx(tx *sql.Tx, kind, reference string, referenceID int64, memo string, lines ...ledgerLine) error {
+	sum := 0
+	for _, line := range lines {
+		sum += line.Amount
+	}
+	if sum != 0 || len(lines) < 2 {
+		return errUnbalancedJournal
+	}
+
+	var ref, refID, memoValue interface{}
+	if reference != "" {
+		ref, refID = reference, referenceID
+	}
+	if memo != "" {
+		memoValue = memo
+	}
+	result, err := tx.Exec(`
+		INSERT INTO ledger_journals (kind, reference_type, reference_id, memo, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, kind, ref, refID, memoValue, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	journalID, _ := result.LastInsertId()
+
+	for _, line := range lines {
+		_, err = tx.Exec(
+			"INSERT INTO ledger_entries (journal_id, account_id, amount) VALUES (?, ?, ?)",
+			journalID, line.AccountID, line.Amount,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postPointsTx records a posting in the ledger and applies it to the user's
+// cached balance. This is the only place users.total_points changes.
+// Deductions may not take the balance below zero.
+func postPointsTx(tx *sql.Tx, p ledgerPosting) error {
+	if p.Points == 0 {
+		return nil
+	}
+
+	wallet, err := walletAccountTx(tx, p.UserID)
+	if err != nil {
+		return err
+	}
+	account, err := accountIDTx(tx, p.Account)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE users SET total_points = total_points + ?, updated_at = ?
+		WHERE id = ? AND total_points + ? >= 0
+	`, p.Points, time.Now(), p.UserID, p.Points)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNegativeBalance
+	}
+
+	return postJournalTx(tx, p.Kind, p.Reference, p.ReferenceID, p.Memo,
+		ledgerLine{AccountID: wallet, Amount: p.Points}, ledgerLine{AccountID: account, Amount: -p.Points})
+}
+
+// openLedgerWallets opens the system accounts, and a wallet for every user
+// with a balance from before the ledger, so reconciliation has something to
+// compare against
+func openLedgerWallets() {
+	for _, code := range systemAccounts {
+		if _, err := database.DB.Exec("INSERT OR IGNORE INTO ledger_accounts (code) VALUES (?)", code); err != nil {
+			log.Printf("openLedgerWallets: failed to open account %s: %v", code, err)
+		}
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id FROM users u
+		WHERE total_points != 0
+			AND NOT EXISTS (SELECT 1 FROM ledger_accounts a WHERE a.user_id = u.id)
+	`)
+	if err != nil {
+		log.Printf("openLedgerWallets: failed to find users: %v", err)
+		return
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			userIDs = append(userIDs, id)
+		}
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		tx, err := database.DB.Begin()
+		if err != nil {
+			log.Printf("openLedgerWallets: %v", err)
+			return
+		}
+		if _, err = walletAccountTx(tx, userID); err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			log.Printf("openLedgerWallets: failed to open wallet for user %d: %v", userID, err)
+		}
+	}
+	if len(userIDs) > 0 {
+		log.Printf("Opened ledger wallets for %d users", len(userIDs))
+	}
+}
+
+// reconcileLedger compares every user's cached balance with their wallet and
+// checks that each journal balances. The result is stored and returned.
+func reconcileLedger() (database.LedgerReconciliation, error) {
+	report := database.LedgerReconciliation{
+		RunAt:              time.Now().UTC(),
+		Drifts:             []database.LedgerDrift{},
+		UnbalancedJournals: []int{},
+		MissingAccounts:    []string{},
+	}
+
+	for _, code := range systemAccounts {
+		var exists int
+		database.DB.QueryRow("SELECT COUNT(*) FROM ledger_accounts WHERE code = ?", code).Scan(&exists)
+		if exists == 0 {
+			report.MissingAccounts = append(report.MissingAccounts, code)
+		}
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.total_points, COALESCE(SUM(e.amount), 0)
+		FROM users u
+		LEFT JOIN ledger_accounts a ON a.user_id = u.id
+		LEFT JOIN ledger_entries e ON e.account_id = a.id
+		GROUP BY u.id
+		ORDER BY u.id
+	`)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var drift database.LedgerDrift
+		if err := rows.Scan(&drift.UserID, &drift.CachedBalance, &drift.LedgerBalance); err != nil {
+			continue
+		}
+		report.UsersChecked++
+		if drift.CachedBalance != drift.LedgerBalance {
+			drift.Drift = drift.CachedBalance - drift.LedgerBalance
+			report.Drifts = append(report.Drifts, drift)
+		}
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT journal_id FROM ledger_entries GROUP BY journal_id HAVING SUM(amount) != 0 ORDER BY journal_id
+	`)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var journalID int
+		if rows.Scan(&journalID) == nil {
+			report.UnbalancedJournals = append(report.UnbalancedJournals, journalID)
+		}
+	}
+	rows.Close()
+
+	drifts, _ := json.Marshal(report.Drifts)
+	unbalanced, _ := json.Marshal(report.UnbalancedJournals)
+	missing, _ := json.Marshal(report.MissingAccounts)
+	result, err := database.DB.Exec(`
+		INSERT INTO ledger_reconciliations (run_at, users_checked, drifts, unbalanced_journals, missing_accounts)
+		VALUES (?, ?, ?, ?, ?)
+	`, report.RunAt, report.UsersChecked, string(drifts), string(unbalanced), string(missing))
+	if err != nil {
+		return report, err
+	}
+	id, _ := result.LastInsertId()
+	report.ID = int(id)
+	return report, nil
+}
+
+// checkLedgerDrift is the periodic reconciliation job
+func checkLedgerDrift() {
+	report, err := reconcileLedger()
+	if err != nil {
+		log.Printf("checkLedgerDrift: %v", err)
+		return
+	}
+	for _, drift := range report.Drifts {
+		log.Printf("Ledger drift: user=%d, total_points=%d, ledger=%d", drift.UserID, drift.CachedBalance, drift.LedgerBalance)
+	}
+	if len(report.UnbalancedJournals) > 0 {
+		log.Printf("Ledger has unbalanced journals: %v", report.UnbalancedJournals)
+	}
+	if len(report.MissingAccounts) > 0 {
+		log.Printf("Ledger is missing system accounts: %v", report.MissingAccounts)
+	}
+}
+
+// getLedgerAccounts returns the balance of each system account and the total
+// held in user wallets. All balances add up to zero.
+func getLedgerAccounts(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(`
+		SELECT a.code, COALESCE(SUM(e.amount), 0)
+		FROM ledger_accounts a
+		LEFT JOIN ledger_entries e ON e.account_id = a.id
+		WHERE a.user_id IS NULL
+		GROUP BY a.id
+		ORDER BY a.id
+	`)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve ledger accounts",
+		})
+		return
+	}
+	defer rows.Close()
+
+	accounts := map[string]int{}
+	for rows.Next() {
+		var code string
+		var balance int
+		if rows.Scan(&code, &balance) == nil {
+			accounts[code] = balance
+		}
+	}
+
+	var wallets, walletTotal int
+	database.DB.QueryRow(`
+		SELECT COUNT(DISTINCT a.id), COALESCE(SUM(e.amount), 0)
+		FROM ledger_accounts a
+		LEFT JOIN ledger_entries e ON e.account_id = a.id
+		WHERE a.user_id IS NOT NULL
+	`).Scan(&wallets, &walletTotal)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"accounts":     accounts,
+			"wallets":      wallets,
+			"wallet_total": walletTotal,
+		},
+	})
+}
+
+// getUserLedger lists the entries of a user's wallet, newest first
+func getUserLedger(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid user ID",
+		})
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT e.id, e.journal_id, a.code, e.amount, j.kind, COALESCE(j.reference_type, ''), j.reference_id,
+			COALESCE(j.memo, ''), j.created_at
+		FROM ledger_entries e
+		JOIN ledger_accounts a ON a.id = e.account_id
+		JOIN ledger_journals j ON j.id = e.journal_id
+		WHERE a.user_id = ?
+		ORDER BY e.id DESC
+		LIMIT 200
+	`, userID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve ledger",
+		})
+		return
+	}
+	defer rows.Close()
+
+	entries := []database.LedgerEntry{}
+	for rows.Next() {
+		var entry database.LedgerEntry
+		var referenceID sql.NullInt64
+		err := rows.Scan(&entry.ID, &entry.JournalID, &entry.Account, &entry.Amount, &entry.Kind,
+			&entry.Reference, &referenceID, &entry.Memo, &entry.CreatedAt)
+		if err != nil {
+			continue
+		}
+		if referenceID.Valid {
+			id := int(referenceID.Int64)
+			entry.ReferenceID = &id
+		}
+		entries = append(entries, entry)
+	}
+
+	var cached, balance int
+	database.DB.QueryRow("SELECT total_points FROM users WHERE id = ?", userID).Scan(&cached)
+	database.DB.QueryRow(`
+		SELECT COALESCE(SUM(e.amount), 0) FROM ledger_entries e
+		JOIN ledger_accounts a ON a.id = e.account_id
+		WHERE a.user_id = ?
+	`, userID).Scan(&balance)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"user_id":        userID,
+			"balance":        balance,
+			"cached_balance": cached,
+			"entries":        entries,
+		},
+	})
+}
+
+// runLedgerReconciliation reconciles the ledger now
+func runLedgerReconciliation(w http.ResponseWriter, r *http.Request) {
+	report, err := reconcileLedger()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to reconcile ledger",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    report,
+	})
+}
+
+// listLedgerReconciliations lists the most recent reconciliation runs
+func listLedgerReconciliations(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(`
+		SELECT id, run_at, users_checked, drifts, unbalanced_journals, missing_accounts
+		FROM ledger_reconciliations
+		ORDER BY id DESC
+		LIMIT 50
+	`)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve reconciliations",
+		})
+		return
+	}
+	defer rows.Close()
+
+	reports := []database.LedgerReconciliation{}
+	for rows.Next() {
+		var report database.LedgerReconciliation
+		var drifts, unbalanced, missing string
+		if err := rows.Scan(&report.ID, &report.RunAt, &report.UsersChecked, &drifts, &unbalanced, &missing); err != nil {
+			continue
+		}
+		json.Unmarshal([]byte(drifts), &report.Drifts)
+		json.Unmarshal([]byte(unbalanced), &report.UnbalancedJournals)
+		json.Unmarshal([]byte(missing), &report.MissingAccounts)
+		reports = append(reports, report)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    reports,
+	})
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"testing"
+
+	"t2cbackend/database"
+)
+
+// walletBalance returns a user's wallet balance and cached total_points
+func walletBalance(t *testing.T, userID int) (int, int) {
+	t.Helper()
+	var balance, cached int
+	database.DB.QueryRow(`
+		SELECT COALESCE(SUM(e.amount), 0) FROM ledger_entries e
+		JOIN ledger_accounts a ON a.id = e.account_id
+		WHERE a.user_id = ?
+	`, userID).Scan(&balance)
+	database.DB.QueryRow("SELECT total_points FROM users WHERE id = ?", userID).Scan(&cached)
+	return balance, cached
+}
+
+// postPoints posts p in its own transaction
+func postPoints(t *testing.T, p ledgerPosting) error {
+	t.Helper()
+	tx, err := database.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := postPointsTx(tx, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func TestPostPointsTx(t *testing.T) {
+	openTestDB(t)
+
+	// The demo user has 2500 points from before the ledger
+	err := postPoints(t, ledgerPosting{UserID: 2, Points: 15, Account: accountIssuance, Kind: journalDeposit})
+	if err != nil {
+		t.Fatalf("postPointsTx() error = %v", err)
+	}
+	err = postPoints(t, ledgerPosting{UserID: 2, Points: -500, Account: accountRedemption, Kind: journalRedemption})
+	if err != nil {
+		t.Fatalf("postPointsTx() error = %v", err)
+	}
+	if balance, cached := walletBalance(t, 2); balance != 2015 || cached != 2015 {
+		t.Errorf("wallet = %d, total_points = %d, want 2015", balance, cached)
+	}
+
+	err = postPoints(t, ledgerPosting{UserID: 2, Points: -2016, Account: accountRedemption, Kind: journalRedemption})
+	if err != errNegativeBalance {
+		t.Errorf("postPointsTx() error = %v, want %v", err, errNegativeBalance)
+	}
+	if balance, cached := walletBalance(t, 2); balance != 2015 || cached != 2015 {
+		t.Errorf("after a refused deduction wallet = %d, total_points = %d, want 2015", balance, cached)
+	}
+
+	// The wallet and the system accounts add up to zero
+	var total, journals int
+	database.DB.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM ledger_entries").Scan(&total)
+	if total != 0 {
+		t.Errorf("ledger entries add up to %d, want 0", total)
+	}
+	database.DB.QueryRow("SELECT COUNT(*) FROM ledger_journals WHERE kind = ?", journalOpening).Scan(&journals)
+	if journals != 1 {
+		t.Errorf("%d opening journals, want 1", journals)
+	}
+}
+
+func TestPostJournalTxUnbalanced(t *testing.T) {
+	openTestDB(t)
+	tx, err := database.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	wallet, err := walletAccountTx(tx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuance, err := accountIDTx(tx, accountIssuance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = postJournalTx(tx, journalAdjustment, "", 0, "",
+		ledgerLine{AccountID: wallet, Amount: 10}, ledgerLine{AccountID: issuance, Amount: -9})
+	if err != errUnbalancedJournal {
+		t.Errorf("postJournalTx() error = %v, want %v", err, errUnbalancedJournal)
+	}
+	err = postJournalTx(tx, journalAdjustment, "", 0, "", ledgerLine{AccountID: wallet, Amount: 0})
+	if err != errUnbalancedJournal {
+		t.Errorf("postJournalTx() with one line error = %v, want %v", err, errUnbalancedJournal)
+	}
+}
+
+func TestReconcileLedgerDrift(t *testing.T) {
+	openTestDB(t)
+	// As at startup, so the seeded users' balances are in the ledger
+	openLedgerWallets()
+	if err := postPoints(t, ledgerPosting{UserID: 2, Points: 15, Account: accountIssuance, Kind: journalDeposit}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := reconcileLedger()
+	if err != nil {
+		t.Fatalf("reconcileLedger() error = %v", err)
+	}
+	if len(report.Drifts) != 0 || len(report.UnbalancedJournals) != 0 || len(report.MissingAccounts) != 0 {
+		t.Fatalf("reconcileLedger() = %+v, want no drift", report)
+	}
+
+	// A balance changed outside the ledger
+	database.DB.Exec("UPDATE users SET total_points = total_points + 7 WHERE id = 2")
+	report, err = reconcileLedger()
+	if err != nil {
+		t.Fatalf("reconcileLedger() error = %v", err)
+	}
+	if len(report.Drifts) != 1 {
+		t.Fatalf("reconcileLedger() drifts = %+v, want 1", report.Drifts)
+	}
+	drift := report.Drifts[0]
+	if drift.UserID != 2 || drift.CachedBalance != 2522 || drift.LedgerBalance != 2515 || drift.Drift != 7 {
+		t.Errorf("reconcileLedger() drift = %+v, want user 2 at 2522 against 2515", drift)
+	}
+
+	var runs int
+	database.DB.QueryRow("SELECT COUNT(*) FROM ledger_reconciliations").Scan(&runs)
+	if runs != 2 {
+		t.Errorf("%d reconciliations stored, want 2", runs)
+	}
+}
+
+func TestLedgerSystemAccounts(t *testing.T) {
+	openTestDB(t)
+	for _, code := range systemAccounts {
+		var exists int
+		database.DB.QueryRow("SELECT COUNT(*) FROM ledger_accounts WHERE code = ? AND user_id IS NULL", code).Scan(&exists)
+		if exists != 1 {
+			t.Errorf("system account %s exists %d times, want 1", code, exists)
+		}
+	}
+
+	// A missing account is reported, and opened again at startup
+	database.DB.Exec("DELETE FROM ledger_accounts WHERE code = ?", accountExpiry)
+	report, err := reconcileLedger()
+	if err != nil {
+		t.Fatalf("reconcileLedger() error = %v", err)
+	}
+	if len(report.MissingAccounts) != 1 || report.MissingAccounts[0] != accountExpiry {
+		t.Errorf("reconcileLedger() missing accounts = %v, want [%s]", report.MissingAccounts, accountExpiry)
+	}
+
+	openLedgerWallets()
+	report, err = reconcileLedger()
+	if err != nil {
+		t.Fatalf("reconcileLedger() error = %v", err)
+	}
+	if len(report.MissingAccounts) != 0 {
+		t.Errorf("after openLedgerWallets() missing accounts = %v, want none", report.MissingAccounts)
+	}
+}
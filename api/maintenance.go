@@ -0,0 +1,1059 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Reliability report window, in days
+const (
+	defaultReliabilityDays = 90
+	maxReliabilityDays     = 365
+)
+
+// ticketTransitions lists the statuses a ticket may move to from each status.
+// Tickets move from open to assigned by being assigned, not through this map.
+var ticketTransitions = map[string][]string{
+	"open":        {"cancelled"},
+	"assigned":    {"in_progress", "cancelled"},
+	"in_progress": {"on_hold", "closed", "cancelled"},
+	"on_hold":     {"in_progress", "cancelled"},
+}
+
+var ticketPriorities = map[string]bool{"low": true, "normal": true, "high": true, "urgent": true}
+
+var errTicketNotFound = errors.New("ticket not found")
+
+// ticketColumns lists the columns scanned by scanTicket
+const ticketColumns = `id, station_id, title, COALESCE(description, ''), kind, source, COALESCE(fault_code, ''),
+	priority, status, assigned_to, opened_by, COALESCE(resolution, ''), opened_at, closed_at, updated_at`
+
+// TicketRequest represents a request to open a maintenance ticket
+type TicketRequest struct {
+	StationID   int    `json:"station_id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Kind        string `json:"kind"`     // fault/service, default fault
+	Priority    string `json:"priority"` // default normal
+}
+
+// AssignTicketRequest represents assigning a ticket to a technician
+type AssignTicketRequest struct {
+	TechnicianID int `json:"technician_id"`
+}
+
+// TicketStatusRequest represents a ticket status change
+type TicketStatusRequest struct {
+	Status     string `json:"status"`
+	Resolution string `json:"resolution"` // required when closing
+	Note       string `json:"note"`
+}
+
+// TicketNoteRequest represents a note added to a ticket
+type TicketNoteRequest struct {
+	Note string `json:"note"`
+}
+
+// TicketPartRequest represents a part used on a ticket
+type TicketPartRequest struct {
+	PartName   string `json:"part_name"`
+	PartNumber string `json:"part_number"`
+	Quantity   int    `json:"quantity"`
+}
+
+// scanTicket scans a row selected with ticketColumns
+func scanTicket(row rowScanner) (database.MaintenanceTicket, error) {
+	var ticket database.MaintenanceTicket
+	var assignedTo, openedBy sql.NullInt64
+	var closedAt sql.NullTime
+	err := row.Scan(&ticket.ID, &ticket.StationID, &ticket.Title, &ticket.Description, &ticket.Kind,
+		&ticket.Source, &ticket.FaultCode, &ticket.Priority, &ticket.Status, &assignedTo, &openedBy,
+		&ticket.Resolution, &ticket.OpenedAt, &closedAt, &ticket.UpdatedAt)
+	if assignedTo.Valid {
+		id := int(assignedTo.Int64)
+		ticket.AssignedTo = &id
+	}
+	if openedBy.Valid {
+		id := int(openedBy.Int64)
+		ticket.OpenedBy = &id
+	}
+	if closedAt.Valid {
+		ticket.ClosedAt = &closedAt.Time
+	}
+	return ticket, err
+}
+
+// loadTicket retrieves a ticket by ID
+func loadTicket(id int) (database.MaintenanceTicket, error) {
+	ticket, err := scanTicket(database.DB.QueryRow(
+		"SELECT "+ticketColumns+" FROM maintenance_tickets WHERE id = ?", id,
+	))
+	if err != nil {
+		return ticket, errTicketNotFound
+	}
+	return ticket, nil
+}
+
+// ticketIsDone reports whether a ticket has reached a final status
+func ticketIsDone(ticket database.MaintenanceTicket) bool {
+	return ticket.Status == "closed" || ticket.Status == "cancelled"
+}
+
+// loadTicketForUpdate retrieves a ticket from the URL that the current user
+// may work on. Technicians may only update tickets assigned to them.
+func loadTicketForUpdate(w http.ResponseWriter, r *http.Request) (database.MaintenanceTicket, int, bool) {
+	userID, _ := getUserIDFromHeader(r)
+
+	ticketID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid ticket ID",
+		})
+		return database.MaintenanceTicket{}, 0, false
+	}
+
+	ticket, err := loadTicket(ticketID)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Ticket not found",
+		})
+		return ticket, 0, false
+	}
+
+	if userRole(userID) != "admin" && (ticket.AssignedTo == nil || *ticket.AssignedTo != userID) {
+		respondJSON(w, http.StatusForbidden, Response{
+			Success: false,
+			Error:   "Ticket is not assigned to you",
+		})
+		return ticket, 0, false
+	}
+
+	return ticket, userID, true
+}
+
+// addTicketNoteTx records a note on a ticket and bumps its updated_at
+func addTicketNoteTx(tx *sql.Tx, ticketID int, userID *int, note string, at time.Time) error {
+	_, err := tx.Exec(
+		"INSERT INTO ticket_notes (ticket_id, user_id, note, created_at) VALUES (?, ?, ?, ?)",
+		ticketID, userID, note, at,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE maintenance_tickets SET updated_at = ? WHERE id = ?", at, ticketID)
+	return err
+}
+
+// openTicket inserts a ticket and returns its ID
+func openTicket(ticket database.MaintenanceTicket) (int, error) {
+	now := time.Now().UTC()
+	result, err := database.DB.Exec(`
+		INSERT INTO maintenance_tickets
+			(station_id, title, description, kind, source, fault_code, priority, status, opened_by, opened_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 'open', ?, ?, ?)
+	`, ticket.StationID, ticket.Title, ticket.Description, ticket.Kind, ticket.Source,
+		ticket.FaultCode, ticket.Priority, ticket.OpenedBy, now, now)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// openFaultTickets opens a ticket for each fault code a station reports,
+// unless one is already being worked on for the same code
+func openFaultTickets(stationID int, errorCodes []string) {
+	for _, code := range errorCodes {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+
+		var open int
+		database.DB.QueryRow(`
+			SELECT COUNT(*) FROM maintenance_tickets
+			WHERE station_id = ? AND fault_code = ? AND status NOT IN ('closed', 'cancelled')
+		`, stationID, code).Scan(&open)
+		if open > 0 {
+			continue
+		}
+
+		title := fmt.Sprintf("Fault %s reported by station", code)
+		ticketID, err := openTicket(database.MaintenanceTicket{
+			StationID:   stationID,
+			Title:       title,
+			Description: "Opened automatically from station telemetry",
+			Kind:        "fault",
+			Source:      "telemetry",
+			FaultCode:   code,
+			Priority:    "high",
+		})
+		if err != nil {
+			log.Printf("openFaultTickets: failed to open ticket for station %d: %v", stationID, err)
+			continue
+		}
+
+		log.Printf("Maintenance ticket %d opened for station %d: fault %s", ticketID, stationID, code)
+		raiseAlert(stationID, "maintenance_ticket", fmt.Sprintf("Ticket %d: %s", ticketID, title))
+	}
+}
+
+// createTicket opens a maintenance ticket
+func createTicket(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	var req TicketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Title is required",
+		})
+		return
+	}
+
+	if req.Kind == "" {
+		req.Kind = "fault"
+	}
+	if req.Kind != "fault" && req.Kind != "service" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Kind must be fault or service",
+		})
+		return
+	}
+
+	if req.Priority == "" {
+		req.Priority = "normal"
+	}
+	if !ticketPriorities[req.Priority] {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Priority must be low, normal, high or urgent",
+		})
+		return
+	}
+
+	if _, err := loadStation(req.StationID); err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	ticketID, err := openTicket(database.MaintenanceTicket{
+		StationID:   req.StationID,
+		Title:       req.Title,
+		Description: req.Description,
+		Kind:        req.Kind,
+		Source:      "manual",
+		Priority:    req.Priority,
+		OpenedBy:    &userID,
+	})
+	if err != nil {
+		log.Printf("createTicket: failed to insert ticket: %v", err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create ticket",
+		})
+		return
+	}
+
+	ticket, _ := loadTicket(ticketID)
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Ticket created",
+		Data:    ticket,
+	})
+}
+
+// listTickets lists maintenance tickets, newest first. Filters: status,
+// station_id and assigned_to ("me" for the current user).
+func listTickets(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	query := "SELECT " + ticketColumns + " FROM maintenance_tickets WHERE 1 = 1"
+	var args []interface{}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if station := r.URL.Query().Get("station_id"); station != "" {
+		stationID, err := strconv.Atoi(station)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Invalid station ID",
+			})
+			return
+		}
+		query += " AND station_id = ?"
+		args = append(args, stationID)
+	}
+	if assigned := r.URL.Query().Get("assigned_to"); assigned != "" {
+		assignee := userID
+		if assigned != "me" {
+			parsed, err := strconv.Atoi(assigned)
+			if err != nil {
+				respondJSON(w, http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "Invalid assigned_to",
+				})
+				return
+			}
+			assignee = parsed
+		}
+		query += " AND assigned_to = ?"
+		args = append(args, assignee)
+	}
+	query += " ORDER BY opened_at DESC, id DESC LIMIT 200"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve tickets",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var tickets []database.MaintenanceTicket
+	for rows.Next() {
+		ticket, err := scanTicket(rows)
+		if err != nil {
+			continue
+		}
+		tickets = append(tickets, ticket)
+	}
+
+	if tickets == nil {
+		tickets = []database.MaintenanceTicket{}
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    tickets,
+	})
+}
+
+// loadTicketDetails attaches a ticket's notes and parts
+func loadTicketDetails(ticket *database.MaintenanceTicket) error {
+	ticket.Notes = []database.TicketNote{}
+	ticket.Parts = []database.TicketPart{}
+
+	rows, err := database.DB.Query(`
+		SELECT id, ticket_id, user_id, note, created_at
+		FROM ticket_notes WHERE ticket_id = ? ORDER BY created_at, id
+	`, ticket.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var note database.TicketNote
+		var noteUser sql.NullInt64
+		if err := rows.Scan(&note.ID, &note.TicketID, &noteUser, &note.Note, &note.CreatedAt); err != nil {
+			continue
+		}
+		if noteUser.Valid {
+			id := int(noteUser.Int64)
+			note.UserID = &id
+		}
+		ticket.Notes = append(ticket.Notes, note)
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT id, ticket_id, part_name, COALESCE(part_number, ''), quantity, added_by, created_at
+		FROM ticket_parts WHERE ticket_id = ? ORDER BY created_at, id
+	`, ticket.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var part database.TicketPart
+		err := rows.Scan(&part.ID, &part.TicketID, &part.PartName, &part.PartNumber,
+			&part.Quantity, &part.AddedBy, &part.CreatedAt)
+		if err != nil {
+			continue
+		}
+		ticket.Parts = append(ticket.Parts, part)
+	}
+	return rows.Err()
+}
+
+// getTicket retrieves a ticket with its notes and parts
+func getTicket(w http.ResponseWriter, r *http.Request) {
+	ticketID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid ticket ID",
+		})
+		return
+	}
+
+	ticket, err := loadTicket(ticketID)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Ticket not found",
+		})
+		return
+	}
+
+	if err := loadTicketDetails(&ticket); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve ticket",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    ticket,
+	})
+}
+
+// assignTicket assigns a ticket to a technician
+func assignTicket(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	ticketID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid ticket ID",
+		})
+		return
+	}
+
+	var req AssignTicketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	var name, role string
+	err = database.DB.QueryRow(
+		"SELECT name, COALESCE(role, 'user') FROM users WHERE id = ?",
+		req.TechnicianID,
+	).Scan(&name, &role)
+	if err != nil || role != "technician" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Technician not found",
+		})
+		return
+	}
+
+	ticket, err := loadTicket(ticketID)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Ticket not found",
+		})
+		return
+	}
+	if ticketIsDone(ticket) {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Ticket is already " + ticket.Status,
+		})
+		return
+	}
+
+	// Reassigning keeps the ticket's progress; a new ticket becomes assigned
+	status := ticket.Status
+	if status == "open" {
+		status = "assigned"
+	}
+
+	now := time.Now().UTC()
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to assign ticket",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE maintenance_tickets SET assigned_to = ?, status = ? WHERE id = ?",
+		req.TechnicianID, status, ticketID,
+	)
+	if err == nil {
+		err = addTicketNoteTx(tx, ticketID, &userID, "Assigned to "+name, now)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("assignTicket: failed to assign ticket %d: %v", ticketID, err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to assign ticket",
+		})
+		return
+	}
+
+	ticket, _ = loadTicket(ticketID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Ticket assigned",
+		Data:    ticket,
+	})
+}
+
+// updateTicketStatus moves a ticket through its workflow. Closing a ticket
+// records the station as serviced.
+func updateTicketStatus(w http.ResponseWriter, r *http.Request) {
+	ticket, userID, ok := loadTicketForUpdate(w, r)
+	if !ok {
+		return
+	}
+
+	var req TicketStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	allowed := false
+	for _, next := range ticketTransitions[ticket.Status] {
+		if next == req.Status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   fmt.Sprintf("Cannot move ticket from %s to %s", ticket.Status, req.Status),
+		})
+		return
+	}
+
+	req.Resolution = strings.TrimSpace(req.Resolution)
+	if req.Status == "closed" && req.Resolution == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Resolution is required to close a ticket",
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update ticket",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// The status condition guards against two updates racing
+	var result sql.Result
+	if req.Status == "closed" || req.Status == "cancelled" {
+		result, err = tx.Exec(`
+			UPDATE maintenance_tickets SET status = ?, resolution = ?, closed_at = ?
+			WHERE id = ? AND status = ?
+		`, req.Status, req.Resolution, now, ticket.ID, ticket.Status)
+	} else {
+		result, err = tx.Exec(
+			"UPDATE maintenance_tickets SET status = ? WHERE id = ? AND status = ?",
+			req.Status, ticket.ID, ticket.Status,
+		)
+	}
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondJSON(w, http.StatusConflict, Response{
+				Success: false,
+				Error:   "Ticket was updated by someone else",
+			})
+			return
+		}
+	}
+
+	if err == nil {
+		note := fmt.Sprintf("Status changed from %s to %s", ticket.Status, req.Status)
+		if req.Resolution != "" {
+			note += ": " + req.Resolution
+		}
+		err = addTicketNoteTx(tx, ticket.ID, &userID, note, now)
+	}
+	if err == nil && strings.TrimSpace(req.Note) != "" {
+		err = addTicketNoteTx(tx, ticket.ID, &userID, strings.TrimSpace(req.Note), now)
+	}
+	if err == nil && req.Status == "closed" {
+		_, err = tx.Exec("UPDATE stations SET last_maintenance = ? WHERE id = ?", now, ticket.StationID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("updateTicketStatus: failed to update ticket %d: %v", ticket.ID, err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update ticket",
+		})
+		return
+	}
+
+	log.Printf("Ticket %d moved from %s to %s by user %d", ticket.ID, ticket.Status, req.Status, userID)
+
+	ticket, _ = loadTicket(ticket.ID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Ticket updated",
+		Data:    ticket,
+	})
+}
+
+// addTicketNote adds a note to a ticket
+func addTicketNote(w http.ResponseWriter, r *http.Request) {
+	ticket, userID, ok := loadTicketForUpdate(w, r)
+	if !ok {
+		return
+	}
+
+	var req TicketNoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Note) == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Note is required",
+		})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		err = addTicketNoteTx(tx, ticket.ID, &userID, strings.TrimSpace(req.Note), time.Now().UTC())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to add note",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Note added",
+	})
+}
+
+// addTicketPart records a part used on a ticket
+func addTicketPart(w http.ResponseWriter, r *http.Request) {
+	ticket, userID, ok := loadTicketForUpdate(w, r)
+	if !ok {
+		return
+	}
+
+	if ticketIsDone(ticket) {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Ticket is already " + ticket.Status,
+		})
+		return
+	}
+
+	var req TicketPartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	req.PartName = strings.TrimSpace(req.PartName)
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.PartName == "" || req.Quantity < 0 {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Part name and a positive quantity are required",
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to add part",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO ticket_parts (ticket_id, part_name, part_number, quantity, added_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, ticket.ID, req.PartName, req.PartNumber, req.Quantity, userID, now)
+	if err == nil {
+		_, err = tx.Exec("UPDATE maintenance_tickets SET updated_at = ? WHERE id = ?", now, ticket.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to add part",
+		})
+		return
+	}
+
+	partID, _ := result.LastInsertId()
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Part added",
+		Data: database.TicketPart{
+			ID:         int(partID),
+			TicketID:   ticket.ID,
+			PartName:   req.PartName,
+			PartNumber: req.PartNumber,
+			Quantity:   req.Quantity,
+			AddedBy:    userID,
+			CreatedAt:  now,
+		},
+	})
+}
+
+// stationReliability summarizes a station's faults over a window ending now.
+// MTBF is uptime divided by the number of faults; downtime is the time fault
+// tickets were open within the window.
+func stationReliability(stationID int, windowStart, now time.Time) (map[string]interface{}, error) {
+	rows, err := database.DB.Query(`
+		SELECT opened_at, closed_at FROM maintenance_tickets
+		WHERE station_id = ? AND kind = 'fault' AND status != 'cancelled'
+			AND (closed_at IS NULL OR closed_at >= ?)
+	`, stationID, windowStart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures, repaired int
+	var downtime, repairTime time.Duration
+	for rows.Next() {
+		var openedAt time.Time
+		var closedAt sql.NullTime
+		if err := rows.Scan(&openedAt, &closedAt); err != nil {
+			continue
+		}
+
+		end := now
+		if closedAt.Valid {
+			end = closedAt.Time
+			repaired++
+			repairTime += closedAt.Time.Sub(openedAt)
+		}
+		start := openedAt
+		if start.Before(windowStart) {
+			start = windowStart
+		} else {
+			// Faults opened before the window were counted in an earlier one
+			failures++
+		}
+		if end.After(start) {
+			downtime += end.Sub(start)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	window := now.Sub(windowStart)
+	if downtime > window {
+		downtime = window // overlapping faults
+	}
+	uptime := window - downtime
+
+	hours := func(d time.Duration) float64 { return math.Round(d.Hours()*10) / 10 }
+
+	report := map[string]interface{}{
+		"station_id":     stationID,
+		"failures":       failures,
+		"uptime_hours":   hours(uptime),
+		"downtime_hours": hours(downtime),
+		"availability":   math.Round(float64(uptime)/float64(window)*10000) / 100,
+		"mtbf_hours":     nil,
+		"mttr_hours":     nil,
+	}
+	if failures > 0 {
+		report["mtbf_hours"] = hours(uptime / time.Duration(failures))
+	}
+	if repaired > 0 {
+		report["mttr_hours"] = hours(repairTime / time.Duration(repaired))
+	}
+	return report, nil
+}
+
+// reliabilityWindow reads the days query parameter
+func reliabilityWindow(r *http.Request) (int, error) {
+	days := defaultReliabilityDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxReliabilityDays {
+			return 0, fmt.Errorf("days must be between 1 and %d", maxReliabilityDays)
+		}
+		days = parsed
+	}
+	return days, nil
+}
+
+// getStationServiceHistory lists a station's finished tickets, newest first,
+// with its reliability over the requested window
+func getStationServiceHistory(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	station, err := loadStation(stationID)
+	if err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	days, err := reliabilityWindow(r)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT `+ticketColumns+` FROM maintenance_tickets
+		WHERE station_id = ? AND status IN ('closed', 'cancelled')
+		ORDER BY closed_at DESC, id DESC
+		LIMIT 100
+	`, stationID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve service history",
+		})
+		return
+	}
+
+	var tickets []database.MaintenanceTicket
+	for rows.Next() {
+		ticket, err := scanTicket(rows)
+		if err != nil {
+			continue
+		}
+		tickets = append(tickets, ticket)
+	}
+	rows.Close()
+
+	for i := range tickets {
+		loadTicketDetails(&tickets[i])
+	}
+	if tickets == nil {
+		tickets = []database.MaintenanceTicket{}
+	}
+
+	now := time.Now().UTC()
+	reliability, err := stationReliability(stationID, now.AddDate(0, 0, -days), now)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to calculate reliability",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"station_id":       stationID,
+			"last_maintenance": station.LastMaintenance,
+			"window_days":      days,
+			"reliability":      reliability,
+			"tickets":          tickets,
+		},
+	})
+}
+
+// emptyStationBins records that a technician emptied all of a station's bins,
+// which resets their fill levels. Closing a ticket does not.
+func emptyStationBins(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	if _, err := loadStation(stationID); err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	_, err = database.DB.Exec("UPDATE stations SET bins_emptied_at = ? WHERE id = ?", now, stationID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to record emptied bins",
+		})
+		return
+	}
+
+	log.Printf("Bins at station %d emptied by user %d", stationID, userID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Bins emptied",
+		Data: map[string]interface{}{
+			"station_id":      stationID,
+			"bins_emptied_at": now,
+		},
+	})
+}
+
+// getReliabilityReport reports MTBF and MTTR for every station that is not disabled
+func getReliabilityReport(w http.ResponseWriter, r *http.Request) {
+	days, err := reliabilityWindow(r)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	rows, err := database.DB.Query("SELECT id FROM stations WHERE status != 'disabled' ORDER BY id")
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve stations",
+		})
+		return
+	}
+	var stationIDs []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			stationIDs = append(stationIDs, id)
+		}
+	}
+	rows.Close()
+
+	now := time.Now().UTC()
+	windowStart := now.AddDate(0, 0, -days)
+	reports := make([]map[string]interface{}, 0, len(stationIDs))
+	for _, stationID := range stationIDs {
+		report, err := stationReliability(stationID, windowStart, now)
+		if err != nil {
+			log.Printf("getReliabilityReport: failed for station %d: %v", stationID, err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"window_days": days,
+			"stations":    reports,
+		},
+	})
+}
+
+// listTechnicians lists technicians with their count of unfinished tickets
+func listTechnicians(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.name, COALESCE(u.email, ''), COALESCE(u.phone, ''),
+			(SELECT COUNT(*) FROM maintenance_tickets t
+			 WHERE t.assigned_to = u.id AND t.status NOT IN ('closed', 'cancelled'))
+		FROM users u
+		WHERE u.role = 'technician'
+		ORDER BY u.name
+	`)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve technicians",
+		})
+		return
+	}
+	defer rows.Close()
+
+	technicians := []map[string]interface{}{}
+	for rows.Next() {
+		var id, openTickets int
+		var name, email, phone string
+		if err := rows.Scan(&id, &name, &email, &phone, &openTickets); err != nil {
+			continue
+		}
+		technicians = append(technicians, map[string]interface{}{
+			"id":           id,
+			"name":         name,
+			"email":        email,
+			"phone":        phone,
+			"open_tickets": openTickets,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    technicians,
+	})
+}
@@ -0,0 +1,555 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// materialCodePattern restricts material codes to short lowercase identifiers
+var materialCodePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,31}$`)
+
+// Units a material can be measured in. Weighed materials are priced per kg;
+// counted materials such as bottles and cans are priced per item.
+const (
+	unitKg   = "kg"
+	unitItem = "item"
+)
+
+// materialUnits lists the units deposits can be measured in
+var materialUnits = map[string]bool{unitKg: true, unitItem: true}
+
+// maxContainerSizeML is the largest container size a deposit can report
+const maxContainerSizeML = 10000
+
+// depositAmount is what a station measured for a deposit: a weight for
+// weighed materials, or an item count and optional container size for
+// counted materials. Counted deposits may also report their weight.
+type depositAmount struct {
+	Weight          database.Grams // as reported by the scale
+	Count           int
+	ContainerSizeML int
+}
+
+// counted reports whether a material is priced per item
+func counted(code string) bool {
+	material, found := lookupMaterial(code)
+	return found && material.Unit == unitItem
+}
+
+// quantity returns the amount a deposit is priced and limited on, in the
+// material's unit
+func (a depositAmount) quantity(code string) float64 {
+	if counted(code) {
+		return float64(a.Count)
+	}
+	return a.Weight.Kg()
+}
+
+// countColumns returns the item_count and container_size_ml values stored
+// for a deposit, which are NULL for weighed materials
+func (a depositAmount) countColumns(code string) (interface{}, interface{}) {
+	if !counted(code) {
+		return nil, nil
+	}
+	if a.ContainerSizeML == 0 {
+		return a.Count, nil
+	}
+	return a.Count, a.ContainerSizeML
+}
+
+// depositWeight returns the weight recorded for a deposit: the calibrated
+// scale reading or, for a counted deposit the station did not weigh, the
+// count times the expected weight of one item. A catalogued product's
+// expected weight is used before the material's.
+func depositWeight(stationID int, code string, amount depositAmount, product productMatch, at time.Time) database.Grams {
+	if amount.Weight > 0 || !counted(code) {
+		return correctWeight(stationID, amount.Weight, at)
+	}
+	itemWeight := product.ItemWeight
+	if itemWeight == 0 {
+		material, _ := lookupMaterial(code)
+		itemWeight = database.Grams(math.Round(material.ItemWeightKg * 1000))
+	}
+	return database.Grams(amount.Count) * itemWeight
+}
+
+// validateDepositAmount checks that a deposit carries the measurement its
+// material is priced on. Unknown materials are left to loadStationForDeposit.
+func validateDepositAmount(code string, amount depositAmount) error {
+	switch {
+	case amount.Weight < 0:
+		return errors.New("weight must not be negative")
+	case amount.ContainerSizeML < 0 || amount.ContainerSizeML > maxContainerSizeML:
+		return fmt.Errorf("container_size_ml must be between 0 and %d", maxContainerSizeML)
+	}
+
+	material, found := lookupMaterial(code)
+	if !found {
+		return nil
+	}
+	if material.Unit == unitItem {
+		if amount.Count <= 0 {
+			return fmt.Errorf("%s is counted per item: count must be positive", material.Name)
+		}
+		return nil
+	}
+	if amount.Count != 0 || amount.ContainerSizeML != 0 {
+		return fmt.Errorf("%s is weighed: count and container size are not accepted", material.Name)
+	}
+	if amount.Weight <= 0 {
+		return errors.New("weight must be positive")
+	}
+	return nil
+}
+
+// materialQuantityError is returned when a deposit is outside the quantity
+// range a material accepts
+type materialQuantityError struct {
+	material database.Material
+}
+
+func (e *materialQuantityError) Error() string {
+	unit := e.material.Unit
+	if unit == unitItem {
+		unit = "items"
+	}
+	if e.material.MaxQuantity == nil {
+		return fmt.Sprintf("%s deposits must be at least %g %s",
+			e.material.Name, e.material.MinQuantity, unit)
+	}
+	return fmt.Sprintf("%s deposits must be between %g and %g %s",
+		e.material.Name, e.material.MinQuantity, *e.material.MaxQuantity, unit)
+}
+
+// MaterialRequest represents a material created or updated by an admin
+type MaterialRequest struct {
+	Code        string   `json:"code"`
+	Name        string   `json:"name"`
+	Unit        string   `json:"unit"`
+	Rate        int      `json:"rate"`
+	MinQuantity float64  `json:"min_quantity"`
+	MaxQuantity *float64 `json:"max_quantity"`
+	Active      *bool    `json:"active"`
+
+	ReviewQuantity *float64 `json:"review_quantity"`
+	ItemWeightKg   float64  `json:"item_weight_kg"` // counted materials
+}
+
+// materialCache holds the material catalog in memory. It is loaded on first
+// use and reloaded after every change made through the admin API, and when a
+// scheduled rate change takes effect.
+type materialCache struct {
+	mu        sync.RWMutex
+	materials map[string]database.Material
+	expires   *time.Time
+}
+
+var materialCatalog = &materialCache{}
+
+// all returns the whole catalog, including inactive materials
+func (c *materialCache) all() map[string]database.Material {
+	now := time.Now().UTC()
+	c.mu.RLock()
+	materials, expires := c.materials, c.expires
+	c.mu.RUnlock()
+	if materials != nil && (expires == nil || now.Before(*expires)) {
+		return materials
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.materials == nil || (c.expires != nil && !now.Before(*c.expires)) {
+		loaded, expires, err := loadMaterials(now)
+		if err != nil {
+			// Retry on the next call rather than caching an empty catalog
+			log.Printf("Failed to load material catalog: %v", err)
+			return map[string]database.Material{}
+		}
+		c.materials, c.expires = loaded, expires
+	}
+	return c.materials
+}
+
+// invalidate drops the cached catalog so the next read reloads it
+func (c *materialCache) invalidate() {
+	c.mu.Lock()
+	c.materials = nil
+	c.mu.Unlock()
+}
+
+// normalizeMaterial puts a material code in the form the catalog stores.
+// Codes from stations, admins and imports all pass through it.
+func normalizeMaterial(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+// lookupMaterial returns a material from the catalog, active or not
+func lookupMaterial(code string) (database.Material, bool) {
+	material, found := materialCatalog.all()[code]
+	return material, found
+}
+
+// activeMaterial returns a material that is currently accepted
+func activeMaterial(code string) (database.Material, bool) {
+	material, found := lookupMaterial(code)
+	return material, found && material.Active
+}
+
+// supportedMaterials returns the codes of the active materials, in a stable order
+func supportedMaterials() []string {
+	var codes []string
+	for code, material := range materialCatalog.all() {
+		if material.Active {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// activeMaterialCodes filters a list of material codes down to active materials
+func activeMaterialCodes(codes []string) []string {
+	active := make([]string, 0, len(codes))
+	for _, code := range codes {
+		if _, ok := activeMaterial(code); ok {
+			active = append(active, code)
+		}
+	}
+	return active
+}
+
+// checkMaterialQuantity checks a deposit quantity against the material's limits
+func checkMaterialQuantity(code string, quantity float64) error {
+	material, found := lookupMaterial(code)
+	if !found {
+		return errMaterialNotAccepted
+	}
+	if quantity < material.MinQuantity || (material.MaxQuantity != nil && quantity > *material.MaxQuantity) {
+		return &materialQuantityError{material: material}
+	}
+	return nil
+}
+
+// materialColumns lists the columns scanned by scanMaterial
+const materialColumns = `code, name, unit, rate, min_quantity, max_quantity, active, created_at, updated_at,
+	review_quantity, item_weight_kg`
+
+// scanMaterial scans a row selected with materialColumns
+func scanMaterial(row rowScanner) (database.Material, error) {
+	var material database.Material
+	var maxQuantity, reviewQuantity sql.NullFloat64
+	err := row.Scan(&material.Code, &material.Name, &material.Unit, &material.Rate, &material.MinQuantity,
+		&maxQuantity, &material.Active, &material.CreatedAt, &material.UpdatedAt, &reviewQuantity,
+		&material.ItemWeightKg)
+	if maxQuantity.Valid {
+		material.MaxQuantity = &maxQuantity.Float64
+	}
+	if reviewQuantity.Valid {
+		material.ReviewQuantity = &reviewQuantity.Float64
+	}
+	return material, err
+}
+
+// loadMaterials reads the whole material catalog from the database, with
+// each material's rate taken from the rate version in force now. It also
+// returns when the next scheduled rate change takes effect.
+func loadMaterials(now time.Time) (map[string]database.Material, *time.Time, error) {
+	rates, next, err := currentRates(now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := database.DB.Query("SELECT " + materialColumns + " FROM materials")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	materials := make(map[string]database.Material)
+	for rows.Next() {
+		material, err := scanMaterial(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rate, found := rates[material.Code]; found {
+			material.Rate = rate
+		}
+		materials[material.Code] = material
+	}
+	return materials, next, rows.Err()
+}
+
+// sortedMaterials returns catalog entries ordered by code
+func sortedMaterials(includeInactive bool) []database.Material {
+	list := []database.Material{}
+	for _, material := range materialCatalog.all() {
+		if material.Active || includeInactive {
+			list = append(list, material)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+// validateMaterial checks the fields of a material request
+func validateMaterial(req *MaterialRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Unit == "" {
+		req.Unit = unitKg
+	}
+
+	switch {
+	case req.Name == "":
+		return errors.New("name is required")
+	case !materialUnits[req.Unit]:
+		return fmt.Errorf("unsupported unit %q", req.Unit)
+	case req.Rate <= 0:
+		return errors.New("rate must be positive")
+	case req.MinQuantity < 0:
+		return errors.New("min_quantity must not be negative")
+	case req.MaxQuantity != nil && *req.MaxQuantity <= req.MinQuantity:
+		return errors.New("max_quantity must be greater than min_quantity")
+	case req.ReviewQuantity != nil && *req.ReviewQuantity <= req.MinQuantity:
+		return errors.New("review_quantity must be greater than min_quantity")
+	case req.ItemWeightKg < 0:
+		return errors.New("item_weight_kg must not be negative")
+	case req.ItemWeightKg > 0 && req.Unit != unitItem:
+		return errors.New("item_weight_kg only applies to materials counted per item")
+	}
+	return nil
+}
+
+// listMaterials lists the active materials for apps and stations
+func listMaterials(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    sortedMaterials(false),
+	})
+}
+
+// listAllMaterials lists the whole catalog, including inactive materials
+func listAllMaterials(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    sortedMaterials(true),
+	})
+}
+
+// createMaterial adds a material to the catalog
+func createMaterial(w http.ResponseWriter, r *http.Request) {
+	var req MaterialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	req.Code = normalizeMaterial(req.Code)
+	if !materialCodePattern.MatchString(req.Code) {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "code must be 2-32 lowercase letters, digits, '-' or '_'",
+		})
+		return
+	}
+	if err := validateMaterial(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	userID, _ := getUserIDFromHeader(r)
+	active := req.Active == nil || *req.Active
+	now := time.Now().UTC()
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create material",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO materials (code, name, unit, rate, min_quantity, max_quantity, review_quantity, item_weight_kg,
+			active, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.Code, req.Name, req.Unit, req.Rate, req.MinQuantity, req.MaxQuantity, req.ReviewQuantity, req.ItemWeightKg,
+		active, now, now)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			respondJSON(w, http.StatusConflict, Response{
+				Success: false,
+				Error:   "A material with this code already exists",
+			})
+			return
+		}
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create material",
+		})
+		return
+	}
+
+	// The first rate version covers the material from the moment it is added
+	_, err = insertRateVersionTx(tx, req.Code, req.Rate, now, "Initial rate", userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create material",
+		})
+		return
+	}
+	materialCatalog.invalidate()
+	notifyConfigChanged(globalConfigScope)
+
+	material, _ := lookupMaterial(req.Code)
+	log.Printf("Material %s added to the catalog", req.Code)
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Material created",
+		Data:    material,
+	})
+}
+
+// updateMaterial replaces a material's details. The code cannot change,
+// since past transactions refer to it. A new rate takes effect immediately
+// as a new rate version.
+func updateMaterial(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+	code := chi.URLParam(r, "code")
+	existing, found := lookupMaterial(code)
+	if !found {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Material not found",
+		})
+		return
+	}
+
+	var req MaterialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+	if err := validateMaterial(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	// Rates and past deposits are in the material's unit
+	if req.Unit != existing.Unit {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "unit cannot be changed",
+		})
+		return
+	}
+
+	active := existing.Active
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	now := time.Now().UTC()
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update material",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE materials
+		SET name = ?, unit = ?, rate = ?, min_quantity = ?, max_quantity = ?, review_quantity = ?, item_weight_kg = ?,
+			active = ?, updated_at = ?
+		WHERE code = ?
+	`, req.Name, req.Unit, req.Rate, req.MinQuantity, req.MaxQuantity, req.ReviewQuantity, req.ItemWeightKg,
+		active, now, code)
+	if err == nil && req.Rate != existing.Rate {
+		_, err = insertRateVersionTx(tx, code, req.Rate, now, "Updated with the material", userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update material",
+		})
+		return
+	}
+	materialCatalog.invalidate()
+	notifyConfigChanged(globalConfigScope)
+
+	material, _ := lookupMaterial(code)
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Material updated",
+		Data:    material,
+	})
+}
+
+// deactivateMaterial stops a material from being accepted anywhere. It stays
+// in the catalog so past transactions keep their name and unit.
+func deactivateMaterial(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+
+	result, err := database.DB.Exec(
+		"UPDATE materials SET active = 0, updated_at = ? WHERE code = ?",
+		time.Now().UTC(), code,
+	)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to deactivate material",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Material not found",
+		})
+		return
+	}
+	materialCatalog.invalidate()
+	notifyConfigChanged(globalConfigScope)
+
+	log.Printf("Material %s deactivated", code)
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Material deactivated",
+	})
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"log"
+	"time"
+)
+
+// Alert describes an operational event that needs someone's attention
+type Alert struct {
+	StationID int       `json:"station_id"`
+	Type      string    `json:"type"` // station_offline
+	Message   string    `json:"message"`
+	RaisedAt  time.Time `json:"raised_at"`
+}
+
+// Notifier delivers alerts to operators
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// LogNotifier logs alerts until SetNotifier installs a real channel
+type LogNotifier struct{}
+
+// Notify logs the alert
+func (LogNotifier) Notify(alert Alert) error {
+	log.Printf("ALERT [%s] station=%d: %s", alert.Type, alert.StationID, alert.Message)
+	return nil
+}
+
+var notifier Notifier = LogNotifier{}
+
+// SetNotifier replaces the notifier used for operational alerts
+func SetNotifier(n Notifier) {
+	notifier = n
+}
+
+// raiseAlert sends an alert through the configured notifier
+func raiseAlert(stationID int, alertType, message string) {
+	alert := Alert{
+		StationID: stationID,
+		Type:      alertType,
+		Message:   message,
+		RaisedAt:  time.Now(),
+	}
+	if err := notifier.Notify(alert); err != nil {
+		log.Printf("Failed to deliver %s alert for station %d: %v", alertType, stationID, err)
+	}
+}
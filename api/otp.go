@@ -0,0 +1,534 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"t2cbackend/database"
+	"time"
+)
+
+// One-time code limits
+const (
+	otpExpiry         = 5 * time.Minute
+	otpResendInterval = time.Minute
+	otpMaxPerHour     = 5
+	otpMaxAttempts    = 5
+)
+
+var (
+	errOTPNotFound        = errors.New("no pending code for this phone")
+	errOTPExpired         = errors.New("code has expired")
+	errOTPTooManyAttempts = errors.New("too many attempts")
+	errOTPInvalid         = errors.New("invalid code")
+)
+
+// OTPRequest represents a request for a one-time code
+type OTPRequest struct {
+	Phone   string `json:"phone"`
+	Purpose string `json:"purpose,omitempty"` // login/link
+}
+
+// OTPVerifyRequest represents a one-time code verification
+type OTPVerifyRequest struct {
+	Phone string `json:"phone"`
+	Code  string `json:"code"`
+	Name  string `json:"name,omitempty"` // Used when creating a new account
+}
+
+// LinkEmailRequest represents adding email login to a phone account
+type LinkEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// normalizePhone strips formatting characters and validates the number. It
+// is returned with a leading "+" whether or not one was given, so
+// "+62812..." and "62812..." are the same phone.
+func normalizePhone(phone string) (string, bool) {
+	phone = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(phone)
+	digits := strings.TrimPrefix(phone, "+")
+	if len(digits) < 8 || len(digits) > 15 {
+		return "", false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return "+" + digits, true
+}
+
+// generateOTPCode returns a random 6-digit code
+func generateOTPCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// consumeOTP checks a code against the latest unused code for the phone and
+// purpose, marking it used on success
+func consumeOTP(phone, purpose, code string) error {
+	var otpID int
+	var codeHash string
+	var expiresAt time.Time
+
+	err := database.DB.QueryRow(`
+		SELECT id, code_hash, expires_at
+		FROM otp_codes
+		WHERE phone = ? AND purpose = ? AND used_at IS NULL
+		ORDER BY id DESC LIMIT 1
+	`, phone, purpose).Scan(&otpID, &codeHash, &expiresAt)
+
+	if err != nil {
+		return errOTPNotFound
+	}
+
+	if time.Now().After(expiresAt) {
+		return errOTPExpired
+	}
+
+	// Count the attempt before checking the code, so concurrent guesses
+	// cannot get past the limit
+	result, err := database.DB.Exec(
+		"UPDATE otp_codes SET attempts = attempts + 1 WHERE id = ? AND attempts < ?",
+		otpID, otpMaxAttempts,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return errOTPTooManyAttempts
+	}
+
+	if !checkPasswordHash(code, codeHash) {
+		return errOTPInvalid
+	}
+
+	// Only one caller can consume the code
+	result, err = database.DB.Exec(
+		"UPDATE otp_codes SET used_at = ? WHERE id = ? AND used_at IS NULL",
+		time.Now(), otpID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errOTPNotFound
+	}
+	return nil
+}
+
+// respondOTPError maps consumeOTP errors to API responses
+func respondOTPError(w http.ResponseWriter, err error) {
+	switch err {
+	case errOTPNotFound:
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "No pending code for this phone number",
+		})
+	case errOTPExpired:
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Code has expired",
+		})
+	case errOTPTooManyAttempts:
+		respondJSON(w, http.StatusTooManyRequests, Response{
+			Success: false,
+			Error:   "Too many attempts, request a new code",
+		})
+	case errOTPInvalid:
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid code",
+		})
+	default:
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to verify code",
+		})
+	}
+}
+
+// requestOTP sends a one-time code to a phone number
+func requestOTP(w http.ResponseWriter, r *http.Request) {
+	var req OTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	phone, ok := normalizePhone(req.Phone)
+	if !ok {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid phone number",
+		})
+		return
+	}
+
+	purpose := req.Purpose
+	if purpose == "" {
+		purpose = "login"
+	}
+	if purpose != "login" && purpose != "link" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Purpose must be login or link",
+		})
+		return
+	}
+
+	// Rate limit per phone number
+	rows, err := database.DB.Query(`
+		SELECT created_at FROM otp_codes
+		WHERE phone = ?
+		ORDER BY id DESC LIMIT ?
+	`, phone, otpMaxPerHour)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to send code",
+		})
+		return
+	}
+
+	now := time.Now()
+	var sentLastHour int
+	var lastSent time.Time
+	for rows.Next() {
+		var createdAt time.Time
+		if err := rows.Scan(&createdAt); err != nil {
+			continue
+		}
+		if createdAt.After(lastSent) {
+			lastSent = createdAt
+		}
+		if now.Sub(createdAt) < time.Hour {
+			sentLastHour++
+		}
+	}
+	rows.Close()
+
+	if now.Sub(lastSent) < otpResendInterval {
+		respondJSON(w, http.StatusTooManyRequests, Response{
+			Success: false,
+			Error:   "Please wait before requesting another code",
+		})
+		return
+	}
+	if sentLastHour >= otpMaxPerHour {
+		respondJSON(w, http.StatusTooManyRequests, Response{
+			Success: false,
+			Error:   "Too many codes requested, try again later",
+		})
+		return
+	}
+
+	code, err := generateOTPCode()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate code",
+		})
+		return
+	}
+
+	codeHash, err := hashPassword(code)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate code",
+		})
+		return
+	}
+
+	expiresAt := now.Add(otpExpiry)
+	_, err = database.DB.Exec(`
+		INSERT INTO otp_codes (phone, code_hash, purpose, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, phone, codeHash, purpose, expiresAt, now)
+
+	if err != nil {
+		log.Printf("requestOTP: failed to store code: %v", err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to send code",
+		})
+		return
+	}
+
+	message := fmt.Sprintf("Your Trash2Cash code is %s. It expires in %d minutes.", code, int(otpExpiry.Minutes()))
+	if err := smsSender.Send(phone, message); err != nil {
+		log.Printf("requestOTP: failed to send SMS to %s: %v", phone, err)
+		respondJSON(w, http.StatusBadGateway, Response{
+			Success: false,
+			Error:   "Failed to send code",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Code sent",
+		Data: map[string]interface{}{
+			"phone":      phone,
+			"expires_at": expiresAt.Format(time.RFC3339),
+		},
+	})
+}
+
+// verifyOTP logs in with a one-time code, creating the account on first use
+func verifyOTP(w http.ResponseWriter, r *http.Request) {
+	var req OTPVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	phone, ok := normalizePhone(req.Phone)
+	if !ok || req.Code == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Phone number and code are required",
+		})
+		return
+	}
+
+	if err := consumeOTP(phone, "login", req.Code); err != nil {
+		log.Printf("OTP login failed for phone %s: %v", phone, err)
+		respondOTPError(w, err)
+		return
+	}
+
+	// Find or create the account for this phone
+	var user database.User
+	err := database.DB.QueryRow(
+		"SELECT id, COALESCE(email, ''), phone, name, total_points FROM users WHERE phone = ?",
+		phone,
+	).Scan(&user.ID, &user.Email, &user.Phone, &user.Name, &user.TotalPoints)
+
+	created := false
+	if err == sql.ErrNoRows {
+		name := req.Name
+		if name == "" {
+			name = phone
+		}
+
+		// Phone-only accounts have no password until an email is linked.
+		// Every account has a ledger wallet from the start.
+		var userID int64
+		tx, err := database.DB.Begin()
+		if err == nil {
+			defer tx.Rollback()
+			var result sql.Result
+			result, err = tx.Exec(
+				"INSERT INTO users (phone, password, name, total_points) VALUES (?, ?, ?, ?)",
+				phone, "", name, 0,
+			)
+			if err == nil {
+				userID, _ = result.LastInsertId()
+				_, err = walletAccountTx(tx, int(userID))
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to create account",
+			})
+			return
+		}
+		user = database.User{ID: int(userID), Phone: phone, Name: name}
+		created = true
+		log.Printf("Account created by phone: user_id=%d", user.ID)
+	} else if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve account",
+		})
+		return
+	}
+
+	jwtToken, err := generateJWT(user.ID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate authentication token",
+		})
+		return
+	}
+
+	status := http.StatusOK
+	message := "Login successful"
+	if created {
+		status = http.StatusCreated
+		message = "Registration successful"
+	}
+
+	respondJSON(w, status, Response{
+		Success: true,
+		Message: message,
+		Data: map[string]interface{}{
+			"token": jwtToken,
+			"user": map[string]interface{}{
+				"id":           user.ID,
+				"email":        user.Email,
+				"phone":        user.Phone,
+				"name":         user.Name,
+				"total_points": user.TotalPoints,
+			},
+		},
+	})
+}
+
+// linkPhone verifies a one-time code and adds the phone to the current account
+func linkPhone(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid user",
+		})
+		return
+	}
+
+	var req OTPVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	phone, ok := normalizePhone(req.Phone)
+	if !ok || req.Code == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Phone number and code are required",
+		})
+		return
+	}
+
+	if err := consumeOTP(phone, "link", req.Code); err != nil {
+		respondOTPError(w, err)
+		return
+	}
+
+	_, err = database.DB.Exec(
+		"UPDATE users SET phone = ?, updated_at = ? WHERE id = ?",
+		phone, time.Now(), userID,
+	)
+	if err != nil {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Phone number already linked to another account",
+		})
+		return
+	}
+
+	log.Printf("Phone linked: user=%d", userID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Phone number linked",
+		Data: map[string]interface{}{
+			"phone": phone,
+		},
+	})
+}
+
+// linkEmail adds email and password login to an account created by phone
+func linkEmail(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid user",
+		})
+		return
+	}
+
+	var req LinkEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	if req.Email == "" || req.Password == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Email and password are required",
+		})
+		return
+	}
+
+	var existingEmail sql.NullString
+	err = database.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&existingEmail)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "User not found",
+		})
+		return
+	}
+
+	if existingEmail.Valid && existingEmail.String != "" {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Account already has an email",
+		})
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to process password",
+		})
+		return
+	}
+
+	_, err = database.DB.Exec(
+		"UPDATE users SET email = ?, password = ?, updated_at = ? WHERE id = ?",
+		req.Email, hashedPassword, time.Now(), userID,
+	)
+	if err != nil {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Email already exists",
+		})
+		return
+	}
+
+	log.Printf("Email linked: user=%d", userID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Email linked",
+		Data: map[string]interface{}{
+			"email": req.Email,
+		},
+	})
+}
@@ -0,0 +1,28 @@
+package api
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone string
+		want  string
+		ok    bool
+	}{
+		{"+6281234567890", "+6281234567890", true},
+		{"6281234567890", "+6281234567890", true},
+		{"+62 812-3456-7890", "+6281234567890", true},
+		{"62 (812) 3456 7890", "+6281234567890", true},
+		{"+1234567", "", false},
+		{"+1234567890123456", "", false},
+		{"+62812a4567890", "", false},
+		{"++6281234567890", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := normalizePhone(tt.phone)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizePhone(%q) = %q, %v, want %q, %v", tt.phone, got, ok, tt.want, tt.ok)
+		}
+	}
+}
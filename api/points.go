@@ -0,0 +1,157 @@
+package api
+
+import (
+	"database/sql"
+	"t2cbackend/database"
+	"time"
+)
+
+// Fixed-point units. Weights are handled in grams and points in thousandths
+// of a point, so a deposit's value is exact: grams x points per kg gives
+// milli-points. Cash is handled in whole rupiah.
+const (
+	milliPerPoint  = 1000
+	rupiahPerPoint = 10 // 100 points = Rp 1,000
+)
+
+// Rounding modes for turning milli-points into whole points
+const (
+	roundFloor    = "floor"
+	roundHalfUp   = "half_up"
+	roundHalfEven = "half_even"
+	roundCeil     = "ceil"
+)
+
+var roundingModes = map[string]bool{
+	roundFloor:    true,
+	roundHalfUp:   true,
+	roundHalfEven: true,
+	roundCeil:     true,
+}
+
+// milliPointsFor returns the exact value of a weight at a rate in points per kg
+func milliPointsFor(rate int, weight database.Grams) int64 {
+	return int64(weight) * int64(rate)
+}
+
+// pointsToRupiah converts points to their cash value
+func pointsToRupiah(points int) int64 {
+	return int64(points) * rupiahPerPoint
+}
+
+// formatMilliPoints renders milli-points as a decimal number of points
+func formatMilliPoints(milli int64) float64 {
+	return float64(milli) / milliPerPoint
+}
+
+// pointsRoundingMode returns the rounding mode set in the global configuration
+func pointsRoundingMode() string {
+	cfg, _, err := globalStationConfig()
+	if err != nil || !roundingModes[cfg.PointsRounding] {
+		return roundFloor
+	}
+	return cfg.PointsRounding
+}
+
+// roundMilliPoints rounds milli-points to whole points with the given mode
+func roundMilliPoints(milli int64, mode string) int64 {
+	// Floor division, so negative carried fractions round the same way
+	points, fraction := milli/milliPerPoint, milli%milliPerPoint
+	if fraction < 0 {
+		points--
+		fraction += milliPerPoint
+	}
+
+	switch mode {
+	case roundCeil:
+		if fraction > 0 {
+			points++
+		}
+	case roundHalfUp:
+		if fraction >= milliPerPoint/2 {
+			points++
+		}
+	case roundHalfEven:
+		if fraction > milliPerPoint/2 || (fraction == milliPerPoint/2 && points%2 != 0) {
+			points++
+		}
+	}
+	return points
+}
+
+// pointsIncrement returns the whole points added when milli-points are added
+// to a running total, so the points credited for a series of deposits always
+// add up to the rounded total
+func pointsIncrement(runningMilli, milli int64, mode string) int {
+	return int(roundMilliPoints(runningMilli+milli, mode) - roundMilliPoints(runningMilli, mode))
+}
+
+// creditPointsTx works out the whole points a deposit's milli-points earn.
+// The fraction of a point carried from earlier deposits is added first; the
+// rest is carried to the next deposit. Returns the points to credit, which
+// the caller posts with postPointsTx once the deposit is recorded.
+func creditPointsTx(tx *sql.Tx, userID int, milli int64) (int, error) {
+	points, err := creditLinePointsTx(tx, userID, []int64{milli})
+	if err != nil {
+		return 0, err
+	}
+	return points[0], nil
+}
+
+// creditLinePointsTx works out the points of several deposit lines at once,
+// carrying the fraction left like creditPointsTx. Returns the points for each
+// line, which add up to the total to post.
+func creditLinePointsTx(tx *sql.Tx, userID int, lines []int64) ([]int, error) {
+	var carried int64
+	err := tx.QueryRow("SELECT point_remainder FROM users WHERE id = ?", userID).Scan(&carried)
+	if err != nil {
+		return nil, err
+	}
+
+	points, remainder := splitLinePoints(carried, lines, pointsRoundingMode())
+	_, err = tx.Exec(
+		"UPDATE users SET point_remainder = ?, updated_at = ? WHERE id = ?",
+		remainder, time.Now(), userID,
+	)
+	return points, err
+}
+
+// splitLinePoints rounds deposit lines to whole points, starting from the
+// milli-points carried from earlier deposits. Returns the points for each
+// line and the milli-points left to carry.
+func splitLinePoints(carried int64, lines []int64, mode string) ([]int, int64) {
+	points := make([]int, len(lines))
+	total, credited := carried, int64(0)
+	for i, milli := range lines {
+		total += milli
+		rounded := roundMilliPoints(total, mode)
+		points[i] = int(rounded - credited)
+		credited = rounded
+	}
+	return points, total - credited*milliPerPoint
+}
+
+// userCarriedPoints returns the fraction of a point a user carries to their next deposit
+func userCarriedPoints(userID int) float64 {
+	var carried int64
+	database.DB.QueryRow("SELECT point_remainder FROM users WHERE id = ?", userID).Scan(&carried)
+	return formatMilliPoints(carried)
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// guestSessionMilliPoints returns the exact value of the deposits made in a
+// guest session so far. Guest deposits carry fractions within the session;
+// what is left over at the end is carried to the user who claims it.
+// Deposits held for review are left out until an admin approves them.
+func guestSessionMilliPoints(q rowQuerier, sessionToken string) int64 {
+	var milli int64
+	q.QueryRow(`
+		SELECT COALESCE(SUM(COALESCE(milli_points, points_earned * 1000)), 0)
+		FROM guest_deposits WHERE session_token = ? AND COALESCE(review_status, '') != 'held'
+	`, sessionToken).Scan(&milli)
+	return milli
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"t2cbackend/database"
+)
+
+func TestRoundMilliPoints(t *testing.T) {
+	tests := []struct {
+		milli int64
+		mode  string
+		want  int64
+	}{
+		{0, roundFloor, 0},
+		{1999, roundFloor, 1},
+		{-1, roundFloor, -1},
+		{1000, roundCeil, 1},
+		{1001, roundCeil, 2},
+		{-500, roundCeil, 0},
+		{1499, roundHalfUp, 1},
+		{1500, roundHalfUp, 2},
+		{-500, roundHalfUp, 0},
+		{500, roundHalfEven, 0},
+		{1500, roundHalfEven, 2},
+		{2500, roundHalfEven, 2},
+		{2501, roundHalfEven, 3},
+	}
+
+	for _, tt := range tests {
+		if got := roundMilliPoints(tt.milli, tt.mode); got != tt.want {
+			t.Errorf("roundMilliPoints(%d, %s) = %d, want %d", tt.milli, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestSplitLinePoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		carried   int64
+		lines     []int64
+		mode      string
+		points    []int
+		remainder int64
+	}{
+		{"small deposits add up", 0, []int64{900, 900, 900}, roundFloor, []int{0, 1, 1}, 700},
+		{"carried fraction first", 700, []int64{400}, roundFloor, []int{1}, 100},
+		{"rounded up carries a negative fraction", 0, []int64{400, 400}, roundHalfUp, []int{0, 1}, -200},
+		{"negative fraction carried", -200, []int64{1100}, roundHalfUp, []int{1}, -100},
+		{"ceil", 0, []int64{100, 100}, roundCeil, []int{1, 0}, -800},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, remainder := splitLinePoints(tt.carried, tt.lines, tt.mode)
+			if len(points) != len(tt.points) {
+				t.Fatalf("splitLinePoints() = %v, want %v", points, tt.points)
+			}
+			for i := range points {
+				if points[i] != tt.points[i] {
+					t.Errorf("splitLinePoints() = %v, want %v", points, tt.points)
+					break
+				}
+			}
+			if remainder != tt.remainder {
+				t.Errorf("splitLinePoints() remainder = %d, want %d", remainder, tt.remainder)
+			}
+		})
+	}
+}
+
+// No fraction of a point is lost or created, whatever the mode
+func TestSplitLinePointsCarry(t *testing.T) {
+	lines := []int64{90, 1250, 333, 999, 1, 4500}
+	for mode := range roundingModes {
+		var carried, exact int64
+		var credited int
+		for _, milli := range lines {
+			points, remainder := splitLinePoints(carried, []int64{milli}, mode)
+			credited += points[0]
+			exact += milli
+			carried = remainder
+		}
+		if int64(credited)*milliPerPoint+carried != exact {
+			t.Errorf("%s: credited %d points and carried %d, want %d milli-points in total",
+				mode, credited, carried, exact)
+		}
+		if carried <= -milliPerPoint || carried >= milliPerPoint {
+			t.Errorf("%s: carried %d, want less than a point", mode, carried)
+		}
+	}
+}
+
+func TestDepositWeightGrams(t *testing.T) {
+	tests := []struct {
+		body  string
+		grams database.Grams
+	}{
+		{`{"weight": 0.09}`, 90},
+		{`{"weight": 0.1}`, 100},
+		{`{"weight": 1.2345}`, 1235},
+		{`{"weight": 2}`, 2000},
+		{`{"weight": 1e-3}`, 1},
+		{`{}`, 0},
+	}
+
+	for _, tt := range tests {
+		var req SessionDepositRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", tt.body, err)
+		}
+		if req.Weight != tt.grams {
+			t.Errorf("Unmarshal(%s) weight = %d g, want %d g", tt.body, req.Weight, tt.grams)
+		}
+	}
+
+	var req SessionDepositRequest
+	if err := json.Unmarshal([]byte(`{"weight": "0.5"}`), &req); err == nil {
+		t.Error("Unmarshal() accepted a weight given as a string")
+	}
+
+	// 0.09 kg at 10 points per kg is worth 0.9 points, not 0
+	if got := milliPointsFor(10, 90); got != 900 {
+		t.Errorf("milliPointsFor(10, 90 g) = %d, want 900", got)
+	}
+}
@@ -0,0 +1,562 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// defaultWeightTolerancePct is how far a container's weight may be from
+	// its product's expected weight when no tolerance is set
+	defaultWeightTolerancePct = 25
+	// maxProductImportBytes limits the size of a CSV product import
+	maxProductImportBytes = 5 << 20
+)
+
+// productImportColumns are the CSV columns a product import reads. Only gtin,
+// name and material are required.
+var productImportColumns = []string{
+	"gtin", "name", "brand", "material", "expected_weight_kg", "weight_tolerance_pct", "container_size_ml",
+}
+
+var errUnknownBarcode = errors.New("unknown barcode")
+
+// ProductRequest represents a product created or updated by an admin
+type ProductRequest struct {
+	GTIN               string   `json:"gtin"`
+	Name               string   `json:"name"`
+	Brand              string   `json:"brand"`
+	Material           string   `json:"material"`
+	ExpectedWeightKg   float64  `json:"expected_weight_kg"`
+	WeightTolerancePct *float64 `json:"weight_tolerance_pct"`
+	ContainerSizeML    *int     `json:"container_size_ml"`
+	Active             *bool    `json:"active"`
+}
+
+// productMatch is what a deposit's barcode identified. Barcode is the
+// normalized GTIN; Brand and Product are nil when the product is not in the
+// catalog.
+type productMatch struct {
+	Material   string
+	Barcode    *string
+	Brand      *string
+	Product    *database.Product
+	ItemWeight database.Grams // expected weight of one container, 0 if unknown
+}
+
+// normalizeGTIN checks a GTIN-8, -12, -13 or -14 barcode's check digit and
+// returns it zero-padded to 14 digits, so UPC and EAN forms of a code match
+func normalizeGTIN(code string) (string, error) {
+	code = strings.TrimSpace(code)
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return "", fmt.Errorf("barcode %q must be 8, 12, 13 or 14 digits", code)
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("barcode %q must be 8, 12, 13 or 14 digits", code)
+		}
+	}
+
+	gtin := strings.Repeat("0", 14-len(code)) + code
+	sum := 0
+	for i, c := range gtin[:13] {
+		digit := int(c - '0')
+		if i%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	if (10-sum%10)%10 != int(gtin[13]-'0') {
+		return "", fmt.Errorf("barcode %q has an invalid check digit", code)
+	}
+	return gtin, nil
+}
+
+// productColumns lists the columns scanned by scanProduct
+const productColumns = `gtin, name, brand, material, expected_weight_kg, weight_tolerance_pct,
+	container_size_ml, active, created_at, updated_at`
+
+// scanProduct scans a row selected with productColumns
+func scanProduct(row rowScanner) (database.Product, error) {
+	var product database.Product
+	var containerSize sql.NullInt64
+	err := row.Scan(&product.GTIN, &product.Name, &product.Brand, &product.Material,
+		&product.ExpectedWeightKg, &product.WeightTolerancePct, &containerSize,
+		&product.Active, &product.CreatedAt, &product.UpdatedAt)
+	if containerSize.Valid {
+		size := int(containerSize.Int64)
+		product.ContainerSizeML = &size
+	}
+	return product, err
+}
+
+// lookupProduct finds a product by its normalized GTIN
+func lookupProduct(gtin string) (database.Product, error) {
+	return scanProduct(database.DB.QueryRow(
+		"SELECT "+productColumns+" FROM products WHERE gtin = ?", gtin,
+	))
+}
+
+// classifyDeposit resolves the material of a deposit that carries a barcode.
+// Catalogued products set the material, and a material sent with them must
+// match; a barcode that is not catalogued is recorded as long as the deposit
+// names its material. Counted deposits take the product's container size
+// when they do not report one. The weight is checked separately with
+// checkWeight, once it has been calibrated.
+func classifyDeposit(material, barcode string, amount *depositAmount) (productMatch, error) {
+	material = normalizeMaterial(material)
+	match := productMatch{Material: material}
+	if barcode == "" {
+		return match, nil
+	}
+
+	gtin, err := normalizeGTIN(barcode)
+	if err != nil {
+		return match, err
+	}
+	match.Barcode = &gtin
+
+	product, err := lookupProduct(gtin)
+	if err != nil || !product.Active {
+		if material == "" {
+			return match, errUnknownBarcode
+		}
+		return match, nil
+	}
+	if material != "" && material != product.Material {
+		return match, fmt.Errorf("barcode %s is %s, not %s", barcode, product.Material, material)
+	}
+	match.Material = product.Material
+	match.Brand = &product.Brand
+	match.ItemWeight = database.Grams(math.Round(product.ExpectedWeightKg * 1000))
+	match.Product = &product
+
+	if counted(product.Material) && amount.ContainerSizeML == 0 && product.ContainerSizeML != nil {
+		amount.ContainerSizeML = *product.ContainerSizeML
+	}
+	return match, nil
+}
+
+// checkWeight checks a deposit's calibrated weight against the expected
+// weight of its catalogued product times the number of containers (the
+// count for counted materials, otherwise 1). Deposits the station did not
+// weigh are not checked.
+func (m productMatch) checkWeight(amount depositAmount, weight database.Grams) error {
+	if m.Product == nil || amount.Weight <= 0 || m.Product.ExpectedWeightKg <= 0 {
+		return nil
+	}
+
+	containers := 1
+	if amount.Count > 0 && counted(m.Material) {
+		containers = amount.Count
+	}
+	expected := float64(containers) * m.Product.ExpectedWeightKg
+	margin := expected * m.Product.WeightTolerancePct / 100
+	if math.Abs(weight.Kg()-expected) > margin {
+		return fmt.Errorf("weight %g kg is outside the expected %.3f-%.3f kg for %s",
+			weight.Kg(), expected-margin, expected+margin, m.Product.Name)
+	}
+	return nil
+}
+
+// validateProduct checks the fields of a product request
+func validateProduct(req *ProductRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Brand = strings.TrimSpace(req.Brand)
+	req.Material = normalizeMaterial(req.Material)
+	if req.WeightTolerancePct == nil {
+		tolerance := float64(defaultWeightTolerancePct)
+		req.WeightTolerancePct = &tolerance
+	}
+
+	if _, found := lookupMaterial(req.Material); !found {
+		return fmt.Errorf("unknown material %q", req.Material)
+	}
+	switch {
+	case req.Name == "":
+		return errors.New("name is required")
+	case req.ExpectedWeightKg < 0:
+		return errors.New("expected_weight_kg must not be negative")
+	case *req.WeightTolerancePct < 0 || *req.WeightTolerancePct > 100:
+		return errors.New("weight_tolerance_pct must be between 0 and 100")
+	case req.ContainerSizeML != nil && (*req.ContainerSizeML <= 0 || *req.ContainerSizeML > maxContainerSizeML):
+		return fmt.Errorf("container_size_ml must be between 1 and %d", maxContainerSizeML)
+	}
+	return nil
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// upsertProduct adds a product, or replaces the details of an existing one
+func upsertProduct(exec sqlExecer, gtin string, req ProductRequest, now time.Time) error {
+	active := req.Active == nil || *req.Active
+	_, err := exec.Exec(`
+		INSERT INTO products (gtin, name, brand, material, expected_weight_kg, weight_tolerance_pct,
+			container_size_ml, active, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(gtin) DO UPDATE SET
+			name = excluded.name, brand = excluded.brand, material = excluded.material,
+			expected_weight_kg = excluded.expected_weight_kg, weight_tolerance_pct = excluded.weight_tolerance_pct,
+			container_size_ml = excluded.container_size_ml, active = excluded.active, updated_at = excluded.updated_at
+	`, gtin, req.Name, req.Brand, req.Material, req.ExpectedWeightKg, *req.WeightTolerancePct,
+		req.ContainerSizeML, active, now, now)
+	return err
+}
+
+// listProducts lists the product catalog, optionally filtered by brand or material
+func listProducts(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + productColumns + " FROM products WHERE 1 = 1"
+	var args []interface{}
+	if brand := r.URL.Query().Get("brand"); brand != "" {
+		query += " AND brand = ?"
+		args = append(args, brand)
+	}
+	if material := r.URL.Query().Get("material"); material != "" {
+		query += " AND material = ?"
+		args = append(args, material)
+	}
+	query += " ORDER BY brand, name"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve products",
+		})
+		return
+	}
+	defer rows.Close()
+
+	products := []database.Product{}
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			continue
+		}
+		products = append(products, product)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    products,
+	})
+}
+
+// getProduct looks up a product by barcode
+func getProduct(w http.ResponseWriter, r *http.Request) {
+	gtin, err := normalizeGTIN(chi.URLParam(r, "gtin"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	product, err := lookupProduct(gtin)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Product not found",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    product,
+	})
+}
+
+// saveProduct adds a product to the catalog, or replaces it if the barcode
+// is already catalogued
+func saveProduct(w http.ResponseWriter, r *http.Request) {
+	var req ProductRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+	if code := chi.URLParam(r, "gtin"); code != "" {
+		req.GTIN = code
+	}
+
+	gtin, err := normalizeGTIN(req.GTIN)
+	if err == nil {
+		err = validateProduct(&req)
+	}
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if err := upsertProduct(database.DB, gtin, req, time.Now().UTC()); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to save product",
+		})
+		return
+	}
+
+	product, _ := lookupProduct(gtin)
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Product saved",
+		Data:    product,
+	})
+}
+
+// deleteProduct removes a product from the catalog. Past deposits keep the
+// barcode and brand they were recorded with.
+func deleteProduct(w http.ResponseWriter, r *http.Request) {
+	gtin, err := normalizeGTIN(chi.URLParam(r, "gtin"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	result, err := database.DB.Exec("DELETE FROM products WHERE gtin = ?", gtin)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to delete product",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Product not found",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Product deleted",
+	})
+}
+
+// importProducts adds or replaces products from a CSV upload with a header
+// row naming the productImportColumns in any order. Rows that fail
+// validation are reported and skipped; the rest are saved together.
+func importProducts(w http.ResponseWriter, r *http.Request) {
+	reader := csv.NewReader(http.MaxBytesReader(w, r.Body, maxProductImportBytes))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "CSV header row is required",
+		})
+		return
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"gtin", "name", "material"} {
+		if _, ok := index[required]; !ok {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("CSV is missing the %s column (columns: %s)", required, strings.Join(productImportColumns, ", ")),
+			})
+			return
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := index[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to import products",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	imported := 0
+	rowErrors := []map[string]interface{}{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				respondJSON(w, http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "Failed to read CSV",
+				})
+				return
+			}
+			rowErrors = append(rowErrors, map[string]interface{}{"line": line, "error": parseErr.Err.Error()})
+			continue
+		}
+
+		req, err := productFromRecord(record, field)
+		var gtin string
+		if err == nil {
+			gtin, err = normalizeGTIN(req.GTIN)
+		}
+		if err == nil {
+			err = validateProduct(&req)
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, map[string]interface{}{"line": line, "gtin": req.GTIN, "error": err.Error()})
+			continue
+		}
+
+		if err := upsertProduct(tx, gtin, req, now); err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to import products",
+			})
+			return
+		}
+		imported++
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to import products",
+		})
+		return
+	}
+
+	log.Printf("Product import: %d saved, %d rejected", imported, len(rowErrors))
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Products imported",
+		Data: map[string]interface{}{
+			"imported": imported,
+			"rejected": len(rowErrors),
+			"errors":   rowErrors,
+		},
+	})
+}
+
+// productFromRecord reads a product request from a CSV row
+func productFromRecord(record []string, field func([]string, string) string) (ProductRequest, error) {
+	req := ProductRequest{
+		GTIN:     field(record, "gtin"),
+		Name:     field(record, "name"),
+		Brand:    field(record, "brand"),
+		Material: field(record, "material"),
+	}
+
+	if raw := field(record, "expected_weight_kg"); raw != "" {
+		weight, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return req, errors.New("expected_weight_kg must be a number")
+		}
+		req.ExpectedWeightKg = weight
+	}
+	if raw := field(record, "weight_tolerance_pct"); raw != "" {
+		tolerance, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return req, errors.New("weight_tolerance_pct must be a number")
+		}
+		req.WeightTolerancePct = &tolerance
+	}
+	if raw := field(record, "container_size_ml"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil {
+			return req, errors.New("container_size_ml must be a whole number")
+		}
+		req.ContainerSizeML = &size
+	}
+	return req, nil
+}
+
+// getBrandReport totals deposits identified by barcode per brand and material
+// over the last days (default 90)
+func getBrandReport(w http.ResponseWriter, r *http.Request) {
+	days, err := reliabilityWindow(r)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	windowStart := time.Now().UTC().AddDate(0, 0, -days)
+
+	rows, err := database.DB.Query(`
+		SELECT brand, item_type, COUNT(*), COALESCE(SUM(item_count), 0), COALESCE(SUM(weight_grams), 0) / 1000.0, COALESCE(SUM(points_earned), 0)
+		FROM transactions
+		WHERE type = 'deposit' AND brand IS NOT NULL AND timestamp >= ?
+		GROUP BY brand, item_type
+		ORDER BY brand, item_type
+	`, windowStart)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to build brand report",
+		})
+		return
+	}
+	defer rows.Close()
+
+	brands := []map[string]interface{}{}
+	for rows.Next() {
+		var brand, material string
+		var deposits, items, points int
+		var weight float64
+		if rows.Scan(&brand, &material, &deposits, &items, &weight, &points) != nil {
+			continue
+		}
+		brands = append(brands, map[string]interface{}{
+			"brand":     brand,
+			"material":  material,
+			"deposits":  deposits,
+			"items":     items,
+			"weight_kg": weight,
+			"points":    points,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"window_days": days,
+			"brands":      brands,
+		},
+	})
+}
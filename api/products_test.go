@@ -0,0 +1,89 @@
+package api
+
+import (
+	"testing"
+
+	"t2cbackend/database"
+)
+
+func TestNormalizeGTIN(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"96385074", "00000096385074"},        // EAN-8
+		{"036000291452", "00036000291452"},    // UPC-A
+		{"0036000291452", "00036000291452"},   // the same code as EAN-13
+		{"5449000000996", "05449000000996"},   // EAN-13
+		{"4006381333931", "04006381333931"},   // EAN-13
+		{"10614141000415", "10614141000415"},  // GTIN-14
+		{" 5449000000996 ", "05449000000996"}, // scanners may pad with spaces
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeGTIN(tt.code)
+		if err != nil {
+			t.Errorf("normalizeGTIN(%q) error = %v", tt.code, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeGTIN(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeGTINRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+	}{
+		{"wrong check digit", "5449000000997"},
+		{"wrong check digit UPC-A", "036000291453"},
+		{"too short", "12345"},
+		{"between lengths", "54490000009"},
+		{"too long", "054490000009960"},
+		{"letters", "544900000099A"},
+		{"empty", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := normalizeGTIN(tt.code); err == nil {
+				t.Errorf("normalizeGTIN(%q) = %q, want an error", tt.code, got)
+			}
+		})
+	}
+}
+
+func TestProductCheckWeight(t *testing.T) {
+	product := &database.Product{Name: "Jar", ExpectedWeightKg: 0.2, WeightTolerancePct: 10}
+	match := productMatch{Material: "glass", Product: product}
+
+	tests := []struct {
+		name      string
+		raw       database.Grams
+		corrected database.Grams
+		wantErr   bool
+	}{
+		{"within tolerance", 205, 205, false},
+		{"scale reads high, calibrated weight fits", 240, 200, false},
+		{"scale reads low, calibrated weight is too heavy", 190, 240, true},
+		{"too light", 150, 150, true},
+		{"not weighed", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := match.checkWeight(depositAmount{Weight: tt.raw}, tt.corrected)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkWeight(raw %d g, corrected %d g) error = %v, want error %v",
+					tt.raw, tt.corrected, err, tt.wantErr)
+			}
+		})
+	}
+
+	// Barcodes that are not catalogued are not checked
+	if err := (productMatch{Material: "glass"}).checkWeight(depositAmount{Weight: 900}, 900); err != nil {
+		t.Errorf("checkWeight() without a product error = %v", err)
+	}
+}
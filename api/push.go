@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Station connection settings. The server pings every stationPingPeriod and
+// drops a connection that has not answered within stationPongWait.
+const (
+	stationWriteTimeout    = 10 * time.Second // bounds how long a push may block on a slow connection
+	stationPongWait        = 60 * time.Second
+	stationPingPeriod      = stationPongWait * 9 / 10
+	maxStationMessageBytes = 4096
+)
+
+// stationConn is a WebSocket connection from station hardware
+type stationConn struct {
+	stationID int
+	conn      *websocket.Conn
+	mu        sync.Mutex // gorilla/websocket allows one concurrent writer
+}
+
+// send writes a JSON message to the station
+func (c *stationConn) send(message interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(stationWriteTimeout))
+	return c.conn.WriteJSON(message)
+}
+
+// stationHub tracks the connected stations
+type stationHub struct {
+	mu    sync.RWMutex
+	conns map[int]map[*stationConn]bool
+}
+
+var hub = &stationHub{conns: make(map[int]map[*stationConn]bool)}
+
+func (h *stationHub) register(c *stationConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[c.stationID] == nil {
+		h.conns[c.stationID] = make(map[*stationConn]bool)
+	}
+	h.conns[c.stationID][c] = true
+}
+
+func (h *stationHub) unregister(c *stationConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns[c.stationID], c)
+	if len(h.conns[c.stationID]) == 0 {
+		delete(h.conns, c.stationID)
+	}
+}
+
+// connections returns the open connections for a station
+func (h *stationHub) connections(stationID int) []*stationConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	conns := make([]*stationConn, 0, len(h.conns[stationID]))
+	for c := range h.conns[stationID] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// stationIDs returns the stations with at least one open connection
+func (h *stationHub) stationIDs() []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ids := make([]int, 0, len(h.conns))
+	for id := range h.conns {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// pushToStation sends a message to every connection of a station and reports
+// whether at least one delivery succeeded
+func pushToStation(stationID int, message interface{}) bool {
+	delivered := false
+	for _, c := range hub.connections(stationID) {
+		if err := c.send(message); err != nil {
+			log.Printf("Push to station %d failed: %v", stationID, err)
+			c.conn.Close()
+			continue
+		}
+		delivered = true
+	}
+	return delivered
+}
+
+// pushToStationOnce sends a message to a single connection of a station, for
+// messages the station must not act on twice. It reports whether a
+// connection accepted it.
+func pushToStationOnce(stationID int, message interface{}) bool {
+	for _, c := range hub.connections(stationID) {
+		if err := c.send(message); err != nil {
+			log.Printf("Push to station %d failed: %v", stationID, err)
+			c.conn.Close()
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// pingStation keeps a connection's read deadline moving until done is closed.
+// Pings may be written alongside send, as gorilla/websocket allows for
+// control messages.
+func pingStation(c *stationConn, done <-chan struct{}) {
+	ticker := time.NewTicker(stationPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(stationWriteTimeout)); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// handleWebSocket opens the command and push channel for station hardware.
+// Stations authenticate with the X-Station-Key header only; keys in the URL
+// would end up in request logs.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	apiKey := r.Header.Get("X-Station-Key")
+
+	var stationID int
+	err := database.DB.QueryRow(
+		"SELECT id FROM stations WHERE api_key = ? AND status != 'disabled'",
+		apiKey,
+	).Scan(&stationID)
+	if apiKey == "" || err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid station key",
+		})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &stationConn{stationID: stationID, conn: conn}
+	hub.register(c)
+	log.Printf("Station %d connected to push channel", stationID)
+
+	// A station that stops answering pings is disconnected, so commands are
+	// not pushed into a dead connection
+	conn.SetReadLimit(maxStationMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(stationPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(stationPongWait))
+	})
+	done := make(chan struct{})
+	go pingStation(c, done)
+
+	defer func() {
+		close(done)
+		hub.unregister(c)
+		conn.Close()
+		log.Printf("Station %d disconnected from push channel", stationID)
+	}()
+
+	// Hand over commands queued while the station was offline
+	deliverQueuedCommands(stationID)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(stationPongWait))
+
+		var ack CommandAck
+		if err := json.Unmarshal(data, &ack); err != nil || ack.Type != "ack" {
+			continue
+		}
+		handleCommandAck(stationID, ack)
+	}
+}
@@ -0,0 +1,417 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// errRateVersionExists is returned when a material already has a rate
+// version starting at the requested time
+var errRateVersionExists = errors.New("a rate version already starts at this time")
+
+// MaterialRateRequest represents a rate change scheduled by an admin
+type MaterialRateRequest struct {
+	Rate          int        `json:"rate"`
+	EffectiveFrom *time.Time `json:"effective_from"` // defaults to now
+	Comment       string     `json:"comment"`
+}
+
+// depositPrice records how a deposit was priced, so statements can explain
+// each credit later
+type depositPrice struct {
+	RateVersionID *int
+	BaseRate      int     // catalog rate in force when the item was weighed
+	Rate          int     // rate applied, after the station's override
+	Multiplier    float64 // Rate relative to BaseRate
+	MilliPoints   int64   // exact value, in thousandths of a point
+	Points        int     // MilliPoints rounded on their own, before any carry-over
+}
+
+// rateVersionColumns lists the columns scanned by scanRateVersion
+const rateVersionColumns = `id, material, rate, effective_from, effective_to, COALESCE(comment, ''), created_by, created_at`
+
+// scanRateVersion scans a row selected with rateVersionColumns
+func scanRateVersion(row rowScanner) (database.MaterialRate, error) {
+	var version database.MaterialRate
+	var effectiveTo sql.NullTime
+	var createdBy sql.NullInt64
+	err := row.Scan(&version.ID, &version.Material, &version.Rate, &version.EffectiveFrom, &effectiveTo,
+		&version.Comment, &createdBy, &version.CreatedAt)
+	if effectiveTo.Valid {
+		version.EffectiveTo = &effectiveTo.Time
+	}
+	if createdBy.Valid {
+		id := int(createdBy.Int64)
+		version.CreatedBy = &id
+	}
+	return version, err
+}
+
+// rateVersionAt returns the rate version of a material in force at the given
+// time, or sql.ErrNoRows if the time is before the material's first version
+func rateVersionAt(material string, at time.Time) (database.MaterialRate, error) {
+	return scanRateVersion(database.DB.QueryRow(`
+		SELECT `+rateVersionColumns+` FROM material_rates
+		WHERE material = ? AND effective_from <= ?
+		ORDER BY effective_from DESC LIMIT 1
+	`, material, at.UTC()))
+}
+
+// currentRates returns the rate in force now for each material with rate
+// versions, and when the next scheduled change takes effect
+func currentRates(now time.Time) (map[string]int, *time.Time, error) {
+	rows, err := database.DB.Query(`
+		SELECT material, rate FROM material_rates
+		WHERE effective_from <= ? AND (effective_to IS NULL OR effective_to > ?)
+	`, now, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	rates := make(map[string]int)
+	for rows.Next() {
+		var material string
+		var rate int
+		if err := rows.Scan(&material, &rate); err != nil {
+			return nil, nil, err
+		}
+		rates[material] = rate
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next time.Time
+	err = database.DB.QueryRow(`
+		SELECT effective_from FROM material_rates
+		WHERE effective_from > ?
+		ORDER BY effective_from ASC LIMIT 1
+	`, now).Scan(&next)
+	if err == sql.ErrNoRows {
+		return rates, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return rates, &next, nil
+}
+
+// priceDeposit prices a deposit made at the given time, by weight or, for
+// counted materials, by item count. The catalog rate version in force at that
+// time applies, or the catalog rate for deposits made before the first version,
+// unless the station's configuration sets its own rate for the material. The
+// price is zero for materials that are not active.
+func priceDeposit(stationID int, material string, weight database.Grams, count int, at time.Time) depositPrice {
+	var price depositPrice
+	catalog, active := activeMaterial(material)
+	if !active {
+		return price
+	}
+
+	price.BaseRate = catalog.Rate
+	if version, err := rateVersionAt(material, at); err == nil {
+		price.RateVersionID = &version.ID
+		price.BaseRate = version.Rate
+	}
+
+	price.Rate = price.BaseRate
+	if rate, exists := stationConfigOrDefault(stationID).MaterialRates[material]; exists {
+		price.Rate = rate
+	}
+	price.Multiplier = 1
+	if price.BaseRate > 0 {
+		price.Multiplier = math.Round(float64(price.Rate)/float64(price.BaseRate)*10000) / 10000
+	}
+	if catalog.Unit == unitItem {
+		price.MilliPoints = int64(count) * int64(price.Rate) * milliPerPoint
+	} else {
+		price.MilliPoints = milliPointsFor(price.Rate, weight)
+	}
+	price.Points = int(roundMilliPoints(price.MilliPoints, pointsRoundingMode()))
+	return price
+}
+
+// explainCredit describes how a deposit's points were calculated, or why
+// staff adjusted a balance
+func explainCredit(tx database.Transaction) string {
+	if tx.Type == "adjustment" {
+		return fmt.Sprintf("Adjustment of %+d points by staff: %s", tx.PointsEarned, tx.Reason)
+	}
+	if tx.Type != "deposit" || tx.Rate == nil {
+		return ""
+	}
+
+	var explanation string
+	if tx.ItemCount != nil {
+		explanation = fmt.Sprintf("%d x %s at %d points per item", *tx.ItemCount, tx.ItemType, *tx.Rate)
+	} else {
+		explanation = fmt.Sprintf("%g kg of %s at %d points per kg", tx.Weight.Kg(), tx.ItemType, *tx.Rate)
+	}
+	if tx.RateVersionID != nil {
+		explanation += fmt.Sprintf(" (rate version %d", *tx.RateVersionID)
+	} else {
+		explanation += " (catalog rate, no rate version"
+	}
+	if tx.RateMultiplier != nil && *tx.RateMultiplier != 1 {
+		explanation += fmt.Sprintf(", station rate x%g", *tx.RateMultiplier)
+	}
+	explanation += ")"
+	switch tx.ReviewStatus {
+	case reviewHeld:
+		return fmt.Sprintf("%s, held for review; no points credited yet", explanation)
+	case reviewRejected:
+		return fmt.Sprintf("%s, rejected on review; no points credited", explanation)
+	}
+	if tx.ExactPoints != nil && *tx.ExactPoints != float64(tx.PointsEarned) {
+		return fmt.Sprintf("%s = %g points, %d credited after rounding and carry-over",
+			explanation, *tx.ExactPoints, tx.PointsEarned)
+	}
+	return fmt.Sprintf("%s = %d points", explanation, tx.PointsEarned)
+}
+
+// insertRateVersionTx adds a rate version starting at from. The version
+// before it is closed at from, and the new version ends where the next
+// scheduled one begins, so a material's versions never overlap.
+func insertRateVersionTx(tx *sql.Tx, material string, rate int, from time.Time, comment string, createdBy int) (int64, error) {
+	from = from.UTC()
+
+	var exists int
+	tx.QueryRow("SELECT COUNT(*) FROM material_rates WHERE material = ? AND effective_from = ?", material, from).Scan(&exists)
+	if exists > 0 {
+		return 0, errRateVersionExists
+	}
+
+	var effectiveTo interface{}
+	var next time.Time
+	err := tx.QueryRow(`
+		SELECT effective_from FROM material_rates
+		WHERE material = ? AND effective_from > ?
+		ORDER BY effective_from ASC LIMIT 1
+	`, material, from).Scan(&next)
+	switch {
+	case err == nil:
+		effectiveTo = next
+	case err != sql.ErrNoRows:
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE material_rates SET effective_to = ?
+		WHERE id = (
+			SELECT id FROM material_rates
+			WHERE material = ? AND effective_from < ?
+			ORDER BY effective_from DESC LIMIT 1
+		)
+	`, from, material, from)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO material_rates (material, rate, effective_from, effective_to, comment, created_by)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, material, rate, from, effectiveTo, comment, createdBy)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// listMaterialRates lists a material's rate versions, newest first
+func listMaterialRates(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+	if _, found := lookupMaterial(code); !found {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Material not found",
+		})
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT `+rateVersionColumns+` FROM material_rates
+		WHERE material = ?
+		ORDER BY effective_from DESC
+	`, code)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve rates",
+		})
+		return
+	}
+	defer rows.Close()
+
+	versions := []database.MaterialRate{}
+	for rows.Next() {
+		version, err := scanRateVersion(rows)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    versions,
+	})
+}
+
+// scheduleMaterialRate adds a rate version taking effect now or at a future time
+func scheduleMaterialRate(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+	code := chi.URLParam(r, "code")
+	if _, found := lookupMaterial(code); !found {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Material not found",
+		})
+		return
+	}
+
+	var req MaterialRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+	if req.Rate <= 0 {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "rate must be positive",
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	from := now
+	if req.EffectiveFrom != nil {
+		from = req.EffectiveFrom.UTC()
+		if from.Before(now) {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "effective_from must not be in the past",
+			})
+			return
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to schedule rate",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	id, err := insertRateVersionTx(tx, code, req.Rate, from, strings.TrimSpace(req.Comment), userID)
+	if err == errRateVersionExists {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "A rate version already starts at this time",
+		})
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to schedule rate",
+		})
+		return
+	}
+	materialCatalog.invalidate()
+	if !from.After(now) {
+		notifyConfigChanged(globalConfigScope)
+	}
+
+	version, _ := scanRateVersion(database.DB.QueryRow(
+		"SELECT "+rateVersionColumns+" FROM material_rates WHERE id = ?", id))
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Rate scheduled",
+		Data:    version,
+	})
+}
+
+// cancelMaterialRate removes a rate version that has not taken effect yet.
+// The version before it is extended to cover its period.
+func cancelMaterialRate(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+	rateID, err := strconv.Atoi(chi.URLParam(r, "rateID"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid rate ID",
+		})
+		return
+	}
+
+	version, err := scanRateVersion(database.DB.QueryRow(
+		"SELECT "+rateVersionColumns+" FROM material_rates WHERE id = ? AND material = ?", rateID, code))
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Rate version not found",
+		})
+		return
+	}
+	if !version.EffectiveFrom.After(time.Now().UTC()) {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Rate version has already taken effect",
+		})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to cancel rate",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE material_rates SET effective_to = ?
+		WHERE material = ? AND effective_to = ?
+	`, version.EffectiveTo, code, version.EffectiveFrom)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM material_rates WHERE id = ?", rateID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to cancel rate",
+		})
+		return
+	}
+	materialCatalog.invalidate()
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Rate cancelled",
+	})
+}
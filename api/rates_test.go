@@ -0,0 +1,44 @@
+package api
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"t2cbackend/database"
+)
+
+// Deposits weighed before a material's first rate version are priced and
+// explained with the catalog rate, not the first version
+func TestRateVersionBeforeFirst(t *testing.T) {
+	openTestDB(t)
+	before := time.Now().AddDate(-1, 0, 0)
+
+	if _, err := rateVersionAt("plastic", before); err != sql.ErrNoRows {
+		t.Fatalf("rateVersionAt before first version: err = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := rateVersionAt("plastic", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("rateVersionAt now: %v", err)
+	}
+
+	price := priceDeposit(1, "plastic", 1500, 0, before)
+	if price.RateVersionID != nil {
+		t.Errorf("RateVersionID = %d, want nil", *price.RateVersionID)
+	}
+	catalog, _ := activeMaterial("plastic")
+	if price.BaseRate != catalog.Rate {
+		t.Errorf("BaseRate = %d, want catalog rate %d", price.BaseRate, catalog.Rate)
+	}
+
+	explanation := explainCredit(database.Transaction{
+		Type:         "deposit",
+		ItemType:     "plastic",
+		Weight:       1500,
+		Rate:         &price.Rate,
+		PointsEarned: price.Points,
+	})
+	if !strings.Contains(explanation, "no rate version") || strings.Contains(explanation, "rate version 1") {
+		t.Errorf("explanation = %q, want the catalog rate without a version", explanation)
+	}
+}
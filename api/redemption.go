@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"t2cbackend/database"
 	"net/http"
-	"time"
 )
 
 // RedeemRequest represents a redemption request
@@ -103,8 +102,8 @@ func redeemPoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calculate cash amount (100 points = Rp 1,000)
-	amountCash := float64(req.Points) * 10.0
+	// Calculate cash amount in whole rupiah (100 points = Rp 1,000)
+	amountCash := pointsToRupiah(req.Points)
 
 	// Begin transaction
 	tx, err := database.DB.Begin()
@@ -131,27 +130,22 @@ func redeemPoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Deduct points from user
-	_, err = tx.Exec("UPDATE users SET total_points = total_points - ?, updated_at = ? WHERE id = ?",
-		req.Points, time.Now(), userID)
-	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, Response{
+	redemptionID, _ := result.LastInsertId()
+
+	// Deduct points from the user; they are owed as a payout until it is made
+	err = postPointsTx(tx, ledgerPosting{UserID: userID, Points: -req.Points, Account: accountRedemption,
+		Kind: journalRedemption, Reference: "redemption", ReferenceID: redemptionID})
+	if err == errNegativeBalance {
+		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Failed to update points",
+			Error:   "Insufficient points",
 		})
 		return
 	}
-
-	// Create corresponding transaction record
-	_, err = tx.Exec(`
-		INSERT INTO transactions (user_id, type, amount, item_type, weight, points_earned, station_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, userID, "redemption", amountCash, "redemption", 0, -req.Points, 1)
-
 	if err != nil {
 		respondJSON(w, http.StatusInternalServerError, Response{
 			Success: false,
-			Error:   "Failed to record transaction",
+			Error:   "Failed to update points",
 		})
 		return
 	}
@@ -164,8 +158,6 @@ func redeemPoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	redemptionID, _ := result.LastInsertId()
-
 	// Get updated points
 	var newTotalPoints int
 	database.DB.QueryRow("SELECT total_points FROM users WHERE id = ?", userID).Scan(&newTotalPoints)
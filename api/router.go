@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"t2cbackend/database"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -40,8 +41,8 @@ func SetupRouter() *chi.Mux {
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Station-Key", "Idempotency-Key"},
+		ExposedHeaders:   []string{"Link", "Idempotent-Replayed"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -56,6 +57,8 @@ func SetupRouter() *chi.Mux {
 		r.Post("/verify-token", verifyToken)
 		r.Post("/logout", logout)
 		r.Post("/register", register)
+		r.Post("/otp/request", requestOTP)
+		r.Post("/otp/verify", verifyOTP)
 	})
 
 	// Session management routes (public for station use)
@@ -64,6 +67,154 @@ func SetupRouter() *chi.Mux {
 		r.Post("/check", checkSession)
 		r.Post("/connect", connectSession)
 		r.Post("/end", endSession)
+
+		// Card login and guest mode (require station authentication)
+		r.Group(func(r chi.Router) {
+			r.Use(stationAuthMiddleware)
+			r.Post("/card", cardSession)
+			r.Post("/guest", requestGuestSession)
+			r.Post("/guest/deposit", guestDeposit)
+			r.Post("/guest/end", endGuestSession)
+		})
+	})
+
+	// Station registry (public for the app and map)
+	r.Get("/api/stations", listStations)
+	r.Get("/api/stations/nearby", getNearbyStations)
+	r.Get("/api/stations/geojson", getStationsGeoJSON)
+	r.Get("/api/stations/{id}", getStation)
+	r.Get("/api/stations/{id}/status", getStationStatus)
+	r.Get("/api/stations/{id}/history", getStationStatusHistory)
+	r.Get("/api/stations/{id}/config", getStationConfig)
+	r.Get("/api/stations/{id}/schedule", getStationSchedule)
+
+	// Material catalog (public)
+	r.Get("/api/materials", listMaterials)
+
+	// Station hardware routes (require station authentication)
+	r.Group(func(r chi.Router) {
+		r.Use(stationAuthMiddleware)
+		r.Post("/api/station/telemetry", ingestTelemetry)
+		r.Post("/api/station/heartbeat", stationHeartbeat)
+		r.Post("/api/station/sync", syncOfflineDeposits)
+		r.With(stationIdempotencyMiddleware).Post("/api/station/deposit", processDeposit)
+	})
+
+	// Admin routes
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(authMiddleware)
+		r.Use(adminMiddleware)
+
+		// Station management
+		r.Post("/stations", createStation)
+		r.Put("/stations/{id}", updateStation)
+		r.Delete("/stations/{id}", deleteStation)
+		r.Post("/stations/{id}/rotate-key", rotateStationKey)
+		r.Get("/config", getConfigHistory)
+		r.Put("/config", updateConfig)
+		r.Post("/config/rollback", rollbackConfig)
+		r.Get("/stations/{id}/config", getConfigHistory)
+		r.Put("/stations/{id}/config", updateConfig)
+		r.Post("/stations/{id}/config/rollback", rollbackConfig)
+
+		// Material catalog
+		r.Get("/materials", listAllMaterials)
+		r.Post("/materials", createMaterial)
+		r.Put("/materials/{code}", updateMaterial)
+		r.Delete("/materials/{code}", deactivateMaterial)
+		r.Get("/materials/{code}/rates", listMaterialRates)
+		r.Post("/materials/{code}/rates", scheduleMaterialRate)
+		r.Delete("/materials/{code}/rates/{rateID}", cancelMaterialRate)
+
+		// Product catalog
+		r.Get("/products", listProducts)
+		r.Post("/products", saveProduct)
+		r.Post("/products/import", importProducts)
+		r.Get("/products/{gtin}", getProduct)
+		r.Put("/products/{gtin}", saveProduct)
+		r.Delete("/products/{gtin}", deleteProduct)
+		r.Get("/reports/brands", getBrandReport)
+
+		// Deposit review
+		r.Get("/reviews", listDepositReviews)
+		r.Post("/reviews/{id}/resolve", resolveDepositReview)
+
+		// Point adjustments
+		r.Get("/adjustments", listAdjustments)
+		r.With(idempotencyMiddleware).Post("/adjustments", createAdjustment)
+		r.Post("/adjustments/{id}/resolve", resolveAdjustment)
+
+		// Remote commands
+		r.Get("/stations/{id}/commands", getStationCommands)
+		r.Post("/stations/{id}/commands", issueStationCommand)
+		r.Post("/stations/{id}/commands/{commandID}/cancel", cancelStationCommand)
+
+		// Offline deposits
+		r.Get("/offline-deposits", listOfflineDeposits)
+		r.Post("/offline-deposits/{id}/resolve", resolveOfflineDeposit)
+
+		// Opening calendar
+		r.Get("/holidays", listHolidays)
+		r.Post("/holidays", createHoliday)
+		r.Delete("/holidays/{id}", deleteHoliday)
+		r.Post("/stations/{id}/closures", createClosure)
+		r.Delete("/stations/{id}/closures/{closureID}", deleteClosure)
+
+		// Points ledger
+		r.Get("/ledger/accounts", getLedgerAccounts)
+		r.Get("/ledger/users/{id}", getUserLedger)
+		r.Post("/ledger/reconcile", runLedgerReconciliation)
+		r.Get("/ledger/reconciliations", listLedgerReconciliations)
+
+		// Membership cards
+		r.Post("/cards/{id}/unblock", unblockCard)
+		r.Delete("/cards/{id}", deleteCard)
+
+		// Users and maintenance
+		r.Put("/users/{id}/role", setUserRole)
+		r.Get("/technicians", listTechnicians)
+		r.Put("/maintenance/tickets/{id}/assign", assignTicket)
+		r.Get("/maintenance/reliability", getReliabilityReport)
+		r.Get("/scales/deviations", getScaleDeviations)
+
+		// Collection planning
+		r.Get("/collections/due", getCollectionsDue)
+		r.Get("/stations/{id}/forecast", getStationForecast)
+		r.Get("/haulers", listHaulers)
+		r.Post("/collections/runs", createCollectionRun)
+		r.Post("/collections/runs/{id}/cancel", cancelCollectionRun)
+		r.Get("/collections/discrepancies", getCollectionDiscrepancies)
+	})
+
+	// Collection routes (haulers and admins)
+	r.Route("/api/collections", func(r chi.Router) {
+		r.Use(authMiddleware)
+		r.Use(haulerMiddleware)
+
+		r.Get("/runs", listCollectionRuns)
+		r.Get("/runs/{id}", getCollectionRun)
+		r.Post("/runs/{id}/start", startCollectionRun)
+		r.Post("/runs/{id}/stops/{stationID}/pickup", recordPickup)
+		r.Post("/runs/{id}/stops/{stationID}/skip", skipCollectionStop)
+		r.Post("/runs/{id}/complete", completeCollectionRun)
+		r.Post("/runs/{id}/depot-weights", recordDepotWeights)
+	})
+
+	// Maintenance routes (technicians and admins)
+	r.Route("/api/maintenance", func(r chi.Router) {
+		r.Use(authMiddleware)
+		r.Use(technicianMiddleware)
+
+		r.Get("/tickets", listTickets)
+		r.Post("/tickets", createTicket)
+		r.Get("/tickets/{id}", getTicket)
+		r.Post("/tickets/{id}/status", updateTicketStatus)
+		r.Post("/tickets/{id}/notes", addTicketNote)
+		r.Post("/tickets/{id}/parts", addTicketPart)
+		r.Get("/stations/{id}/history", getStationServiceHistory)
+		r.Post("/stations/{id}/empty-bins", emptyStationBins)
+		r.Get("/stations/{id}/calibrations", listCalibrations)
+		r.Post("/stations/{id}/calibrations", createCalibration)
 	})
 
 	// Protected routes
@@ -75,33 +226,61 @@ func SetupRouter() *chi.Mux {
 		r.Get("/api/user/stats", getUserStats)
 		r.Put("/api/user/profile", updateUserProfile)
 
+		// Membership cards
+		r.Get("/api/user/cards", getUserCards)
+		r.Post("/api/user/cards", registerCard)
+		r.Post("/api/user/cards/{id}/block", blockCard)
+
+		// Account linking
+		r.Post("/api/user/phone", linkPhone)
+		r.Post("/api/user/email", linkEmail)
+
 		// Transactions
 		r.Get("/api/transactions", getTransactions)
-		r.Post("/api/transactions", createTransaction)
 		r.Get("/api/transactions/{id}", getTransactionDetail)
 
 		// Redemptions
 		r.Get("/api/redemption/options", getRedemptionOptions)
-		r.Post("/api/redemption/redeem", redeemPoints)
+		r.With(idempotencyMiddleware).Post("/api/redemption/redeem", redeemPoints)
 		r.Get("/api/redemption/history", getRedemptionHistory)
 
+		// Guest claims
+		r.Post("/api/claims/redeem", redeemClaim)
+
 		// Station management
 		r.Get("/api/station/status", getStationStatus)
-		r.Post("/api/station/deposit", processDeposit)
 		r.Get("/api/station/config", getStationConfig)
 
-		// Session-based deposit (requires auth)
-		r.Post("/api/deposit", deposit)
+		r.Get("/api/deposits/{id}", getDeposit)
+	})
+
+	// Session-based deposit (requires auth; also accepts card session tokens)
+	r.Group(func(r chi.Router) {
+		r.Use(depositAuthMiddleware)
+		r.With(idempotencyMiddleware).Post("/api/deposit", deposit)
+		r.With(idempotencyMiddleware).Post("/api/deposit/batch", batchDeposit)
 	})
 
 	// WebSocket
 	r.Get("/ws", handleWebSocket)
+	r.Get("/ws/station", handleWebSocket)
 
 	return r
 }
 
-// authMiddleware validates JWT tokens
+// authMiddleware validates JWT tokens. Session-limited tokens are refused.
 func authMiddleware(next http.Handler) http.Handler {
+	return tokenAuth(next, false)
+}
+
+// depositAuthMiddleware validates JWT tokens for the deposit routes, which
+// also accept the session-limited tokens issued for card sessions. Handlers
+// check the session with sessionScopeAllows.
+func depositAuthMiddleware(next http.Handler) http.Handler {
+	return tokenAuth(next, true)
+}
+
+func tokenAuth(next http.Handler, allowSessionTokens bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tokenString := r.Header.Get("Authorization")
 		if tokenString == "" {
@@ -138,12 +317,114 @@ func authMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// Session-limited tokens only work for deposits into their session
+		scope, _ := claims["session"].(string)
+		if scope != "" && !allowSessionTokens {
+			respondJSON(w, http.StatusUnauthorized, Response{
+				Success: false,
+				Error:   "Token is limited to a station session",
+			})
+			return
+		}
+
 		// Add user ID to context
 		r.Header.Set("X-User-ID", claims["user_id"].(string))
+		r.Header.Set("X-Session-Scope", scope)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// stationAuthMiddleware validates station API keys
+func stationAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get("X-Station-Key")
+		if apiKey == "" {
+			respondJSON(w, http.StatusUnauthorized, Response{
+				Success: false,
+				Error:   "Station key required",
+			})
+			return
+		}
+
+		var stationID int
+		var status string
+		err := database.DB.QueryRow(
+			"SELECT id, status FROM stations WHERE api_key = ?",
+			apiKey,
+		).Scan(&stationID, &status)
+
+		if err != nil {
+			respondJSON(w, http.StatusUnauthorized, Response{
+				Success: false,
+				Error:   "Invalid station key",
+			})
+			return
+		}
+
+		if status == "disabled" {
+			respondJSON(w, http.StatusForbidden, Response{
+				Success: false,
+				Error:   "Station is disabled",
+			})
+			return
+		}
+
+		// Add station ID to context
+		r.Header.Set("X-Station-ID", strconv.Itoa(stationID))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireRole restricts routes to users with one of the given roles. It must
+// run after authMiddleware.
+func requireRole(message string, roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := getUserIDFromHeader(r)
+			if err != nil {
+				respondJSON(w, http.StatusUnauthorized, Response{
+					Success: false,
+					Error:   "Invalid user",
+				})
+				return
+			}
+
+			role := userRole(userID)
+			allowed := false
+			for _, allowedRole := range roles {
+				if role == allowedRole {
+					allowed = true
+				}
+			}
+			if !allowed {
+				respondJSON(w, http.StatusForbidden, Response{
+					Success: false,
+					Error:   message,
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// userRole returns a user's role, or an empty string if the user does not exist
+func userRole(userID int) string {
+	var role string
+	database.DB.QueryRow("SELECT COALESCE(role, 'user') FROM users WHERE id = ?", userID).Scan(&role)
+	return role
+}
+
+// adminMiddleware restricts routes to admin users
+var adminMiddleware = requireRole("Admin access required", "admin")
+
+// technicianMiddleware restricts routes to technicians and admins
+var technicianMiddleware = requireRole("Technician access required", "technician", "admin")
+
+// haulerMiddleware restricts routes to haulers and admins
+var haulerMiddleware = requireRole("Hauler access required", "hauler", "admin")
+
 // Helper functions
 func respondJSON(w http.ResponseWriter, status int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -156,6 +437,17 @@ func getUserIDFromHeader(r *http.Request) (int, error) {
 	return strconv.Atoi(userIDStr)
 }
 
+func getStationIDFromHeader(r *http.Request) (int, error) {
+	stationIDStr := r.Header.Get("X-Station-ID")
+	return strconv.Atoi(stationIDStr)
+}
+
+// sqliteTime formats a time like CURRENT_TIMESTAMP so it can be compared
+// against columns filled by SQLite defaults
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
 func hashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	return string(bytes), err
@@ -174,6 +466,24 @@ func generateJWT(userID int) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
+// generateSessionJWT issues a token that can only make deposits into one
+// station session and expires with it
+func generateSessionJWT(userID int, sessionToken string, expiresAt time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": strconv.Itoa(userID),
+		"session": sessionToken,
+		"exp":     expiresAt.Unix(),
+	})
+	return token.SignedString(jwtSecret)
+}
+
+// sessionScopeAllows reports whether the caller's token may be used for the
+// given station session. Full user tokens may be used for any session.
+func sessionScopeAllows(r *http.Request, sessionToken string) bool {
+	scope := r.Header.Get("X-Session-Scope")
+	return scope == "" || scope == sessionToken
+}
+
 func verifyJWT(tokenString string) (int, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
@@ -192,6 +502,9 @@ func verifyJWT(tokenString string) (int, error) {
 	if !ok {
 		return 0, jwt.ErrInvalidKey
 	}
+	if _, scoped := claims["session"]; scoped {
+		return 0, jwt.ErrInvalidKey
+	}
 
 	return strconv.Atoi(userIDStr)
 }
@@ -207,22 +520,3 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 		},
 	})
 }
-
-// WebSocket handler
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		return
-	}
-	defer conn.Close()
-
-	for {
-		messageType, p, err := conn.ReadMessage()
-		if err != nil {
-			return
-		}
-		if err := conn.WriteMessage(messageType, p); err != nil {
-			return
-		}
-	}
-}
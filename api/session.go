@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -38,11 +39,91 @@ type EndSessionRequest struct {
 	SessionToken string `json:"sessionToken"`
 }
 
+// Errors returned by loadDepositSession
+var (
+	errSessionNotLinked = errors.New("session not linked to this user")
+	errSessionNotActive = errors.New("session is not active")
+	errSessionExpired   = errors.New("session has expired")
+)
+
+// loadDepositSession checks that a station session can take deposits from
+// the user: it is linked to them, connected or active, and not expired. It
+// returns the session's ID and station.
+func loadDepositSession(q rowQuerier, sessionToken string, userID int) (int, string, error) {
+	var sessionID int
+	var sessionUserID sql.NullInt64
+	var status, sessionStation string
+	var expiresAt time.Time
+
+	err := q.QueryRow(
+		"SELECT id, user_id, status, station_id, expires_at FROM station_sessions WHERE session_token = ?",
+		sessionToken,
+	).Scan(&sessionID, &sessionUserID, &status, &sessionStation, &expiresAt)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if !sessionUserID.Valid || int(sessionUserID.Int64) != userID {
+		return 0, "", errSessionNotLinked
+	}
+	if status != "connected" && status != "active" {
+		return 0, "", errSessionNotActive
+	}
+	if time.Now().After(expiresAt) {
+		return 0, "", errSessionExpired
+	}
+	return sessionID, sessionStation, nil
+}
+
+// respondDepositSessionError maps loadDepositSession errors to API responses
+func respondDepositSessionError(w http.ResponseWriter, err error) {
+	switch err {
+	case errSessionNotLinked:
+		respondJSON(w, http.StatusForbidden, Response{
+			Success: false,
+			Error:   "Session not linked to this user",
+		})
+	case errSessionNotActive:
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Session has ended",
+		})
+	case errSessionExpired:
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Session has expired",
+		})
+	default:
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Session not found",
+		})
+	}
+}
+
 // SessionDepositRequest represents a deposit request during active session
 type SessionDepositRequest struct {
-	Material     string  `json:"material"`
-	Weight       float64 `json:"weight"`
-	SessionToken string  `json:"sessionToken"`
+	Material        string         `json:"material"`
+	Weight          database.Grams `json:"weight"`
+	Count           int            `json:"count,omitempty"`           // counted materials
+	ContainerSizeML int            `json:"containerSizeMl,omitempty"` // counted materials
+	Barcode         string         `json:"barcode,omitempty"`         // sets the material for catalogued products
+	SessionToken    string         `json:"sessionToken"`
+}
+
+// amount returns what the station measured for the deposit
+func (req SessionDepositRequest) amount() depositAmount {
+	return depositAmount{Weight: req.Weight, Count: req.Count, ContainerSizeML: req.ContainerSizeML}
+}
+
+// classify resolves the deposit's material from its barcode and fills in
+// the container size of catalogued products
+func (req *SessionDepositRequest) classify() (productMatch, error) {
+	amount := req.amount()
+	match, err := classifyDeposit(req.Material, req.Barcode, &amount)
+	req.Material = match.Material
+	req.ContainerSizeML = amount.ContainerSizeML
+	return match, err
 }
 
 // requestSession creates a new station session and generates QR code
@@ -66,7 +147,7 @@ func requestSession(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Creating new session: token=%s, station=%s", sessionToken, req.StationID)
 
-	// Set expiration time (5 minutes from now)
+	// Set expiration time (5 minutes from now, or the station's configured timeout)
 	expiresAt := time.Now().Add(5 * time.Minute)
 
 	// Insert session into database
@@ -75,6 +156,21 @@ func requestSession(w http.ResponseWriter, r *http.Request) {
 		stationID = "default"
 	}
 
+	// Numeric station IDs must refer to a registered station that is open.
+	// Other sessions deposit at the default station, so its hours apply.
+	if id, err := strconv.Atoi(stationID); err == nil {
+		if _, err := loadOpenStation(id); err != nil {
+			respondStationError(w, err)
+			return
+		}
+		expiresAt = stationSessionExpiry(id)
+	} else if station, err := loadStation(defaultStationID); err == nil {
+		if err := checkStationOpen(station, time.Now().UTC()); err != nil {
+			respondStationError(w, err)
+			return
+		}
+	}
+
 	res, err := database.DB.Exec(
 		"INSERT INTO station_sessions (session_token, station_id, status, expires_at) VALUES (?, ?, ?, ?)",
 		sessionToken, stationID, "pending", expiresAt.Format(time.RFC3339),
@@ -214,7 +310,7 @@ func checkSession(w http.ResponseWriter, r *http.Request) {
 	var user database.User
 	uid := int(userID.Int64)
 	err = database.DB.QueryRow(
-		"SELECT id, email, name, total_points FROM users WHERE id = ?",
+		"SELECT id, COALESCE(email, ''), name, total_points FROM users WHERE id = ?",
 		uid,
 	).Scan(&user.ID, &user.Email, &user.Name, &user.TotalPoints)
 
@@ -328,6 +424,15 @@ func connectSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Guest sessions accrue points to a claim code instead of a user
+	if status == "guest" {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Session is a guest session",
+		})
+		return
+	}
+
 	// Check if session is already connected
 	if existingUserID.Valid {
 		respondJSON(w, http.StatusConflict, Response{
@@ -430,51 +535,62 @@ func deposit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate input
-	if req.Material == "" || req.Weight <= 0 || req.SessionToken == "" {
+	if (req.Material == "" && req.Barcode == "") || req.SessionToken == "" {
 		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Material, weight, and session token are required",
+			Error:   "Material or barcode and session token are required",
 		})
 		return
 	}
-
-	// Verify session is active and linked to the user
-	var sessionID int
-	var sessionUserID sql.NullInt64
-	var status string
-
-	err = database.DB.QueryRow(
-		"SELECT id, user_id, status FROM station_sessions WHERE session_token = ?",
-		req.SessionToken,
-	).Scan(&sessionID, &sessionUserID, &status)
-
+	match, err := req.classify()
 	if err != nil {
-		respondJSON(w, http.StatusNotFound, Response{
+		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Session not found",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validateDepositAmount(req.Material, req.amount()); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
 		})
 		return
 	}
 
-	// Verify session belongs to the authenticated user
-	if !sessionUserID.Valid || int(sessionUserID.Int64) != userID {
+	if !sessionScopeAllows(r, req.SessionToken) {
 		respondJSON(w, http.StatusForbidden, Response{
 			Success: false,
-			Error:   "Session not linked to this user",
+			Error:   "Token is not valid for this session",
 		})
 		return
 	}
 
-	// Calculate points based on material and weight
-	points := CalculatePoints(req.Material, req.Weight)
-	if points == 0 {
+	// Verify session is active and linked to the user
+	sessionID, sessionStation, err := loadDepositSession(database.DB, req.SessionToken, userID)
+	if err != nil {
+		respondDepositSessionError(w, err)
+		return
+	}
+
+	// Deposits are credited to the station the session was started at
+	station, err := loadStationForDeposit(sessionStationID(sessionStation), req.Material, req.amount().quantity(req.Material))
+	if err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	// Calculate points from the calibrated weight and the station's rates
+	weight := depositWeight(station.ID, req.Material, req.amount(), match, time.Now())
+	if err := match.checkWeight(req.amount(), weight); err != nil {
 		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Invalid material type",
+			Error:   err.Error(),
 		})
 		return
 	}
-
+	price := priceDeposit(station.ID, req.Material, weight, req.Count, time.Now())
+	itemCount, containerSize := req.amount().countColumns(req.Material)
 	// Begin database transaction
 	tx, err := database.DB.Begin()
 	if err != nil {
@@ -486,11 +602,34 @@ func deposit(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	// Score the deposit inside the transaction, so deposits made at the same
+	// time count against each other's limits
+	assessment := scoreDeposit(tx, fraudCheck{UserID: userID, Station: station, Material: req.Material, Weight: weight,
+		RawWeight: req.Weight, Quantity: req.amount().quantity(req.Material), Points: price.Points, At: time.Now()})
+
+	// Credit the points, carrying any fraction of a point to the next deposit.
+	// Deposits held for review are credited if an admin approves them.
+	points := 0
+	if !assessment.Held {
+		points, err = creditPointsTx(tx, userID, price.MilliPoints)
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update user balance",
+		})
+		return
+	}
+
 	// Insert transaction record
 	result, err := tx.Exec(`
-		INSERT INTO transactions (user_id, type, item_type, weight, points_earned, station_id, session_token)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, userID, "deposit", req.Material, req.Weight, points, 1, req.SessionToken)
+		INSERT INTO transactions (user_id, type, item_type, weight_grams, raw_weight_grams, points_earned, station_id, session_token,
+			rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, barcode, brand,
+			fraud_score, review_status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, "deposit", req.Material, weight, req.Weight, points, station.ID, req.SessionToken,
+		price.RateVersionID, price.Rate, price.Multiplier, price.MilliPoints, itemCount, containerSize,
+		match.Barcode, match.Brand, assessment.Score, assessment.reviewStatus())
 
 	if err != nil {
 		respondJSON(w, http.StatusInternalServerError, Response{
@@ -501,12 +640,18 @@ func deposit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	transactionID, _ := result.LastInsertId()
+	if assessment.Held {
+		if err = recordReviewTx(tx, transactionID, userID, station.ID, assessment); err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to queue deposit for review",
+			})
+			return
+		}
+	}
 
-	// Update user points
-	_, err = tx.Exec(
-		"UPDATE users SET total_points = total_points + ?, updated_at = ? WHERE id = ?",
-		points, time.Now(), userID,
-	)
+	err = postPointsTx(tx, ledgerPosting{UserID: userID, Points: points, Account: accountIssuance,
+		Kind: journalDeposit, Reference: "transaction", ReferenceID: transactionID})
 	if err != nil {
 		respondJSON(w, http.StatusInternalServerError, Response{
 			Success: false,
@@ -540,7 +685,8 @@ func deposit(w http.ResponseWriter, r *http.Request) {
 	var newBalance int
 	database.DB.QueryRow("SELECT total_points FROM users WHERE id = ?", userID).Scan(&newBalance)
 
-	log.Printf("Deposit recorded: user=%d, material=%s, weight=%.2f, points=%d", userID, req.Material, req.Weight, points)
+	log.Printf("Deposit recorded: user=%d, material=%s, weight=%.3f (raw %.3f), points=%d",
+		userID, req.Material, weight.Kg(), req.Weight.Kg(), points)
 
 	respondJSON(w, http.StatusOK, Response{
 		Success: true,
@@ -549,6 +695,7 @@ func deposit(w http.ResponseWriter, r *http.Request) {
 			"newBalance":    newBalance,
 			"pointsEarned":  points,
 			"transactionId": transactionID,
+			"heldForReview": assessment.Held,
 		},
 	})
 }
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"t2cbackend/database"
+)
+
+func TestLoadDepositSession(t *testing.T) {
+	openTestDB(t)
+	now := time.Now()
+	sessions := []struct {
+		token   string
+		status  string
+		expires time.Time
+	}{
+		{"live", "connected", now.Add(time.Hour)},
+		{"ended", "expired", now.Add(time.Hour)},
+		{"stale", "active", now.Add(-time.Minute)},
+	}
+	for _, s := range sessions {
+		_, err := database.DB.Exec(
+			"INSERT INTO station_sessions (session_token, station_id, user_id, status, expires_at) VALUES (?, ?, ?, ?, ?)",
+			s.token, "1", 2, s.status, s.expires.Format(time.RFC3339),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		token  string
+		userID int
+		want   error
+	}{
+		{"live", 2, nil},
+		{"live", 1, errSessionNotLinked},
+		{"ended", 2, errSessionNotActive},
+		{"stale", 2, errSessionExpired},
+	}
+	for _, tt := range tests {
+		_, station, err := loadDepositSession(database.DB, tt.token, tt.userID)
+		if err != tt.want {
+			t.Errorf("loadDepositSession(%q, %d) error = %v, want %v", tt.token, tt.userID, err, tt.want)
+		}
+		if err == nil && station != "1" {
+			t.Errorf("loadDepositSession(%q) station = %q, want \"1\"", tt.token, station)
+		}
+	}
+}
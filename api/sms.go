@@ -0,0 +1,24 @@
+package api
+
+import "log"
+
+// SMSSender delivers text messages to phone numbers
+type SMSSender interface {
+	Send(phone, message string) error
+}
+
+// LogSMSSender prints messages to the server log in place of an SMS gateway
+type LogSMSSender struct{}
+
+// Send logs the message
+func (LogSMSSender) Send(phone, message string) error {
+	log.Printf("SMS to %s: %s", phone, message)
+	return nil
+}
+
+var smsSender SMSSender = LogSMSSender{}
+
+// SetSMSSender replaces the sender used for one-time codes
+func SetSMSSender(sender SMSSender) {
+	smsSender = sender
+}
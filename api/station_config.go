@@ -0,0 +1,605 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// globalConfigScope is the station_id under which global configuration versions are stored
+const globalConfigScope = 0
+
+// Session timeout limits for station configuration, in seconds
+const (
+	minSessionTimeoutSeconds = 60
+	maxSessionTimeoutSeconds = 30 * 60
+)
+
+var errMaterialNotAccepted = errors.New("material not accepted at this station")
+
+// supportedUILanguages lists the languages station screens are translated into
+var supportedUILanguages = map[string]bool{"en": true, "id": true}
+
+// effectiveConfig is a station's configuration after applying its overrides
+type effectiveConfig struct {
+	Config         database.StationConfig `json:"config"`
+	GlobalVersion  int                    `json:"global_version"`
+	StationVersion int                    `json:"station_version"`
+}
+
+// ConfigUpdateRequest represents a new configuration version
+type ConfigUpdateRequest struct {
+	Document json.RawMessage `json:"document"`
+	Comment  string          `json:"comment"`
+}
+
+// ConfigRollbackRequest represents a rollback to an earlier version
+type ConfigRollbackRequest struct {
+	Version int    `json:"version"`
+	Comment string `json:"comment"`
+}
+
+// defaultStationConfig is used until an admin saves a global configuration
+func defaultStationConfig() database.StationConfig {
+	hours := make(map[string]string, len(operatingHours))
+	for key, value := range operatingHours {
+		hours[key] = value
+	}
+	return database.StationConfig{
+		AcceptedMaterials:     supportedMaterials(),
+		MaterialRates:         map[string]int{}, // catalog rates apply
+		OperatingHours:        hours,
+		UILanguage:            "en",
+		SessionTimeoutSeconds: 300,
+		PointsRounding:        roundFloor,
+		FraudReviewThreshold:  defaultFraudReviewThreshold,
+
+		AdjustmentApprovalPoints: defaultAdjustmentApprovalPoints,
+	}
+}
+
+// latestConfigVersion returns the newest version for a scope, or nil if none exist
+func latestConfigVersion(scope int) (*database.ConfigVersion, error) {
+	return loadConfigVersion(scope, 0)
+}
+
+// loadConfigVersion returns a specific version for a scope, or the newest
+// version when version is 0. It returns nil if no such version exists.
+func loadConfigVersion(scope, version int) (*database.ConfigVersion, error) {
+	query := `
+		SELECT id, station_id, version, document, COALESCE(comment, ''), COALESCE(created_by, 0), created_at
+		FROM config_versions WHERE station_id = ?`
+	args := []interface{}{scope}
+	if version > 0 {
+		query += " AND version = ?"
+		args = append(args, version)
+	}
+	query += " ORDER BY version DESC LIMIT 1"
+
+	var v database.ConfigVersion
+	var document string
+	err := database.DB.QueryRow(query, args...).Scan(&v.ID, &v.StationID, &v.Version,
+		&document, &v.Comment, &v.CreatedBy, &v.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.Document = json.RawMessage(document)
+	return &v, nil
+}
+
+// globalStationConfig returns the current global configuration and its version
+func globalStationConfig() (database.StationConfig, int, error) {
+	cfg := defaultStationConfig()
+	latest, err := latestConfigVersion(globalConfigScope)
+	if err != nil || latest == nil {
+		return cfg, 0, err
+	}
+	if err := json.Unmarshal(latest.Document, &cfg); err != nil {
+		return defaultStationConfig(), 0, err
+	}
+	return cfg, latest.Version, nil
+}
+
+// applyConfigOverride merges a station's overrides into a copy of the global configuration
+func applyConfigOverride(global database.StationConfig, override database.StationConfigOverride) database.StationConfig {
+	cfg := global
+	cfg.MaterialRates = make(map[string]int, len(global.MaterialRates))
+	for material, rate := range global.MaterialRates {
+		cfg.MaterialRates[material] = rate
+	}
+	cfg.OperatingHours = make(map[string]string, len(global.OperatingHours))
+	for key, value := range global.OperatingHours {
+		cfg.OperatingHours[key] = value
+	}
+
+	if override.AcceptedMaterials != nil {
+		cfg.AcceptedMaterials = override.AcceptedMaterials
+	}
+	for material, rate := range override.MaterialRates {
+		cfg.MaterialRates[material] = rate
+	}
+	for key, value := range override.OperatingHours {
+		cfg.OperatingHours[key] = value
+	}
+	if override.UILanguage != nil {
+		cfg.UILanguage = *override.UILanguage
+	}
+	if override.SessionTimeoutSeconds != nil {
+		cfg.SessionTimeoutSeconds = *override.SessionTimeoutSeconds
+	}
+	return cfg
+}
+
+// effectiveStationConfig returns the configuration a station should run with
+func effectiveStationConfig(stationID int) (effectiveConfig, error) {
+	global, globalVersion, err := globalStationConfig()
+	if err != nil {
+		return effectiveConfig{Config: global}, err
+	}
+
+	result := effectiveConfig{Config: global, GlobalVersion: globalVersion}
+
+	latest, err := latestConfigVersion(stationID)
+	if err != nil {
+		return result, err
+	}
+	if latest != nil {
+		var override database.StationConfigOverride
+		if err := json.Unmarshal(latest.Document, &override); err != nil {
+			return result, err
+		}
+		result.Config = applyConfigOverride(global, override)
+		result.StationVersion = latest.Version
+	}
+
+	// Materials retired from the catalog are no longer accepted anywhere
+	result.Config.AcceptedMaterials = activeMaterialCodes(result.Config.AcceptedMaterials)
+	return result, nil
+}
+
+// stationConfigOrDefault returns a station's effective configuration, falling
+// back to the global configuration if it cannot be loaded
+func stationConfigOrDefault(stationID int) database.StationConfig {
+	effective, err := effectiveStationConfig(stationID)
+	if err != nil {
+		log.Printf("Failed to load configuration for station %d: %v", stationID, err)
+	}
+	return effective.Config
+}
+
+// validateStationConfig checks a complete configuration document
+func validateStationConfig(cfg database.StationConfig) error {
+	if len(cfg.AcceptedMaterials) == 0 {
+		return errors.New("accepted_materials must not be empty")
+	}
+	for _, material := range cfg.AcceptedMaterials {
+		if _, active := activeMaterial(material); !active {
+			return fmt.Errorf("unknown or inactive material %q", material)
+		}
+	}
+	// Materials without a rate here earn the catalog rate
+	for material, rate := range cfg.MaterialRates {
+		if _, known := lookupMaterial(material); !known {
+			return fmt.Errorf("unknown material %q in material_rates", material)
+		}
+		if rate <= 0 {
+			return fmt.Errorf("material_rates must set a positive rate for %q", material)
+		}
+	}
+	for _, key := range []string{"weekday", "weekend"} {
+		if _, found := cfg.OperatingHours[key]; !found {
+			return fmt.Errorf("operating_hours.%s is required", key)
+		}
+	}
+	for key, hours := range cfg.OperatingHours {
+		if !validHoursKey(key) {
+			return fmt.Errorf("unknown operating_hours key %q", key)
+		}
+		if _, _, ok := parseHoursRange(hours); !ok && hours != closedAllDay {
+			return fmt.Errorf("operating_hours.%s must be HH:MM-HH:MM or %q", key, closedAllDay)
+		}
+	}
+	if !supportedUILanguages[cfg.UILanguage] {
+		return fmt.Errorf("unsupported ui_language %q", cfg.UILanguage)
+	}
+	if cfg.SessionTimeoutSeconds < minSessionTimeoutSeconds || cfg.SessionTimeoutSeconds > maxSessionTimeoutSeconds {
+		return fmt.Errorf("session_timeout_seconds must be between %d and %d",
+			minSessionTimeoutSeconds, maxSessionTimeoutSeconds)
+	}
+	// Documents saved before rounding was configurable leave it empty
+	if cfg.PointsRounding != "" && !roundingModes[cfg.PointsRounding] {
+		return fmt.Errorf("unsupported points_rounding %q", cfg.PointsRounding)
+	}
+	// Zero, or left out, uses the default threshold
+	if cfg.FraudReviewThreshold < 0 || cfg.FraudReviewThreshold > maxFraudScore {
+		return fmt.Errorf("fraud_review_threshold must be between 0 and %d", maxFraudScore)
+	}
+	// Zero, or left out, uses the default threshold too
+	if cfg.AdjustmentApprovalPoints < 0 {
+		return fmt.Errorf("adjustment_approval_points must not be negative")
+	}
+	return nil
+}
+
+// validHoursKey reports whether key is weekday, weekend or a day name
+func validHoursKey(key string) bool {
+	if key == "weekday" || key == "weekend" {
+		return true
+	}
+	for _, day := range dayNames {
+		if key == day {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConfigDocument parses and validates a document for a scope,
+// returning the normalized JSON to store
+func validateConfigDocument(scope int, document json.RawMessage) ([]byte, error) {
+	if scope == globalConfigScope {
+		var cfg database.StationConfig
+		if err := unmarshalStrict(document, &cfg); err != nil {
+			return nil, err
+		}
+		if err := validateStationConfig(cfg); err != nil {
+			return nil, err
+		}
+		return json.Marshal(cfg)
+	}
+
+	var override database.StationConfigOverride
+	if err := unmarshalStrict(document, &override); err != nil {
+		return nil, err
+	}
+	global, _, err := globalStationConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateStationConfig(applyConfigOverride(global, override)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(override)
+}
+
+// unmarshalStrict decodes JSON and rejects unknown fields
+func unmarshalStrict(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errors.New("document is required")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// saveConfigVersion stores a new version for a scope and notifies stations
+func saveConfigVersion(scope int, document []byte, comment string, userID int) (int, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow(
+		"SELECT COALESCE(MAX(version), 0) + 1 FROM config_versions WHERE station_id = ?",
+		scope,
+	).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO config_versions (station_id, version, document, comment, created_by)
+		VALUES (?, ?, ?, ?, ?)
+	`, scope, version, string(document), comment, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	notifyConfigChanged(scope)
+	return version, nil
+}
+
+// notifyConfigChanged pushes a config-changed message to the affected stations
+// so they fetch the new version. Stations that are not connected pick it up
+// from their next heartbeat.
+func notifyConfigChanged(scope int) {
+	if scope == globalConfigScope {
+		for _, stationID := range hub.stationIDs() {
+			notifyConfigChanged(stationID)
+		}
+		return
+	}
+
+	effective, err := effectiveStationConfig(scope)
+	if err != nil {
+		log.Printf("notifyConfigChanged: failed to load configuration for station %d: %v", scope, err)
+		return
+	}
+	pushToStation(scope, map[string]interface{}{
+		"type":            "config_changed",
+		"global_version":  effective.GlobalVersion,
+		"station_version": effective.StationVersion,
+	})
+}
+
+// configScopeFromRequest returns the station ID from the URL, or the global
+// scope for routes without one
+func configScopeFromRequest(r *http.Request) (int, error) {
+	raw := chi.URLParam(r, "id")
+	if raw == "" {
+		return globalConfigScope, nil
+	}
+	stationID, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := loadStation(stationID); err != nil {
+		return 0, err
+	}
+	return stationID, nil
+}
+
+// getStationConfig retrieves a station's effective configuration
+func getStationConfig(w http.ResponseWriter, r *http.Request) {
+	stationID, err := stationIDFromRequest(r)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	if _, err := loadStation(stationID); err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	effective, err := effectiveStationConfig(stationID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to load station configuration",
+		})
+		return
+	}
+
+	cfg := effective.Config
+	rates := make(map[string]int, len(cfg.AcceptedMaterials))
+	materials := make([]map[string]interface{}, 0, len(cfg.AcceptedMaterials))
+	for _, code := range acceptedMaterialsSorted(cfg) {
+		material, _ := lookupMaterial(code)
+		rate, priced := cfg.MaterialRates[code]
+		if !priced {
+			rate = material.Rate
+		}
+		rates[code] = rate
+		materials = append(materials, map[string]interface{}{
+			"code":         material.Code,
+			"name":         material.Name,
+			"unit":         material.Unit,
+			"rate":         rate,
+			"min_quantity": material.MinQuantity,
+			"max_quantity": material.MaxQuantity,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"station_id":              stationID,
+			"global_version":          effective.GlobalVersion,
+			"station_version":         effective.StationVersion,
+			"material_rates":          rates,
+			"operating_hours":         cfg.OperatingHours,
+			"supported_materials":     cfg.AcceptedMaterials,
+			"materials":               materials,
+			"ui_language":             cfg.UILanguage,
+			"session_timeout_seconds": cfg.SessionTimeoutSeconds,
+		},
+	})
+}
+
+// getConfigHistory lists the saved versions for the global configuration or
+// a station's overrides, newest first
+func getConfigHistory(w http.ResponseWriter, r *http.Request) {
+	scope, err := configScopeFromRequest(r)
+	if err != nil {
+		respondStationError(w, errStationNotFound)
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, station_id, version, document, COALESCE(comment, ''), COALESCE(created_by, 0), created_at
+		FROM config_versions
+		WHERE station_id = ?
+		ORDER BY version DESC
+	`, scope)
+
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve configuration history",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var versions []database.ConfigVersion
+	for rows.Next() {
+		var v database.ConfigVersion
+		var document string
+		err := rows.Scan(&v.ID, &v.StationID, &v.Version, &document, &v.Comment, &v.CreatedBy, &v.CreatedAt)
+		if err != nil {
+			continue
+		}
+		v.Document = json.RawMessage(document)
+		versions = append(versions, v)
+	}
+
+	if versions == nil {
+		versions = []database.ConfigVersion{}
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    versions,
+	})
+}
+
+// updateConfig saves a new version of the global configuration or of a
+// station's overrides
+func updateConfig(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	scope, err := configScopeFromRequest(r)
+	if err != nil {
+		respondStationError(w, errStationNotFound)
+		return
+	}
+
+	var req ConfigUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	document, err := validateConfigDocument(scope, req.Document)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid configuration: " + err.Error(),
+		})
+		return
+	}
+
+	version, err := saveConfigVersion(scope, document, req.Comment, userID)
+	if err != nil {
+		log.Printf("updateConfig: failed to save version: %v", err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to save configuration",
+		})
+		return
+	}
+
+	log.Printf("Configuration saved: scope=%d, version=%d, user=%d", scope, version, userID)
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Configuration saved",
+		Data: map[string]interface{}{
+			"station_id": scope,
+			"version":    version,
+		},
+	})
+}
+
+// rollbackConfig saves a copy of an earlier version as the newest version
+func rollbackConfig(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromHeader(r)
+
+	scope, err := configScopeFromRequest(r)
+	if err != nil {
+		respondStationError(w, errStationNotFound)
+		return
+	}
+
+	var req ConfigRollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version <= 0 {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Version is required",
+		})
+		return
+	}
+
+	target, err := loadConfigVersion(scope, req.Version)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to load configuration version",
+		})
+		return
+	}
+	if target == nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Configuration version not found",
+		})
+		return
+	}
+
+	// An old station override may no longer be valid against today's global config
+	document, err := validateConfigDocument(scope, target.Document)
+	if err != nil {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Version is no longer valid: " + err.Error(),
+		})
+		return
+	}
+
+	comment := req.Comment
+	if comment == "" {
+		comment = fmt.Sprintf("Rollback to version %d", req.Version)
+	}
+
+	version, err := saveConfigVersion(scope, document, comment, userID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to save configuration",
+		})
+		return
+	}
+
+	log.Printf("Configuration rolled back: scope=%d, from=%d, new version=%d", scope, req.Version, version)
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Configuration rolled back",
+		Data: map[string]interface{}{
+			"station_id": scope,
+			"version":    version,
+		},
+	})
+}
+
+// acceptedMaterialsSorted returns a sorted copy of a configuration's accepted materials
+func acceptedMaterialsSorted(cfg database.StationConfig) []string {
+	materials := append([]string(nil), cfg.AcceptedMaterials...)
+	sort.Strings(materials)
+	return materials
+}
+
+// stationSessionExpiry returns when a new session at the station should expire
+func stationSessionExpiry(stationID int) time.Time {
+	timeout := stationConfigOrDefault(stationID).SessionTimeoutSeconds
+	if timeout <= 0 {
+		timeout = 300
+	}
+	return time.Now().Add(time.Duration(timeout) * time.Second)
+}
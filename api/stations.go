@@ -0,0 +1,472 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"t2cbackend/database"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Sessions and deposits that do not name a station belong to the default station
+const defaultStationID = 1
+
+var (
+	errStationNotFound = errors.New("station not found")
+	errStationInactive = errors.New("station is not accepting deposits")
+)
+
+// stationColumns lists the columns scanned by scanStation
+const stationColumns = `id, location, COALESCE(address, ''), latitude, longitude, status, capacity,
+	COALESCE(timezone, 'UTC'), COALESCE(operator, ''), COALESCE(connectivity, 'unknown'), last_heartbeat,
+	last_maintenance, COALESCE(configuration, ''), bins_emptied_at`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// StationRequest represents a station create or update request
+type StationRequest struct {
+	Location  string   `json:"location"`
+	Address   string   `json:"address"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Status    string   `json:"status"`
+	Capacity  int      `json:"capacity"`
+	Timezone  string   `json:"timezone"`
+	Operator  string   `json:"operator"`
+}
+
+// scanStation scans a row selected with stationColumns
+func scanStation(row rowScanner) (database.Station, error) {
+	var station database.Station
+	var latitude, longitude sql.NullFloat64
+	var lastHeartbeat, binsEmptiedAt sql.NullTime
+	err := row.Scan(&station.ID, &station.Location, &station.Address, &latitude, &longitude,
+		&station.Status, &station.Capacity, &station.Timezone, &station.Operator,
+		&station.Connectivity, &lastHeartbeat, &station.LastMaintenance, &station.Configuration,
+		&binsEmptiedAt)
+	if latitude.Valid && longitude.Valid {
+		station.Latitude = &latitude.Float64
+		station.Longitude = &longitude.Float64
+	}
+	if lastHeartbeat.Valid {
+		station.LastHeartbeat = &lastHeartbeat.Time
+	}
+	// Stations never emptied count from when they were installed or serviced
+	station.BinsEmptiedAt = station.LastMaintenance
+	if binsEmptiedAt.Valid {
+		station.BinsEmptiedAt = binsEmptiedAt.Time
+	}
+	return station, err
+}
+
+// loadStation retrieves a station by ID
+func loadStation(id int) (database.Station, error) {
+	station, err := scanStation(database.DB.QueryRow(
+		"SELECT "+stationColumns+" FROM stations WHERE id = ?", id,
+	))
+	if err != nil {
+		return station, errStationNotFound
+	}
+	return station, nil
+}
+
+// loadActiveStation retrieves a station that is accepting deposits
+func loadActiveStation(id int) (database.Station, error) {
+	station, err := loadStation(id)
+	if err != nil {
+		return station, err
+	}
+	if station.Status != "active" {
+		return station, errStationInactive
+	}
+	return station, nil
+}
+
+// respondStationError maps loadStation errors to API responses
+func respondStationError(w http.ResponseWriter, err error) {
+	var closed *stationClosedError
+	if errors.As(err, &closed) {
+		respondStationClosed(w, closed)
+		return
+	}
+	var quantity *materialQuantityError
+	if errors.As(err, &quantity) {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   quantity.Error(),
+		})
+		return
+	}
+
+	switch err {
+	case errStationNotFound:
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Station not found",
+		})
+	case errStationInactive:
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Station is not accepting deposits",
+		})
+	case errBinFull:
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Bin for this material is full",
+		})
+	case errMaterialNotAccepted:
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Material is not accepted at this station",
+		})
+	default:
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve station",
+		})
+	}
+}
+
+// sessionStationID maps the station_id stored on a station session to a
+// stations row. Sessions created without a numeric station use the default.
+func sessionStationID(raw string) int {
+	if id, err := strconv.Atoi(raw); err == nil {
+		return id
+	}
+	return defaultStationID
+}
+
+// stationIDFromRequest reads the station from the {id} URL parameter or the
+// station_id query parameter, falling back to the default station
+func stationIDFromRequest(r *http.Request) (int, error) {
+	raw := chi.URLParam(r, "id")
+	if raw == "" {
+		raw = r.URL.Query().Get("station_id")
+	}
+	if raw == "" {
+		return defaultStationID, nil
+	}
+	return strconv.Atoi(raw)
+}
+
+// generateStationKey returns a random API key for station hardware
+func generateStationKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validateStationRequest checks the fields of a create or update request
+func validateStationRequest(req *StationRequest) string {
+	if req.Location == "" {
+		return "Location is required"
+	}
+	if req.Status == "" {
+		req.Status = "active"
+	}
+	if req.Status != "active" && req.Status != "maintenance" && req.Status != "disabled" {
+		return "Status must be active, maintenance, or disabled"
+	}
+	if req.Capacity == 0 {
+		req.Capacity = 100
+	}
+	if req.Capacity < 0 {
+		return "Capacity must be positive"
+	}
+	if (req.Latitude == nil) != (req.Longitude == nil) {
+		return "Latitude and longitude must be set together"
+	}
+	if req.Latitude != nil && (*req.Latitude < -90 || *req.Latitude > 90) {
+		return "Latitude must be between -90 and 90"
+	}
+	if req.Longitude != nil && (*req.Longitude < -180 || *req.Longitude > 180) {
+		return "Longitude must be between -180 and 180"
+	}
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(req.Timezone); err != nil {
+		return "Invalid timezone"
+	}
+	return ""
+}
+
+// listStations lists all stations
+func listStations(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + stationColumns + " FROM stations"
+	args := []interface{}{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve stations",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var stations []database.Station
+	for rows.Next() {
+		station, err := scanStation(rows)
+		if err != nil {
+			continue
+		}
+		stations = append(stations, station)
+	}
+
+	if stations == nil {
+		stations = []database.Station{}
+	}
+
+	now := time.Now().UTC()
+	for i := range stations {
+		stations[i] = withOpenState(stations[i], now)
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    stations,
+	})
+}
+
+// getStation retrieves a single station
+func getStation(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	station, err := loadStation(stationID)
+	if err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    withOpenState(station, time.Now().UTC()),
+	})
+}
+
+// createStation registers a new station and returns its API key
+func createStation(w http.ResponseWriter, r *http.Request) {
+	var req StationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	if msg := validateStationRequest(&req); msg != "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   msg,
+		})
+		return
+	}
+
+	apiKey, err := generateStationKey()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate station key",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		INSERT INTO stations (location, address, latitude, longitude, status, capacity, timezone, operator, api_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.Location, req.Address, req.Latitude, req.Longitude, req.Status, req.Capacity,
+		req.Timezone, req.Operator, apiKey)
+
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to create station",
+		})
+		return
+	}
+
+	stationID, _ := result.LastInsertId()
+	station, _ := loadStation(int(stationID))
+
+	log.Printf("Station created: id=%d, location=%s", stationID, req.Location)
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Station created",
+		Data: map[string]interface{}{
+			"station": station,
+			"api_key": apiKey,
+		},
+	})
+}
+
+// updateStation replaces a station's registry details
+func updateStation(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	var req StationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	if msg := validateStationRequest(&req); msg != "" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   msg,
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE stations SET location = ?, address = ?, latitude = ?, longitude = ?, status = ?,
+			capacity = ?, timezone = ?, operator = ?
+		WHERE id = ?
+	`, req.Location, req.Address, req.Latitude, req.Longitude, req.Status, req.Capacity,
+		req.Timezone, req.Operator, stationID)
+
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update station",
+		})
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		respondStationError(w, errStationNotFound)
+		return
+	}
+
+	station, _ := loadStation(stationID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Station updated",
+		Data:    station,
+	})
+}
+
+// deleteStation disables a station. Stations are never removed because
+// transactions reference them.
+func deleteStation(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec("UPDATE stations SET status = ? WHERE id = ?", "disabled", stationID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to disable station",
+		})
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		respondStationError(w, errStationNotFound)
+		return
+	}
+
+	log.Printf("Station disabled: id=%d", stationID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Station disabled",
+	})
+}
+
+// rotateStationKey issues a new API key, invalidating the old one
+func rotateStationKey(w http.ResponseWriter, r *http.Request) {
+	stationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid station ID",
+		})
+		return
+	}
+
+	apiKey, err := generateStationKey()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to generate station key",
+		})
+		return
+	}
+
+	// The old key is kept to check offline deposits signed before the rotation
+	result, err := database.DB.Exec(
+		"UPDATE stations SET previous_api_key = api_key, key_rotated_at = ?, api_key = ? WHERE id = ?",
+		time.Now().UTC(), apiKey, stationID,
+	)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to rotate station key",
+		})
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		respondStationError(w, errStationNotFound)
+		return
+	}
+
+	log.Printf("Station key rotated: id=%d", stationID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Station key rotated",
+		Data: map[string]interface{}{
+			"api_key": apiKey,
+		},
+	})
+}
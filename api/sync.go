@@ -0,0 +1,709 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"t2cbackend/database"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Offline sync limits
+const (
+	maxSyncBatch        = 500
+	maxOfflineAge       = 30 * 24 * time.Hour
+	offlineClockSkew    = 5 * time.Minute
+	sessionWindowMargin = 2 * time.Minute // allowance for station clock drift
+)
+
+// OfflineDepositItem represents one deposit recorded by a station while offline
+type OfflineDepositItem struct {
+	ID              string         `json:"id"` // station-generated UUID
+	RecordedAt      time.Time      `json:"recorded_at"`
+	SessionToken    string         `json:"session_token,omitempty"`
+	CardUID         string         `json:"card_uid,omitempty"`
+	Material        string         `json:"material"`
+	Weight          database.Grams `json:"weight"`
+	Count           int            `json:"count,omitempty"`             // counted materials
+	ContainerSizeML int            `json:"container_size_ml,omitempty"` // counted materials
+	Barcode         string         `json:"barcode,omitempty"`           // sets the material for catalogued products
+	Signature       string         `json:"signature"`
+}
+
+// amount returns what the station measured for the deposit
+func (item OfflineDepositItem) amount() depositAmount {
+	return depositAmount{Weight: item.Weight, Count: item.Count, ContainerSizeML: item.ContainerSizeML}
+}
+
+// SyncRequest represents a batch of offline deposits
+type SyncRequest struct {
+	Deposits []OfflineDepositItem `json:"deposits"`
+}
+
+// ResolveOfflineRequest represents an admin decision on a held offline deposit
+type ResolveOfflineRequest struct {
+	UserID int    `json:"user_id"`
+	Reason string `json:"reason"`
+}
+
+// SyncResult is the outcome for one uploaded deposit
+type SyncResult struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"` // applied/held/rejected/duplicate
+	Points        int    `json:"points,omitempty"`
+	TransactionID *int   `json:"transaction_id,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+	HeldForReview bool   `json:"held_for_review,omitempty"` // applied, but held by the fraud rules
+}
+
+// offlineSigningString returns the string a station signs for a deposit.
+// The count and container size are only signed for counted deposits, and
+// the barcode only when one was scanned, so signatures from stations that
+// predate them stay valid.
+func offlineSigningString(item OfflineDepositItem) string {
+	fields := []string{
+		item.ID,
+		item.RecordedAt.UTC().Format(time.RFC3339),
+		item.SessionToken,
+		item.CardUID,
+		item.Material,
+		strconv.FormatFloat(item.Weight.Kg(), 'f', 3, 64),
+	}
+	if item.Count != 0 || item.ContainerSizeML != 0 {
+		fields = append(fields, strconv.Itoa(item.Count), strconv.Itoa(item.ContainerSizeML))
+	}
+	if item.Barcode != "" {
+		fields = append(fields, item.Barcode)
+	}
+	return strings.Join(fields, "|")
+}
+
+// validOfflineSignature checks a deposit's HMAC-SHA256 signature, made with
+// the station's API key
+func validOfflineSignature(item OfflineDepositItem, apiKey string) bool {
+	if apiKey == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(item.Signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte(offlineSigningString(item)))
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// validStationSignature checks a deposit's signature against the key the
+// station had when the deposit was recorded. Deposits recorded before the
+// station's last key rotation may be signed with the previous key; deposits
+// older than maxOfflineAge are refused anyway.
+func validStationSignature(stationID int, apiKey string, item OfflineDepositItem) bool {
+	if validOfflineSignature(item, apiKey) {
+		return true
+	}
+
+	var previousKey sql.NullString
+	var rotatedAt sql.NullTime
+	err := database.DB.QueryRow(
+		"SELECT previous_api_key, key_rotated_at FROM stations WHERE id = ?", stationID,
+	).Scan(&previousKey, &rotatedAt)
+	if err != nil || !previousKey.Valid || !rotatedAt.Valid {
+		return false
+	}
+	if item.RecordedAt.After(rotatedAt.Time.Add(offlineClockSkew)) {
+		return false
+	}
+	return validOfflineSignature(item, previousKey.String)
+}
+
+// recordRejectedOfflineDeposit keeps a rejected deposit for admins to review.
+// Retries of the same ID then report it as a duplicate.
+func recordRejectedOfflineDeposit(stationID int, item OfflineDepositItem, reason string, now time.Time) {
+	itemCount, containerSize := item.amount().countColumns(item.Material)
+	_, err := database.DB.Exec(`
+		INSERT INTO offline_deposits (station_id, deposit_uuid, session_token, card_uid, item_type, weight_grams,
+			item_count, container_size_ml, barcode, points, status, reason, recorded_at, received_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 'rejected', ?, ?, ?)
+		ON CONFLICT (deposit_uuid) DO NOTHING
+	`, stationID, item.ID, item.SessionToken, normalizeCardUID(item.CardUID), item.Material, item.Weight,
+		itemCount, containerSize, item.Barcode, reason, item.RecordedAt.UTC(), now)
+	if err != nil {
+		log.Printf("recordRejectedOfflineDeposit: failed to store %s: %v", item.ID, err)
+	}
+}
+
+// offlineAttribution is who an offline deposit should be credited to
+type offlineAttribution struct {
+	userID       int    // 0 if not a registered user
+	guestSession string // set for deposits in an open guest session
+	held         string // reason the deposit cannot be attributed automatically
+}
+
+// attributeOfflineDeposit works out who made an offline deposit from its
+// session or card reference, as it stood when the deposit was recorded
+func attributeOfflineDeposit(stationID int, item OfflineDepositItem) offlineAttribution {
+	if item.SessionToken != "" {
+		var userID sql.NullInt64
+		var status, sessionStation string
+		var createdAt, expiresAt time.Time
+		var endedAt sql.NullTime
+		err := database.DB.QueryRow(`
+			SELECT user_id, status, station_id, created_at, expires_at, ended_at
+			FROM station_sessions WHERE session_token = ?
+		`, item.SessionToken).Scan(&userID, &status, &sessionStation, &createdAt, &expiresAt, &endedAt)
+		if err != nil {
+			return offlineAttribution{held: "Unknown session"}
+		}
+		if sessionStationID(sessionStation) != stationID {
+			return offlineAttribution{held: "Session belongs to another station"}
+		}
+
+		end := expiresAt
+		if endedAt.Valid && endedAt.Time.Before(end) {
+			end = endedAt.Time
+		}
+		if item.RecordedAt.Before(createdAt.Add(-sessionWindowMargin)) || item.RecordedAt.After(end.Add(sessionWindowMargin)) {
+			return offlineAttribution{held: "Deposit recorded outside the session"}
+		}
+
+		if status == "guest" {
+			return offlineAttribution{guestSession: item.SessionToken}
+		}
+		if !userID.Valid {
+			return offlineAttribution{held: "Session was never connected to a user"}
+		}
+		return offlineAttribution{userID: int(userID.Int64)}
+	}
+
+	if item.CardUID != "" {
+		var userID int
+		var status string
+		var blockedAt sql.NullTime
+		err := database.DB.QueryRow(
+			"SELECT user_id, status, blocked_at FROM user_cards WHERE card_uid = ?",
+			normalizeCardUID(item.CardUID),
+		).Scan(&userID, &status, &blockedAt)
+		if err != nil {
+			return offlineAttribution{held: "Unknown card"}
+		}
+		// A card blocked after the deposit was still valid when it was used
+		if status != "active" && (!blockedAt.Valid || !blockedAt.Time.After(item.RecordedAt)) {
+			return offlineAttribution{held: "Card was blocked"}
+		}
+		return offlineAttribution{userID: userID}
+	}
+
+	return offlineAttribution{held: "No session or card reference"}
+}
+
+// creditOfflineDeposit records a deposit transaction for a user and adds the
+// points, returning the transaction ID, the points credited and the fraud
+// assessment. The deposit is scored as of the time it was recorded; held
+// deposits earn nothing until an admin approves them. weight is the
+// corrected weight; the item keeps the raw scale reading.
+func creditOfflineDeposit(tx *sql.Tx, userID int, station database.Station, item OfflineDepositItem, match productMatch,
+	weight database.Grams, price depositPrice) (int, int, fraudAssessment, error) {
+	var sessionToken interface{}
+	if item.SessionToken != "" {
+		sessionToken = item.SessionToken
+	}
+
+	assessment := scoreDeposit(tx, fraudCheck{UserID: userID, Station: station, Material: item.Material, Weight: weight,
+		RawWeight: item.Weight, Quantity: item.amount().quantity(item.Material), Points: price.Points, At: item.RecordedAt})
+	points := 0
+	if !assessment.Held {
+		var err error
+		if points, err = creditPointsTx(tx, userID, price.MilliPoints); err != nil {
+			return 0, 0, assessment, err
+		}
+	}
+
+	itemCount, containerSize := item.amount().countColumns(item.Material)
+	result, err := tx.Exec(`
+		INSERT INTO transactions (user_id, type, item_type, weight_grams, raw_weight_grams, points_earned, station_id, session_token, timestamp,
+			rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, barcode, brand,
+			fraud_score, review_status)
+		VALUES (?, 'deposit', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, item.Material, weight, item.Weight, points, station.ID, sessionToken, item.RecordedAt,
+		price.RateVersionID, price.Rate, price.Multiplier, price.MilliPoints, itemCount, containerSize,
+		match.Barcode, match.Brand, assessment.Score, assessment.reviewStatus())
+	if err != nil {
+		return 0, 0, assessment, err
+	}
+
+	transactionID, _ := result.LastInsertId()
+	if assessment.Held {
+		err = recordReviewTx(tx, transactionID, userID, station.ID, assessment)
+	}
+	if err == nil {
+		err = postPointsTx(tx, ledgerPosting{UserID: userID, Points: points, Account: accountIssuance,
+			Kind: journalDeposit, Reference: "transaction", ReferenceID: transactionID})
+	}
+	return int(transactionID), points, assessment, err
+}
+
+// applyOfflineDeposit validates, attributes and stores one offline deposit.
+// The UUID is stored in the same database transaction as any credit, so a
+// deposit can never be applied twice.
+func applyOfflineDeposit(stationID int, apiKey string, item OfflineDepositItem, now time.Time) SyncResult {
+	result := SyncResult{ID: item.ID, Status: "rejected"}
+	reject := func(reason string) SyncResult {
+		recordRejectedOfflineDeposit(stationID, item, reason, now)
+		result.Reason = reason
+		return result
+	}
+
+	if _, err := uuid.Parse(item.ID); err != nil {
+		result.Reason = "id must be a UUID"
+		return result
+	}
+
+	// Already synced: report the original outcome
+	var existingStation int
+	var existing database.OfflineDeposit
+	var transactionID sql.NullInt64
+	var reason sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT station_id, status, points, transaction_id, reason
+		FROM offline_deposits WHERE deposit_uuid = ?
+	`, item.ID).Scan(&existingStation, &existing.Status, &existing.Points, &transactionID, &reason)
+	if err == nil {
+		if existingStation != stationID {
+			result.Reason = "id was already used by another station"
+			return result
+		}
+		result.Status = "duplicate"
+		result.Points = existing.Points
+		result.Reason = "Already synced as " + existing.Status
+		if transactionID.Valid {
+			id := int(transactionID.Int64)
+			result.TransactionID = &id
+		}
+		return result
+	}
+
+	item.RecordedAt = item.RecordedAt.UTC()
+	if !validStationSignature(stationID, apiKey, item) {
+		return reject("Invalid signature")
+	}
+
+	if item.RecordedAt.IsZero() || item.RecordedAt.After(now.Add(offlineClockSkew)) {
+		return reject("recorded_at is missing or in the future")
+	}
+	if now.Sub(item.RecordedAt) > maxOfflineAge {
+		return reject("Deposit is older than 30 days")
+	}
+
+	// Classify scanned containers the same way as deposits made online
+	amount := item.amount()
+	match, err := classifyDeposit(item.Material, item.Barcode, &amount)
+	if err != nil {
+		return reject(err.Error())
+	}
+	item.Material, item.ContainerSizeML = match.Material, amount.ContainerSizeML
+
+	// Use the calibration and rates that were in force when the item was weighed
+	weight := depositWeight(stationID, item.Material, item.amount(), match, item.RecordedAt)
+	price := priceDeposit(stationID, item.Material, weight, item.Count, item.RecordedAt)
+	points := price.Points
+	if _, active := activeMaterial(item.Material); !active {
+		return reject("Invalid material or weight")
+	}
+	if err := validateDepositAmount(item.Material, item.amount()); err != nil {
+		return reject(err.Error())
+	}
+	if err := match.checkWeight(item.amount(), weight); err != nil {
+		return reject(err.Error())
+	}
+	if err := checkMaterialQuantity(item.Material, item.amount().quantity(item.Material)); err != nil {
+		return reject(err.Error())
+	}
+	itemCount, containerSize := item.amount().countColumns(item.Material)
+	result.Points = points
+
+	attribution := attributeOfflineDeposit(stationID, item)
+	station, err := loadStation(stationID)
+	if err != nil {
+		result.Reason = "Failed to store deposit"
+		return result
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		result.Reason = "Failed to store deposit"
+		return result
+	}
+	defer tx.Rollback()
+
+	// The guest session's points are totalled when it ends, so check it is
+	// still open in the transaction that adds to it
+	if attribution.guestSession != "" {
+		if _, err := loadGuestSession(tx, attribution.guestSession, stationID); err != nil {
+			attribution = offlineAttribution{held: "Guest session has ended"}
+		}
+	}
+
+	var userID, creditedTransaction interface{}
+	status := "applied"
+	switch {
+	case attribution.userID != 0:
+		id, credited, assessment, err := creditOfflineDeposit(tx, attribution.userID, station, item, match, weight, price)
+		if err != nil {
+			log.Printf("applyOfflineDeposit: failed to credit %s: %v", item.ID, err)
+			result.Reason = "Failed to store deposit"
+			return result
+		}
+		userID = attribution.userID
+		creditedTransaction = id
+		points = credited
+		result.Points = credited
+		result.TransactionID = &id
+		result.HeldForReview = assessment.Held
+	case attribution.guestSession != "":
+		var assessment fraudAssessment
+		assessment, points = scoreGuestDepositTx(tx, fraudCheck{GuestSession: attribution.guestSession, Station: station,
+			Material: item.Material, Weight: weight, RawWeight: item.Weight, Quantity: item.amount().quantity(item.Material),
+			Points: price.Points, At: item.RecordedAt}, price)
+		result.Points = points
+		result.HeldForReview = assessment.Held
+		_, err = tx.Exec(`
+			INSERT INTO guest_deposits (session_token, item_type, weight_grams, raw_weight_grams, points_earned, station_id, timestamp,
+				rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, barcode, brand,
+				fraud_score, review_status, fraud_reasons)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, attribution.guestSession, item.Material, weight, item.Weight, points, stationID, item.RecordedAt,
+			price.RateVersionID, price.Rate, price.Multiplier, price.MilliPoints, itemCount, containerSize,
+			match.Barcode, match.Brand, assessment.Score, assessment.reviewStatus(), assessment.heldReasons())
+		if err != nil {
+			result.Reason = "Failed to store deposit"
+			return result
+		}
+		result.Reason = "Added to guest session"
+	default:
+		status = "held"
+		result.Reason = attribution.held
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO offline_deposits (station_id, deposit_uuid, session_token, card_uid, item_type, weight_grams,
+			item_count, container_size_ml, barcode, points, status, reason, user_id, transaction_id, recorded_at, received_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, stationID, item.ID, item.SessionToken, normalizeCardUID(item.CardUID), item.Material, item.Weight,
+		itemCount, containerSize, match.Barcode, points, status, result.Reason, userID, creditedTransaction, item.RecordedAt, now)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// A concurrent upload of the same batch won the race
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return SyncResult{ID: item.ID, Status: "duplicate", Reason: "Already synced"}
+		}
+		log.Printf("applyOfflineDeposit: failed to store %s: %v", item.ID, err)
+		return SyncResult{ID: item.ID, Status: "rejected", Reason: "Failed to store deposit"}
+	}
+
+	result.Status = status
+	return result
+}
+
+// syncOfflineDeposits applies a batch of deposits the authenticated station
+// recorded while offline. Items are applied independently and the response
+// lists the outcome of each, so a station can safely retry the whole batch.
+func syncOfflineDeposits(w http.ResponseWriter, r *http.Request) {
+	stationID, err := getStationIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid station",
+		})
+		return
+	}
+
+	var req SyncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	if len(req.Deposits) == 0 || len(req.Deposits) > maxSyncBatch {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   fmt.Sprintf("A batch must contain between 1 and %d deposits", maxSyncBatch),
+		})
+		return
+	}
+
+	apiKey := r.Header.Get("X-Station-Key")
+	now := time.Now().UTC()
+
+	results := make([]SyncResult, 0, len(req.Deposits))
+	summary := map[string]int{"applied": 0, "held": 0, "rejected": 0, "duplicate": 0}
+	for _, item := range req.Deposits {
+		result := applyOfflineDeposit(stationID, apiKey, item, now)
+		summary[result.Status]++
+		results = append(results, result)
+	}
+
+	log.Printf("Offline sync from station %d: %d applied, %d held, %d rejected, %d duplicate",
+		stationID, summary["applied"], summary["held"], summary["rejected"], summary["duplicate"])
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Batch processed",
+		Data: map[string]interface{}{
+			"summary": summary,
+			"results": results,
+		},
+	})
+}
+
+// offlineDepositColumns lists the columns scanned by scanOfflineDeposit
+const offlineDepositColumns = `id, station_id, deposit_uuid, COALESCE(session_token, ''), COALESCE(card_uid, ''),
+	item_type, weight_grams, COALESCE(item_count, 0), COALESCE(container_size_ml, 0), points, status, COALESCE(reason, ''), user_id, transaction_id, recorded_at, received_at,
+	resolved_by, resolved_at, COALESCE(barcode, '')`
+
+// scanOfflineDeposit scans a row selected with offlineDepositColumns
+func scanOfflineDeposit(row rowScanner) (database.OfflineDeposit, error) {
+	var deposit database.OfflineDeposit
+	var userID, transactionID, resolvedBy sql.NullInt64
+	var resolvedAt sql.NullTime
+	err := row.Scan(&deposit.ID, &deposit.StationID, &deposit.DepositUUID, &deposit.SessionToken,
+		&deposit.CardUID, &deposit.ItemType, &deposit.Weight, &deposit.ItemCount, &deposit.ContainerSizeML,
+		&deposit.Points, &deposit.Status,
+		&deposit.Reason, &userID, &transactionID, &deposit.RecordedAt, &deposit.ReceivedAt,
+		&resolvedBy, &resolvedAt, &deposit.Barcode)
+	if userID.Valid {
+		id := int(userID.Int64)
+		deposit.UserID = &id
+	}
+	if transactionID.Valid {
+		id := int(transactionID.Int64)
+		deposit.TransactionID = &id
+	}
+	if resolvedBy.Valid {
+		id := int(resolvedBy.Int64)
+		deposit.ResolvedBy = &id
+	}
+	if resolvedAt.Valid {
+		deposit.ResolvedAt = &resolvedAt.Time
+	}
+	return deposit, err
+}
+
+// listOfflineDeposits lists uploaded offline deposits, held ones by default
+func listOfflineDeposits(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "held"
+	}
+
+	query := "SELECT " + offlineDepositColumns + " FROM offline_deposits WHERE status = ?"
+	args := []interface{}{status}
+	if station := r.URL.Query().Get("station_id"); station != "" {
+		stationID, err := strconv.Atoi(station)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Invalid station ID",
+			})
+			return
+		}
+		query += " AND station_id = ?"
+		args = append(args, stationID)
+	}
+	query += " ORDER BY recorded_at DESC LIMIT 200"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to retrieve offline deposits",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var deposits []database.OfflineDeposit
+	for rows.Next() {
+		deposit, err := scanOfflineDeposit(rows)
+		if err != nil {
+			continue
+		}
+		deposits = append(deposits, deposit)
+	}
+
+	if deposits == nil {
+		deposits = []database.OfflineDeposit{}
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    deposits,
+	})
+}
+
+// resolveOfflineDeposit credits a held offline deposit to a user, or rejects
+// it when no user_id is given
+func resolveOfflineDeposit(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := getUserIDFromHeader(r)
+
+	depositID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid deposit ID",
+		})
+		return
+	}
+
+	var req ResolveOfflineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	deposit, err := scanOfflineDeposit(database.DB.QueryRow(
+		"SELECT "+offlineDepositColumns+" FROM offline_deposits WHERE id = ?", depositID,
+	))
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Offline deposit not found",
+		})
+		return
+	}
+
+	if req.UserID != 0 {
+		var exists int
+		database.DB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", req.UserID).Scan(&exists)
+		if exists == 0 {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "User not found",
+			})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve deposit",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// Claim the deposit first so two admins cannot both credit it
+	status := "rejected"
+	if req.UserID != 0 {
+		status = "applied"
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "Resolved by admin"
+	}
+	result, err := tx.Exec(`
+		UPDATE offline_deposits SET status = ?, reason = ?, resolved_by = ?, resolved_at = ?
+		WHERE id = ? AND status = 'held'
+	`, status, reason, adminID, now, depositID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve deposit",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Deposit is not held",
+		})
+		return
+	}
+
+	var transactionID *int
+	var held bool
+	points := deposit.Points
+	if req.UserID != 0 {
+		item := OfflineDepositItem{
+			RecordedAt:      deposit.RecordedAt,
+			SessionToken:    deposit.SessionToken,
+			Material:        deposit.ItemType,
+			Weight:          deposit.Weight,
+			Count:           deposit.ItemCount,
+			ContainerSizeML: deposit.ContainerSizeML,
+			Barcode:         deposit.Barcode,
+		}
+		// The deposit was checked when it was uploaded; a product changed
+		// since then does not stop it being credited
+		amount := item.amount()
+		match, err := classifyDeposit(deposit.ItemType, deposit.Barcode, &amount)
+		if err != nil {
+			match = productMatch{Material: deposit.ItemType}
+		}
+		weight := depositWeight(deposit.StationID, deposit.ItemType, item.amount(), match, deposit.RecordedAt)
+		price := priceDeposit(deposit.StationID, deposit.ItemType, weight, deposit.ItemCount, deposit.RecordedAt)
+		station, err := loadStation(deposit.StationID)
+		var id, credited int
+		var assessment fraudAssessment
+		if err == nil {
+			id, credited, assessment, err = creditOfflineDeposit(tx, req.UserID, station, item, match, weight, price)
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE offline_deposits SET user_id = ?, transaction_id = ?, points = ? WHERE id = ?",
+				req.UserID, id, credited, depositID)
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to credit deposit",
+			})
+			return
+		}
+		transactionID = &id
+		points = credited
+		held = assessment.Held
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve deposit",
+		})
+		return
+	}
+
+	log.Printf("Offline deposit %d %s by admin %d", depositID, status, adminID)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Deposit " + status,
+		Data: map[string]interface{}{
+			"id":              depositID,
+			"status":          status,
+			"points":          points,
+			"user_id":         req.UserID,
+			"transaction_id":  transactionID,
+			"held_for_review": held,
+		},
+	})
+}
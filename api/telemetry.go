@@ -0,0 +1,313 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"t2cbackend/database"
+	"time"
+)
+
+// Telemetry settings
+const (
+	telemetryRetention = 30 * 24 * time.Hour
+	binFullThreshold   = 95.0 // Deposits are refused at or above this fill percentage
+)
+
+var errBinFull = errors.New("bin is full")
+
+// TelemetryRequest represents a periodic telemetry report from a station
+type TelemetryRequest struct {
+	RecordedAt  *time.Time   `json:"recorded_at,omitempty"`
+	Temperature *float64     `json:"temperature,omitempty"`
+	DoorState   string       `json:"door_state,omitempty"` // open/closed
+	ErrorCodes  []string     `json:"error_codes,omitempty"`
+	Bins        []BinReading `json:"bins"`
+}
+
+// BinReading represents the fill level reported for one bin
+type BinReading struct {
+	Material    string  `json:"material"`
+	FillPercent float64 `json:"fill_percent"`
+}
+
+// ingestTelemetry stores a telemetry report from the authenticated station
+func ingestTelemetry(w http.ResponseWriter, r *http.Request) {
+	stationID, err := getStationIDFromHeader(r)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid station",
+		})
+		return
+	}
+
+	var req TelemetryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	recordedAt := now
+	if req.RecordedAt != nil {
+		recordedAt = req.RecordedAt.UTC()
+		// Allow for small clock drift on station hardware
+		if recordedAt.After(now.Add(5 * time.Minute)) {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "recorded_at is in the future",
+			})
+			return
+		}
+	}
+
+	if req.DoorState != "" && req.DoorState != "open" && req.DoorState != "closed" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "door_state must be open or closed",
+		})
+		return
+	}
+
+	for i := range req.Bins {
+		req.Bins[i].Material = normalizeMaterial(req.Bins[i].Material)
+		if req.Bins[i].Material == "" {
+			respondJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Each bin needs a material",
+			})
+			return
+		}
+		// Sensors can overshoot slightly; keep readings within 0-100
+		req.Bins[i].FillPercent = math.Max(0, math.Min(100, req.Bins[i].FillPercent))
+	}
+
+	errorCodes, _ := json.Marshal(req.ErrorCodes)
+	if req.ErrorCodes == nil {
+		errorCodes = []byte("[]")
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to store telemetry",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO station_telemetry (station_id, temperature, door_state, error_codes, recorded_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, stationID, req.Temperature, req.DoorState, string(errorCodes), recordedAt)
+
+	if err != nil {
+		log.Printf("ingestTelemetry: failed to insert telemetry: %v", err)
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to store telemetry",
+		})
+		return
+	}
+
+	telemetryID, _ := result.LastInsertId()
+
+	for _, bin := range req.Bins {
+		_, err = tx.Exec(`
+			INSERT INTO station_bin_levels (telemetry_id, station_id, material, fill_percent, recorded_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, telemetryID, stationID, bin.Material, bin.FillPercent, recordedAt)
+
+		if err != nil {
+			log.Printf("ingestTelemetry: failed to insert bin level: %v", err)
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to store telemetry",
+			})
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to store telemetry",
+		})
+		return
+	}
+
+	openFaultTickets(stationID, req.ErrorCodes)
+
+	// Tell the station which bins it should stop accepting
+	fullBins := []string{}
+	for _, bin := range req.Bins {
+		if bin.FillPercent >= binFullThreshold {
+			fullBins = append(fullBins, bin.Material)
+		}
+	}
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Telemetry recorded",
+		Data: map[string]interface{}{
+			"id":        telemetryID,
+			"full_bins": fullBins,
+		},
+	})
+}
+
+// latestTelemetry returns the most recent telemetry report for a station, or
+// nil if the station has never reported
+func latestTelemetry(station database.Station) (*database.StationTelemetry, error) {
+	var telemetry database.StationTelemetry
+	var temperature sql.NullFloat64
+	var doorState, errorCodes sql.NullString
+
+	err := database.DB.QueryRow(`
+		SELECT id, station_id, temperature, door_state, error_codes, recorded_at
+		FROM station_telemetry
+		WHERE station_id = ?
+		ORDER BY recorded_at DESC, id DESC LIMIT 1
+	`, station.ID).Scan(&telemetry.ID, &telemetry.StationID, &temperature, &doorState,
+		&errorCodes, &telemetry.RecordedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if temperature.Valid {
+		telemetry.Temperature = &temperature.Float64
+	}
+	telemetry.DoorState = doorState.String
+	telemetry.ErrorCodes = []string{}
+	if errorCodes.Valid {
+		json.Unmarshal([]byte(errorCodes.String), &telemetry.ErrorCodes)
+	}
+
+	levels, err := latestBinLevels(station)
+	if err != nil {
+		return nil, err
+	}
+	telemetry.Bins = make([]database.BinLevel, 0, len(levels))
+	for _, level := range levels {
+		telemetry.Bins = append(telemetry.Bins, level)
+	}
+	sort.Slice(telemetry.Bins, func(i, j int) bool {
+		return telemetry.Bins[i].Material < telemetry.Bins[j].Material
+	})
+
+	return &telemetry, nil
+}
+
+// latestBinLevels returns the most recent fill reading for each bin. Readings
+// taken before a bin was last emptied, by a pickup of that bin or of the
+// whole station, are ignored.
+func latestBinLevels(station database.Station) (map[string]database.BinLevel, error) {
+	// Readings uploaded late can have lower IDs than newer ones, so the latest
+	// reading is the one recorded last
+	rows, err := database.DB.Query(`
+		SELECT material, fill_percent, recorded_at
+		FROM station_bin_levels b
+		WHERE station_id = ? AND id = (
+			SELECT id FROM station_bin_levels
+			WHERE station_id = b.station_id AND material = b.material
+			ORDER BY recorded_at DESC, id DESC LIMIT 1
+		)
+	`, station.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	levels := make(map[string]database.BinLevel)
+	for rows.Next() {
+		var level database.BinLevel
+		if err := rows.Scan(&level.Material, &level.FillPercent, &level.RecordedAt); err != nil {
+			continue
+		}
+		// Readings from before the bin was last emptied are out of date
+		if level.RecordedAt.Before(binEmptiedAt(station, level.Material)) {
+			continue
+		}
+		levels[level.Material] = level
+	}
+	return levels, rows.Err()
+}
+
+// loadStationForDeposit retrieves a station that can accept a deposit of the
+// given material and quantity right now: it is active and open, its
+// configuration accepts the material, the quantity is within the catalog
+// limits and the bin is not full
+func loadStationForDeposit(stationID int, material string, quantity float64) (database.Station, error) {
+	station, err := loadActiveStation(stationID)
+	if err != nil {
+		return station, err
+	}
+
+	// Sessions started just before closing may finish within their timeout
+	cfg := stationConfigOrDefault(station.ID)
+	now := time.Now().UTC()
+	grace := time.Duration(cfg.SessionTimeoutSeconds) * time.Second
+	if err := checkStationOpen(station, now); err != nil && !stationOpenAt(station, now.Add(-grace)) {
+		return station, err
+	}
+
+	accepted := false
+	for _, m := range cfg.AcceptedMaterials {
+		if m == material {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		return station, errMaterialNotAccepted
+	}
+	if err := checkMaterialQuantity(material, quantity); err != nil {
+		return station, err
+	}
+
+	levels, err := latestBinLevels(station)
+	if err != nil {
+		return station, err
+	}
+	if level, ok := levels[material]; ok && level.FillPercent >= binFullThreshold {
+		return station, errBinFull
+	}
+
+	return station, nil
+}
+
+// pruneTelemetry deletes telemetry older than the retention period
+func pruneTelemetry() {
+	cutoff := time.Now().UTC().Add(-telemetryRetention)
+
+	result, err := database.DB.Exec("DELETE FROM station_bin_levels WHERE recorded_at < ?", cutoff)
+	if err != nil {
+		log.Printf("pruneTelemetry: failed to prune bin levels: %v", err)
+		return
+	}
+	binRows, _ := result.RowsAffected()
+
+	result, err = database.DB.Exec("DELETE FROM station_telemetry WHERE recorded_at < ?", cutoff)
+	if err != nil {
+		log.Printf("pruneTelemetry: failed to prune telemetry: %v", err)
+		return
+	}
+	telemetryRows, _ := result.RowsAffected()
+
+	if binRows > 0 || telemetryRows > 0 {
+		log.Printf("Pruned %d telemetry reports and %d bin readings", telemetryRows, binRows)
+	}
+}
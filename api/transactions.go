@@ -1,6 +1,7 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"t2cbackend/database"
 	"net/http"
@@ -10,27 +11,77 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
-// Material rates for points calculation
-var materialRates = map[string]int{
-	"plastic": 10, // 10 points per kg
-	"glass":   8,
-	"metal":   15,
-	"paper":   5,
-}
+// transactionColumns lists the columns scanned by scanTransaction
+const transactionColumns = `id, user_id, type, amount, item_type, weight_grams, COALESCE(raw_weight_grams, weight_grams), points_earned,
+	station_id, timestamp, rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml,
+	deposit_id, COALESCE(barcode, ''), COALESCE(brand, ''), fraud_score, COALESCE(review_status, ''),
+	COALESCE(reason, ''), operator_id, approved_by`
 
-// CalculatePoints calculates points based on item type and weight
-func CalculatePoints(itemType string, weight float64) int {
-	rate, exists := materialRates[itemType]
-	if !exists {
-		return 0
+// scanTransaction scans a row selected with transactionColumns and explains
+// how a deposit's points were calculated
+func scanTransaction(row rowScanner) (database.Transaction, error) {
+	var tx database.Transaction
+	var rateVersionID, rate, milliPoints, itemCount, containerSize, depositID, fraudScore sql.NullInt64
+	var operatorID, approvedBy sql.NullInt64
+	var multiplier sql.NullFloat64
+	err := row.Scan(&tx.ID, &tx.UserID, &tx.Type, &tx.Amount, &tx.ItemType,
+		&tx.Weight, &tx.RawWeight, &tx.PointsEarned, &tx.StationID, &tx.Timestamp,
+		&rateVersionID, &rate, &multiplier, &milliPoints, &itemCount, &containerSize,
+		&depositID, &tx.Barcode, &tx.Brand, &fraudScore, &tx.ReviewStatus,
+		&tx.Reason, &operatorID, &approvedBy)
+	if rateVersionID.Valid {
+		id := int(rateVersionID.Int64)
+		tx.RateVersionID = &id
+	}
+	if rate.Valid {
+		value := int(rate.Int64)
+		tx.Rate = &value
+	}
+	if multiplier.Valid {
+		tx.RateMultiplier = &multiplier.Float64
+	}
+	if milliPoints.Valid {
+		exact := formatMilliPoints(milliPoints.Int64)
+		tx.ExactPoints = &exact
+	}
+	if itemCount.Valid {
+		count := int(itemCount.Int64)
+		tx.ItemCount = &count
+	}
+	if containerSize.Valid {
+		size := int(containerSize.Int64)
+		tx.ContainerSizeML = &size
+	}
+	if depositID.Valid {
+		id := int(depositID.Int64)
+		tx.DepositID = &id
 	}
-	return int(weight * float64(rate))
+	if fraudScore.Valid {
+		score := int(fraudScore.Int64)
+		tx.FraudScore = &score
+	}
+	if operatorID.Valid {
+		id := int(operatorID.Int64)
+		tx.OperatorID = &id
+	}
+	if approvedBy.Valid {
+		id := int(approvedBy.Int64)
+		tx.ApprovedBy = &id
+	}
+	tx.Explanation = explainCredit(tx)
+	return tx, err
 }
 
-// DepositRequest represents a deposit request
+// DepositRequest represents a deposit a station credits to a scanned card.
+// Weighed materials need a weight; counted materials need a count and may
+// include a container size.
 type DepositRequest struct {
-	ItemType string  `json:"item_type"`
-	Weight   float64 `json:"weight"`
+	CardUID         string         `json:"card_uid"`
+	ItemType        string         `json:"item_type"`
+	Weight          database.Grams `json:"weight"`
+	Count           int            `json:"count,omitempty"`
+	ContainerSizeML int            `json:"container_size_ml,omitempty"`
+	Barcode         string         `json:"barcode,omitempty"` // sets item_type for catalogued products
 }
 
 // getTransactions retrieves transaction history
@@ -55,7 +106,7 @@ func getTransactions(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rows, err := database.DB.Query(`
-		SELECT id, user_id, type, amount, item_type, weight, points_earned, station_id, timestamp
+		SELECT `+transactionColumns+`
 		FROM transactions
 		WHERE user_id = ?
 		ORDER BY timestamp DESC
@@ -73,9 +124,7 @@ func getTransactions(w http.ResponseWriter, r *http.Request) {
 
 	var transactions []database.Transaction
 	for rows.Next() {
-		var tx database.Transaction
-		err := rows.Scan(&tx.ID, &tx.UserID, &tx.Type, &tx.Amount, &tx.ItemType,
-			&tx.Weight, &tx.PointsEarned, &tx.StationID, &tx.Timestamp)
+		tx, err := scanTransaction(rows)
 		if err != nil {
 			continue
 		}
@@ -92,8 +141,8 @@ func getTransactions(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// createTransaction creates a new transaction (manual entry)
-func createTransaction(w http.ResponseWriter, r *http.Request) {
+// getTransactionDetail retrieves a specific transaction
+func getTransactionDetail(w http.ResponseWriter, r *http.Request) {
 	userID, err := getUserIDFromHeader(r)
 	if err != nil {
 		respondJSON(w, http.StatusUnauthorized, Response{
@@ -103,153 +152,121 @@ func createTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req DepositRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondJSON(w, http.StatusBadRequest, Response{
-			Success: false,
-			Error:   "Invalid request body",
-		})
-		return
-	}
+	txID := chi.URLParam(r, "id")
 
-	// Calculate points
-	points := CalculatePoints(req.ItemType, req.Weight)
-	if points == 0 {
-		respondJSON(w, http.StatusBadRequest, Response{
-			Success: false,
-			Error:   "Invalid item type",
-		})
-		return
-	}
+	tx, err := scanTransaction(database.DB.QueryRow(`
+		SELECT `+transactionColumns+`
+		FROM transactions
+		WHERE id = ? AND user_id = ?
+	`, txID, userID))
 
-	// Begin transaction
-	tx, err := database.DB.Begin()
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, Response{
+		respondJSON(w, http.StatusNotFound, Response{
 			Success: false,
-			Error:   "Failed to process transaction",
+			Error:   "Transaction not found",
 		})
 		return
 	}
-	defer tx.Rollback()
 
-	// Insert transaction
-	result, err := tx.Exec(`
-		INSERT INTO transactions (user_id, type, item_type, weight, points_earned, station_id)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, userID, "deposit", req.ItemType, req.Weight, points, 1)
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    tx,
+	})
+}
 
+// processDeposit processes an item deposit at the station, crediting the
+// owner of the card scanned with it. Only stations may call it; the station
+// is the one the API key belongs to.
+func processDeposit(w http.ResponseWriter, r *http.Request) {
+	stationID, err := getStationIDFromHeader(r)
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, Response{
+		respondJSON(w, http.StatusUnauthorized, Response{
 			Success: false,
-			Error:   "Failed to save transaction",
+			Error:   "Invalid station",
 		})
 		return
 	}
 
-	// Update user points
-	_, err = tx.Exec("UPDATE users SET total_points = total_points + ?, updated_at = ? WHERE id = ?",
-		points, time.Now(), userID)
-	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, Response{
+	var req DepositRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Failed to update points",
+			Error:   "Invalid request body",
 		})
 		return
 	}
 
-	if err = tx.Commit(); err != nil {
-		respondJSON(w, http.StatusInternalServerError, Response{
+	cardUID := normalizeCardUID(req.CardUID)
+	if cardUID == "" {
+		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Failed to complete transaction",
+			Error:   "Card UID is required",
 		})
 		return
 	}
-
-	txID, _ := result.LastInsertId()
-
-	// Get updated points
-	var totalPoints int
-	database.DB.QueryRow("SELECT total_points FROM users WHERE id = ?", userID).Scan(&totalPoints)
-
-	respondJSON(w, http.StatusCreated, Response{
-		Success: true,
-		Message: "Transaction successful",
-		Data: map[string]interface{}{
-			"id":            txID,
-			"points_earned": points,
-			"total_points":  totalPoints,
-		},
-	})
-}
-
-// getTransactionDetail retrieves a specific transaction
-func getTransactionDetail(w http.ResponseWriter, r *http.Request) {
-	userID, err := getUserIDFromHeader(r)
+	var userID int
+	var cardStatus string
+	err = database.DB.QueryRow(
+		"SELECT user_id, status FROM user_cards WHERE card_uid = ?", cardUID,
+	).Scan(&userID, &cardStatus)
 	if err != nil {
-		respondJSON(w, http.StatusUnauthorized, Response{
+		respondJSON(w, http.StatusNotFound, Response{
 			Success: false,
-			Error:   "Invalid user",
+			Error:   "Card not registered",
 		})
 		return
 	}
-
-	txID := chi.URLParam(r, "id")
-
-	var tx database.Transaction
-	err = database.DB.QueryRow(`
-		SELECT id, user_id, type, amount, item_type, weight, points_earned, station_id, timestamp
-		FROM transactions
-		WHERE id = ? AND user_id = ?
-	`, txID, userID).Scan(&tx.ID, &tx.UserID, &tx.Type, &tx.Amount, &tx.ItemType,
-		&tx.Weight, &tx.PointsEarned, &tx.StationID, &tx.Timestamp)
-
-	if err != nil {
-		respondJSON(w, http.StatusNotFound, Response{
+	if cardStatus != "active" {
+		respondJSON(w, http.StatusForbidden, Response{
 			Success: false,
-			Error:   "Transaction not found",
+			Error:   "Card has been blocked",
 		})
 		return
 	}
 
-	respondJSON(w, http.StatusOK, Response{
-		Success: true,
-		Data:    tx,
-	})
-}
-
-// processDeposit processes an item deposit at the station
-func processDeposit(w http.ResponseWriter, r *http.Request) {
-	// This endpoint would typically be called by station hardware
-	// For now, it's similar to createTransaction but can include station-specific logic
-
-	userID, err := getUserIDFromHeader(r)
+	// Classify scanned containers, then validate the deposit
+	amount := depositAmount{Weight: req.Weight, Count: req.Count, ContainerSizeML: req.ContainerSizeML}
+	match, err := classifyDeposit(req.ItemType, req.Barcode, &amount)
 	if err != nil {
-		respondJSON(w, http.StatusUnauthorized, Response{
+		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Invalid user",
+			Error:   err.Error(),
 		})
 		return
 	}
+	req.ItemType = match.Material
 
-	var req DepositRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if _, active := activeMaterial(req.ItemType); !active {
 		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Invalid request body",
+			Error:   "Invalid item type",
+		})
+		return
+	}
+	if err := validateDepositAmount(req.ItemType, amount); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
 		})
 		return
 	}
 
-	// Validate and calculate points
-	points := CalculatePoints(req.ItemType, req.Weight)
-	if points == 0 {
+	station, err := loadStationForDeposit(stationID, req.ItemType, amount.quantity(req.ItemType))
+	if err != nil {
+		respondStationError(w, err)
+		return
+	}
+	// Price the reading after correcting it with the station's scale calibration
+	weight := depositWeight(stationID, req.ItemType, amount, match, time.Now())
+	if err := match.checkWeight(amount, weight); err != nil {
 		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Invalid item type",
+			Error:   err.Error(),
 		})
 		return
 	}
+	price := priceDeposit(stationID, req.ItemType, weight, req.Count, time.Now())
+	itemCount, containerSize := amount.countColumns(req.ItemType)
 
 	// Begin transaction
 	tx, err := database.DB.Begin()
@@ -262,11 +279,32 @@ func processDeposit(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	assessment := scoreDeposit(tx, fraudCheck{UserID: userID, Station: station, Material: req.ItemType, Weight: weight,
+		RawWeight: req.Weight, Quantity: amount.quantity(req.ItemType), Points: price.Points, At: time.Now()})
+
+	// Credit the points, carrying any fraction of a point to the next deposit.
+	// Deposits held for review are credited if an admin approves them.
+	points := 0
+	if !assessment.Held {
+		points, err = creditPointsTx(tx, userID, price.MilliPoints)
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update points",
+		})
+		return
+	}
+
 	// Insert transaction
 	result, err := tx.Exec(`
-		INSERT INTO transactions (user_id, type, item_type, weight, points_earned, station_id)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, userID, "deposit", req.ItemType, req.Weight, points, 1)
+		INSERT INTO transactions (user_id, type, item_type, weight_grams, raw_weight_grams, points_earned, station_id,
+			rate_version_id, rate, rate_multiplier, milli_points, item_count, container_size_ml, barcode, brand,
+			fraud_score, review_status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, "deposit", req.ItemType, weight, req.Weight, points, stationID,
+		price.RateVersionID, price.Rate, price.Multiplier, price.MilliPoints, itemCount, containerSize,
+		match.Barcode, match.Brand, assessment.Score, assessment.reviewStatus())
 
 	if err != nil {
 		respondJSON(w, http.StatusInternalServerError, Response{
@@ -276,9 +314,19 @@ func processDeposit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update user points
-	_, err = tx.Exec("UPDATE users SET total_points = total_points + ?, updated_at = ? WHERE id = ?",
-		points, time.Now(), userID)
+	depositID, _ := result.LastInsertId()
+	if assessment.Held {
+		if err = recordReviewTx(tx, depositID, userID, stationID, assessment); err != nil {
+			respondJSON(w, http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to queue deposit for review",
+			})
+			return
+		}
+	}
+
+	err = postPointsTx(tx, ledgerPosting{UserID: userID, Points: points, Account: accountIssuance,
+		Kind: journalDeposit, Reference: "transaction", ReferenceID: depositID})
 	if err != nil {
 		respondJSON(w, http.StatusInternalServerError, Response{
 			Success: false,
@@ -295,8 +343,6 @@ func processDeposit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	depositID, _ := result.LastInsertId()
-
 	// Get updated points
 	var totalPoints int
 	database.DB.QueryRow("SELECT total_points FROM users WHERE id = ?", userID).Scan(&totalPoints)
@@ -305,12 +351,17 @@ func processDeposit(w http.ResponseWriter, r *http.Request) {
 		Success: true,
 		Message: "Deposit processed successfully",
 		Data: map[string]interface{}{
-			"id":            depositID,
-			"item_type":     req.ItemType,
-			"weight":        req.Weight,
-			"points_earned": points,
-			"total_points":  totalPoints,
-			"timestamp":     time.Now(),
+			"id":              depositID,
+			"item_type":       req.ItemType,
+			"weight":          weight,
+			"raw_weight":      req.Weight,
+			"item_count":      itemCount,
+			"brand":           match.Brand,
+			"station_id":      stationID,
+			"points_earned":   points,
+			"total_points":    totalPoints,
+			"held_for_review": assessment.Held,
+			"timestamp":       time.Now(),
 		},
 	})
 }
@@ -2,9 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
+	"strconv"
 	"t2cbackend/database"
 	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
 // getUserProfile retrieves the current user's profile
@@ -20,9 +24,9 @@ func getUserProfile(w http.ResponseWriter, r *http.Request) {
 
 	var user database.User
 	err = database.DB.QueryRow(`
-		SELECT id, email, name, total_points, created_at, updated_at
+		SELECT id, COALESCE(email, ''), COALESCE(phone, ''), name, total_points, created_at, updated_at
 		FROM users WHERE id = ?
-	`, userID).Scan(&user.ID, &user.Email, &user.Name,
+	`, userID).Scan(&user.ID, &user.Email, &user.Phone, &user.Name,
 		&user.TotalPoints, &user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
@@ -51,19 +55,20 @@ func getUserStats(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get total deposits
-	var totalDeposits int
+	var totalDeposits, totalItems int
 	var totalWeight float64
 	var totalPointsEarned int
 
 	database.DB.QueryRow(`
-		SELECT COUNT(*), COALESCE(SUM(weight), 0), COALESCE(SUM(points_earned), 0)
+		SELECT COUNT(*), COALESCE(SUM(weight_grams), 0) / 1000.0, COALESCE(SUM(item_count), 0), COALESCE(SUM(points_earned), 0)
 		FROM transactions
 		WHERE user_id = ? AND type = 'deposit'
-	`, userID).Scan(&totalDeposits, &totalWeight, &totalPointsEarned)
+	`, userID).Scan(&totalDeposits, &totalWeight, &totalItems, &totalPointsEarned)
 
 	// Get breakdown by material
 	rows, _ := database.DB.Query(`
-		SELECT item_type, COUNT(*), SUM(weight), SUM(points_earned)
+		SELECT item_type, COUNT(*), SUM(weight_grams) / 1000.0, COALESCE(SUM(item_count), 0),
+			COALESCE(SUM(item_count * container_size_ml), 0), SUM(points_earned)
 		FROM transactions
 		WHERE user_id = ? AND type = 'deposit'
 		GROUP BY item_type
@@ -73,15 +78,24 @@ func getUserStats(w http.ResponseWriter, r *http.Request) {
 	breakdown := make(map[string]interface{})
 	for rows.Next() {
 		var itemType string
-		var count int
+		var count, items, volumeML int
 		var weight float64
 		var points int
-		rows.Scan(&itemType, &count, &weight, &points)
-		breakdown[itemType] = map[string]interface{}{
+		rows.Scan(&itemType, &count, &weight, &items, &volumeML, &points)
+		entry := map[string]interface{}{
+			"unit":   unitKg,
 			"count":  count,
 			"weight": weight,
 			"points": points,
 		}
+		// Counted materials report items, and the volume of those with a
+		// container size. Their weight is estimated when stations don't weigh them.
+		if counted(itemType) {
+			entry["unit"] = unitItem
+			entry["items"] = items
+			entry["volume_l"] = float64(volumeML) / 1000
+		}
+		breakdown[itemType] = entry
 	}
 
 	respondJSON(w, http.StatusOK, Response{
@@ -89,7 +103,9 @@ func getUserStats(w http.ResponseWriter, r *http.Request) {
 		Data: map[string]interface{}{
 			"total_deposits":      totalDeposits,
 			"total_weight_kg":     totalWeight,
+			"total_items":         totalItems,
 			"total_points_earned": totalPointsEarned,
+			"carried_points":      userCarriedPoints(userID),
 			"breakdown":           breakdown,
 		},
 	})
@@ -137,36 +153,44 @@ func updateUserProfile(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// getStationStatus retrieves the current station status
+// getStationStatus retrieves the current status of a station
 func getStationStatus(w http.ResponseWriter, r *http.Request) {
-	var station database.Station
-	err := database.DB.QueryRow(`
-		SELECT id, location, status, capacity, last_maintenance, configuration
-		FROM stations WHERE id = 1
-	`).Scan(&station.ID, &station.Location, &station.Status, &station.Capacity,
-		&station.LastMaintenance, &station.Configuration)
-
+	stationID, err := stationIDFromRequest(r)
 	if err != nil {
-		respondJSON(w, http.StatusNotFound, Response{
+		respondJSON(w, http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Station not found",
+			Error:   "Invalid station ID",
 		})
 		return
 	}
 
+	station, err := loadStation(stationID)
+	if err != nil {
+		respondStationError(w, err)
+		return
+	}
+
+	// Latest telemetry report, if the station sends any
+	telemetry, err := latestTelemetry(station)
+	if err != nil {
+		log.Printf("getStationStatus: failed to load telemetry for station %d: %v", station.ID, err)
+	}
+
 	// Get today's statistics
 	var todayDeposits int
 	var todayWeight float64
 	database.DB.QueryRow(`
-		SELECT COUNT(*), COALESCE(SUM(weight), 0)
+		SELECT COUNT(*), COALESCE(SUM(weight_grams), 0) / 1000.0
 		FROM transactions
-		WHERE DATE(timestamp) = DATE('now') AND type = 'deposit'
-	`).Scan(&todayDeposits, &todayWeight)
+		WHERE DATE(timestamp) = DATE('now') AND type = 'deposit' AND station_id = ?
+	`, station.ID).Scan(&todayDeposits, &todayWeight)
 
 	respondJSON(w, http.StatusOK, Response{
 		Success: true,
 		Data: map[string]interface{}{
-			"station": station,
+			"station":    station,
+			"telemetry":  telemetry,
+			"fill_level": stationFillLevel(station),
 			"today_stats": map[string]interface{}{
 				"deposits":  todayDeposits,
 				"weight_kg": todayWeight,
@@ -175,17 +199,83 @@ func getStationStatus(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// getStationConfig retrieves station configuration
-func getStationConfig(w http.ResponseWriter, r *http.Request) {
+// Opening hours advertised to stations and the app
+var operatingHours = map[string]string{
+	"weekday": "08:00-20:00",
+	"weekend": "09:00-18:00",
+}
+
+// RoleRequest represents a change to a user's role
+type RoleRequest struct {
+	Role string `json:"role"` // user/technician/hauler/admin
+}
+
+// setUserRole changes a user's role
+func setUserRole(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := getUserIDFromHeader(r)
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid user ID",
+		})
+		return
+	}
+
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	if req.Role != "user" && req.Role != "technician" && req.Role != "hauler" && req.Role != "admin" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Role must be user, technician, hauler or admin",
+		})
+		return
+	}
+
+	// Admins cannot lock themselves out
+	if userID == adminID && req.Role != "admin" {
+		respondJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "You cannot remove your own admin role",
+		})
+		return
+	}
+
+	result, err := database.DB.Exec(
+		"UPDATE users SET role = ?, updated_at = ? WHERE id = ?",
+		req.Role, time.Now(), userID,
+	)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to update role",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "User not found",
+		})
+		return
+	}
+
+	log.Printf("User %d role set to %s by admin %d", userID, req.Role, adminID)
+
 	respondJSON(w, http.StatusOK, Response{
 		Success: true,
+		Message: "Role updated",
 		Data: map[string]interface{}{
-			"material_rates": materialRates,
-			"operating_hours": map[string]string{
-				"weekday": "08:00-20:00",
-				"weekend": "09:00-18:00",
-			},
-			"supported_materials": []string{"plastic", "glass", "metal", "paper"},
+			"user_id": userID,
+			"role":    req.Role,
 		},
 	})
 }
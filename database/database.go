@@ -2,7 +2,11 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"log"
+	"math/big"
+	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -15,24 +19,109 @@ var DB *sql.DB
 type User struct {
 	ID          int       `json:"id"`
 	Email       string    `json:"email"`
+	Phone       string    `json:"phone,omitempty"`
 	Password    string    `json:"-"`
 	Name        string    `json:"name"`
+	Role        string    `json:"role,omitempty"` // user/technician/hauler/admin
 	TotalPoints int       `json:"total_points"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
-// Transaction represents a deposit or redemption transaction
+// Grams is a weight in whole grams. Weights are stored as integer grams and
+// read from and written to JSON as kg, e.g. 1.25 for 1250 g.
+type Grams int64
+
+// Kg returns the weight in kg
+func (g Grams) Kg() float64 {
+	return float64(g) / 1000
+}
+
+// MarshalJSON writes the weight in kg
+func (g Grams) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(g.Kg(), 'f', -1, 64)), nil
+}
+
+// UnmarshalJSON reads a weight in kg and rounds it to the nearest gram. The
+// number is parsed as a decimal, so 0.1 kg is exactly 100 g.
+func (g *Grams) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	kg, ok := new(big.Rat).SetString(string(data))
+	if !ok {
+		return errors.New("weight must be a number in kg")
+	}
+
+	// Round half away from zero
+	grams := new(big.Rat).Mul(kg, big.NewRat(1000, 1))
+	half := big.NewRat(1, 2)
+	if grams.Sign() < 0 {
+		half.Neg(half)
+	}
+	grams.Add(grams, half)
+	whole := new(big.Int).Quo(grams.Num(), grams.Denom())
+	if !whole.IsInt64() {
+		return errors.New("weight is out of range")
+	}
+	*g = Grams(whole.Int64())
+	return nil
+}
+
+// Transaction represents a deposit or adjustment transaction
 type Transaction struct {
 	ID           int       `json:"id"`
 	UserID       int       `json:"user_id"`
-	Type         string    `json:"type"` // deposit/redemption
+	Type         string    `json:"type"` // deposit/adjustment
 	Amount       float64   `json:"amount"`
 	ItemType     string    `json:"item_type"`
-	Weight       float64   `json:"weight"`
+	Weight       Grams     `json:"weight"`     // corrected by the station's scale calibration
+	RawWeight    Grams     `json:"raw_weight"` // as reported by the scale
 	PointsEarned int       `json:"points_earned"`
 	StationID    int       `json:"station_id"`
 	Timestamp    time.Time `json:"timestamp"`
+
+	// Set for materials counted per item
+	ItemCount       *int `json:"item_count,omitempty"`
+	ContainerSizeML *int `json:"container_size_ml,omitempty"`
+
+	// Set for the line items of a multi-item deposit
+	DepositID *int `json:"deposit_id,omitempty"`
+
+	// Set for deposits identified by barcode
+	Barcode string `json:"barcode,omitempty"`
+	Brand   string `json:"brand,omitempty"`
+
+	// Fraud score of deposits made since scoring began. Deposits scored at or
+	// above the review threshold are held until an admin reviews them.
+	FraudScore   *int   `json:"fraud_score,omitempty"`
+	ReviewStatus string `json:"review_status,omitempty"` // held/approved/rejected
+
+	// Set for staff adjustments
+	Reason     string `json:"reason,omitempty"`
+	OperatorID *int   `json:"operator_id,omitempty"` // admin who entered the adjustment
+	ApprovedBy *int   `json:"approved_by,omitempty"` // second admin, above the approval threshold
+
+	// How a deposit was priced; empty for adjustments and older deposits
+	RateVersionID  *int     `json:"rate_version_id,omitempty"`
+	Rate           *int     `json:"rate,omitempty"`            // points per unit applied
+	RateMultiplier *float64 `json:"rate_multiplier,omitempty"` // applied rate relative to the catalog rate
+	ExactPoints    *float64 `json:"exact_points,omitempty"`    // value before rounding to whole points
+	Explanation    string   `json:"explanation,omitempty"`
+}
+
+// Deposit is the header of a multi-item deposit. Each line item is a deposit
+// transaction linked to it by deposit_id.
+type Deposit struct {
+	ID           int           `json:"id"`
+	UserID       int           `json:"user_id"`
+	StationID    int           `json:"station_id"`
+	SessionToken string        `json:"session_token,omitempty"`
+	ItemLines    int           `json:"item_lines"`
+	PointsEarned int           `json:"points_earned"`
+	ExactPoints  float64       `json:"exact_points"`
+	CreatedAt    time.Time     `json:"created_at"`
+	Items        []Transaction `json:"items,omitempty"`
 }
 
 // Redemption represents a points redemption
@@ -59,18 +148,416 @@ type Session struct {
 
 // Station represents a recycling station
 type Station struct {
-	ID              int       `json:"id"`
-	Location        string    `json:"location"`
-	Status          string    `json:"status"`
-	Capacity        int       `json:"capacity"`
-	LastMaintenance time.Time `json:"last_maintenance"`
-	Configuration   string    `json:"configuration"`
+	ID              int        `json:"id"`
+	Location        string     `json:"location"`
+	Address         string     `json:"address"`
+	Latitude        *float64   `json:"latitude,omitempty"`
+	Longitude       *float64   `json:"longitude,omitempty"`
+	Status          string     `json:"status"` // active/maintenance/disabled
+	Capacity        int        `json:"capacity"`
+	Timezone        string     `json:"timezone"`
+	Operator        string     `json:"operator"`
+	Connectivity    string     `json:"connectivity"` // unknown/online/degraded/offline
+	LastHeartbeat   *time.Time `json:"last_heartbeat,omitempty"`
+	LastMaintenance time.Time  `json:"last_maintenance"`
+	Configuration   string     `json:"configuration"`
+	IsOpen          *bool      `json:"is_open,omitempty"`   // set in listings
+	NextOpen        *time.Time `json:"next_open,omitempty"` // set in listings when closed
+
+	// When every bin was last emptied, by a full pickup or a technician.
+	// Servicing a station does not empty its bins.
+	BinsEmptiedAt time.Time `json:"bins_emptied_at"`
+}
+
+// OfflineDeposit represents a deposit a station recorded while offline and
+// uploaded later
+type OfflineDeposit struct {
+	ID              int        `json:"id"`
+	StationID       int        `json:"station_id"`
+	DepositUUID     string     `json:"deposit_uuid"`
+	SessionToken    string     `json:"session_token,omitempty"`
+	CardUID         string     `json:"card_uid,omitempty"`
+	ItemType        string     `json:"item_type"`
+	Weight          Grams      `json:"weight"` // as reported by the scale
+	ItemCount       int        `json:"item_count,omitempty"`
+	ContainerSizeML int        `json:"container_size_ml,omitempty"`
+	Points          int        `json:"points"`
+	Status          string     `json:"status"` // applied/held/rejected
+	Reason          string     `json:"reason,omitempty"`
+	UserID          *int       `json:"user_id,omitempty"`
+	TransactionID   *int       `json:"transaction_id,omitempty"`
+	RecordedAt      time.Time  `json:"recorded_at"`
+	ReceivedAt      time.Time  `json:"received_at"`
+	ResolvedBy      *int       `json:"resolved_by,omitempty"`
+	ResolvedAt      *time.Time `json:"resolved_at,omitempty"`
+
+	// Set for deposits identified by barcode
+	Barcode string `json:"barcode,omitempty"`
+}
+
+// StationCommand represents a remote command sent to a station
+type StationCommand struct {
+	ID          int             `json:"id"`
+	StationID   int             `json:"station_id"`
+	Command     string          `json:"command"` // lock/unlock/open_door/reboot/show_message
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"` // queued/sent/succeeded/failed/timed_out/expired/cancelled
+	Attempts    int             `json:"attempts"`
+	Result      string          `json:"result,omitempty"`
+	IssuedBy    int             `json:"issued_by"`
+	CreatedAt   time.Time       `json:"created_at"`
+	SentAt      *time.Time      `json:"sent_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+}
+
+// CalibrationReading is a scale reading taken with a reference weight
+type CalibrationReading struct {
+	ReferenceKg float64 `json:"reference_kg"`
+	ReadingKg   float64 `json:"reading_kg"`
+}
+
+// ScaleCalibration is a calibration profile for a station's scale. Corrected
+// weights are Gain * reading + OffsetKg.
+type ScaleCalibration struct {
+	ID           int                  `json:"id"`
+	StationID    int                  `json:"station_id"`
+	Gain         float64              `json:"gain"`
+	OffsetKg     float64              `json:"offset_kg"`
+	Readings     []CalibrationReading `json:"readings"`
+	MaxErrorKg   float64              `json:"max_error_kg"`
+	TicketID     *int                 `json:"ticket_id,omitempty"`
+	TechnicianID int                  `json:"technician_id,omitempty"`
+	Notes        string               `json:"notes,omitempty"`
+	CalibratedAt time.Time            `json:"calibrated_at"`
+}
+
+// CollectionRun is a hauler's scheduled trip to empty the bins at a set of stations
+type CollectionRun struct {
+	ID           int                `json:"id"`
+	HaulerID     int                `json:"hauler_id"`
+	HaulerName   string             `json:"hauler_name,omitempty"`
+	ScheduledFor time.Time          `json:"scheduled_for"`
+	Status       string             `json:"status"` // scheduled/in_progress/completed/cancelled
+	Notes        string             `json:"notes,omitempty"`
+	CreatedBy    int                `json:"created_by"`
+	CreatedAt    time.Time          `json:"created_at"`
+	StartedAt    *time.Time         `json:"started_at,omitempty"`
+	CompletedAt  *time.Time         `json:"completed_at,omitempty"`
+	Stops        []CollectionStop   `json:"stops,omitempty"`
+	Pickups      []CollectionPickup `json:"pickups,omitempty"`
+}
+
+// CollectionStop is a station visited on a collection run
+type CollectionStop struct {
+	ID         int        `json:"id"`
+	RunID      int        `json:"run_id"`
+	StationID  int        `json:"station_id"`
+	Location   string     `json:"location"`
+	Sequence   int        `json:"sequence"`
+	Status     string     `json:"status"` // pending/collected/skipped
+	SkipReason string     `json:"skip_reason,omitempty"`
+	VisitedAt  *time.Time `json:"visited_at,omitempty"`
+}
+
+// CollectionPickup is one bin on a run's manifest. Recorded weights are the
+// deposits made into the bin since its previous pickup; the depot weight is
+// measured when the run is unloaded.
+type CollectionPickup struct {
+	ID               int        `json:"id"`
+	RunID            int        `json:"run_id"`
+	StationID        int        `json:"station_id"`
+	Material         string     `json:"material"`
+	Deposits         int        `json:"deposits"`
+	RecordedWeightKg float64    `json:"recorded_weight_kg"`
+	RecordedRawKg    float64    `json:"recorded_raw_kg"`
+	FillPercent      float64    `json:"fill_percent"`
+	PeriodStart      time.Time  `json:"period_start"`
+	PickedUpAt       time.Time  `json:"picked_up_at"`
+	DepotWeightKg    *float64   `json:"depot_weight_kg"`
+	DiscrepancyKg    *float64   `json:"discrepancy_kg"`
+	DiscrepancyPct   *float64   `json:"discrepancy_pct"`
+	Flagged          bool       `json:"flagged"`
+	WeighedAt        *time.Time `json:"weighed_at,omitempty"`
+}
+
+// Holiday represents a date with special or no opening hours. StationID 0
+// applies to every station.
+type Holiday struct {
+	ID        int       `json:"id"`
+	StationID int       `json:"station_id"`
+	Date      string    `json:"date"` // YYYY-MM-DD in the station's timezone
+	Name      string    `json:"name"`
+	Hours     string    `json:"hours,omitempty"` // "HH:MM-HH:MM", empty when closed all day
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StationClosure represents a temporary closure of a station
+type StationClosure struct {
+	ID        int       `json:"id"`
+	StationID int       `json:"station_id"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Reason    string    `json:"reason"`
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MaintenanceTicket represents a repair or service job at a station
+type MaintenanceTicket struct {
+	ID          int          `json:"id"`
+	StationID   int          `json:"station_id"`
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	Kind        string       `json:"kind"`   // fault/service
+	Source      string       `json:"source"` // manual/telemetry
+	FaultCode   string       `json:"fault_code,omitempty"`
+	Priority    string       `json:"priority"` // low/normal/high/urgent
+	Status      string       `json:"status"`   // open/assigned/in_progress/on_hold/closed/cancelled
+	AssignedTo  *int         `json:"assigned_to,omitempty"`
+	OpenedBy    *int         `json:"opened_by,omitempty"`
+	Resolution  string       `json:"resolution,omitempty"`
+	OpenedAt    time.Time    `json:"opened_at"`
+	ClosedAt    *time.Time   `json:"closed_at,omitempty"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Notes       []TicketNote `json:"notes,omitempty"`
+	Parts       []TicketPart `json:"parts,omitempty"`
+}
+
+// TicketNote represents a note or status change on a maintenance ticket
+type TicketNote struct {
+	ID        int       `json:"id"`
+	TicketID  int       `json:"ticket_id"`
+	UserID    *int      `json:"user_id,omitempty"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TicketPart represents a part used on a maintenance ticket
+type TicketPart struct {
+	ID         int       `json:"id"`
+	TicketID   int       `json:"ticket_id"`
+	PartName   string    `json:"part_name"`
+	PartNumber string    `json:"part_number,omitempty"`
+	Quantity   int       `json:"quantity"`
+	AddedBy    int       `json:"added_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Material is an entry in the material catalog
+type Material struct {
+	Code        string    `json:"code"`
+	Name        string    `json:"name"`
+	Unit        string    `json:"unit"` // kg/item
+	Rate        int       `json:"rate"` // points per unit
+	MinQuantity float64   `json:"min_quantity"`
+	MaxQuantity *float64  `json:"max_quantity"` // nil for no limit
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Deposits above this quantity are scored as implausible; nil for the default
+	ReviewQuantity *float64 `json:"review_quantity"`
+
+	// Expected weight of one item of a counted material, recorded as the
+	// weight of deposits the station did not weigh; 0 if unknown
+	ItemWeightKg float64 `json:"item_weight_kg"`
+}
+
+// MaterialRate is a version of a material's rate, in force from EffectiveFrom
+// until EffectiveTo
+type MaterialRate struct {
+	ID            int        `json:"id"`
+	Material      string     `json:"material"`
+	Rate          int        `json:"rate"` // points per unit
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to"` // nil for the latest version
+	Comment       string     `json:"comment,omitempty"`
+	CreatedBy     *int       `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Product is a packaged product identified by its GTIN barcode
+type Product struct {
+	GTIN               string    `json:"gtin"` // 14 digits, zero-padded
+	Name               string    `json:"name"`
+	Brand              string    `json:"brand"`
+	Material           string    `json:"material"`
+	ExpectedWeightKg   float64   `json:"expected_weight_kg"` // per container, 0 if unknown
+	WeightTolerancePct float64   `json:"weight_tolerance_pct"`
+	ContainerSizeML    *int      `json:"container_size_ml,omitempty"`
+	Active             bool      `json:"active"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// DepositReview is a deposit held for manual review because of its fraud score
+type DepositReview struct {
+	ID            int                   `json:"id"`
+	TransactionID int                   `json:"transaction_id"`
+	UserID        int                   `json:"user_id"`
+	StationID     int                   `json:"station_id"`
+	Score         int                   `json:"score"`
+	Reasons       []DepositReviewReason `json:"reasons"`
+	Status        string                `json:"status"` // pending/approved/rejected
+	Note          string                `json:"note,omitempty"`
+	CreatedAt     time.Time             `json:"created_at"`
+	ReviewedBy    *int                  `json:"reviewed_by,omitempty"`
+	ReviewedAt    *time.Time            `json:"reviewed_at,omitempty"`
+	Transaction   *Transaction          `json:"transaction,omitempty"`
+}
+
+// PointAdjustment is a manual change to a user's points made by staff.
+// Adjustments above the approval threshold wait for a second admin.
+type PointAdjustment struct {
+	ID            int        `json:"id"`
+	UserID        int        `json:"user_id"`
+	Points        int        `json:"points"` // negative for deductions
+	Reason        string     `json:"reason"`
+	Status        string     `json:"status"` // pending/applied/rejected
+	CreatedBy     int        `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ResolvedBy    *int       `json:"resolved_by,omitempty"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+	Note          string     `json:"note,omitempty"`
+	TransactionID *int       `json:"transaction_id,omitempty"`
+}
+
+// LedgerEntry is one side of a balanced journal in the points ledger
+type LedgerEntry struct {
+	ID          int       `json:"id"`
+	JournalID   int       `json:"journal_id"`
+	Account     string    `json:"account"`
+	Amount      int       `json:"amount"` // positive adds to the account
+	Kind        string    `json:"kind"`   // opening/deposit/claim/redemption/adjustment
+	Reference   string    `json:"reference,omitempty"`
+	ReferenceID *int      `json:"reference_id,omitempty"`
+	Memo        string    `json:"memo,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// LedgerReconciliation is the result of checking users' cached balances
+// against the ledger
+type LedgerReconciliation struct {
+	ID                 int           `json:"id"`
+	RunAt              time.Time     `json:"run_at"`
+	UsersChecked       int           `json:"users_checked"`
+	Drifts             []LedgerDrift `json:"drifts"`
+	UnbalancedJournals []int         `json:"unbalanced_journals"`
+	MissingAccounts    []string      `json:"missing_accounts"` // system accounts that do not exist
+}
+
+// LedgerDrift is a user whose cached balance differs from their wallet
+type LedgerDrift struct {
+	UserID        int `json:"user_id"`
+	CachedBalance int `json:"cached_balance"` // users.total_points
+	LedgerBalance int `json:"ledger_balance"`
+	Drift         int `json:"drift"` // cached minus ledger
+}
+
+// DepositReviewReason is a fraud rule a deposit triggered
+type DepositReviewReason struct {
+	Rule   string `json:"rule"`
+	Score  int    `json:"score"`
+	Detail string `json:"detail"`
+}
+
+// StationConfig is the configuration document delivered to stations
+type StationConfig struct {
+	AcceptedMaterials     []string          `json:"accepted_materials"`
+	MaterialRates         map[string]int    `json:"material_rates"`  // points per kg
+	OperatingHours        map[string]string `json:"operating_hours"` // weekday/weekend, "HH:MM-HH:MM"
+	UILanguage            string            `json:"ui_language"`
+	SessionTimeoutSeconds int               `json:"session_timeout_seconds"`
+	PointsRounding        string            `json:"points_rounding"` // floor/half_up/half_even/ceil
+	FraudReviewThreshold  int               `json:"fraud_review_threshold"`
+
+	// Manual adjustments of more than this many points, added up per admin
+	// and user over a day, need a second admin to approve them
+	AdjustmentApprovalPoints int `json:"adjustment_approval_points"`
+}
+
+// StationConfigOverride holds per-station changes to the global configuration.
+// Unset fields inherit the global value; rates and hours are merged per key.
+type StationConfigOverride struct {
+	AcceptedMaterials     []string          `json:"accepted_materials,omitempty"`
+	MaterialRates         map[string]int    `json:"material_rates,omitempty"`
+	OperatingHours        map[string]string `json:"operating_hours,omitempty"`
+	UILanguage            *string           `json:"ui_language,omitempty"`
+	SessionTimeoutSeconds *int              `json:"session_timeout_seconds,omitempty"`
+}
+
+// ConfigVersion represents one saved version of the global configuration
+// (StationID 0) or of a station's overrides
+type ConfigVersion struct {
+	ID        int             `json:"id"`
+	StationID int             `json:"station_id"`
+	Version   int             `json:"version"`
+	Document  json.RawMessage `json:"document"`
+	Comment   string          `json:"comment"`
+	CreatedBy int             `json:"created_by"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// StationStatusChange represents a connectivity transition of a station
+type StationStatusChange struct {
+	ID        int       `json:"id"`
+	StationID int       `json:"station_id"`
+	FromState string    `json:"from_state"`
+	ToState   string    `json:"to_state"`
+	Reason    string    `json:"reason"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// StationTelemetry represents a periodic telemetry report from a station
+type StationTelemetry struct {
+	ID          int        `json:"id"`
+	StationID   int        `json:"station_id"`
+	Temperature *float64   `json:"temperature,omitempty"`
+	DoorState   string     `json:"door_state,omitempty"` // open/closed
+	ErrorCodes  []string   `json:"error_codes"`
+	Bins        []BinLevel `json:"bins"`
+	RecordedAt  time.Time  `json:"recorded_at"`
+}
+
+// BinLevel represents the fill level of one material bin at a station
+type BinLevel struct {
+	Material    string    `json:"material"`
+	FillPercent float64   `json:"fill_percent"`
+	RecordedAt  time.Time `json:"recorded_at"`
+}
+
+// GuestClaim represents points earned in a guest session awaiting a claim
+type GuestClaim struct {
+	ID           int        `json:"id"`
+	ClaimCode    string     `json:"claim_code"`
+	SessionToken string     `json:"session_token"`
+	StationID    int        `json:"station_id"`
+	Points       int        `json:"points"`
+	Status       string     `json:"status"` // open/claimed
+	ExpiresAt    time.Time  `json:"expires_at"`
+	ClaimedBy    *int       `json:"claimed_by,omitempty"`
+	ClaimedAt    *time.Time `json:"claimed_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// UserCard represents an RFID/NFC membership card registered to a user
+type UserCard struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	CardUID   string     `json:"card_uid"`
+	Label     string     `json:"label"`
+	Status    string     `json:"status"` // active/lost/blocked
+	CreatedAt time.Time  `json:"created_at"`
+	BlockedAt *time.Time `json:"blocked_at,omitempty"`
 }
 
 // InitDB initializes the database connection and creates tables
 func InitDB() error {
 	var err error
-	DB, err = sql.Open("sqlite3", "./trash2cash.db")
+	// Write transactions take the database lock when they begin, so checks
+	// made inside a transaction still hold when it commits
+	DB, err = sql.Open("sqlite3", "./trash2cash.db?_txlock=immediate&_busy_timeout=5000")
 	if err != nil {
 		return err
 	}
@@ -79,7 +566,7 @@ func InitDB() error {
 	createUsersTable := `
 	CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		email TEXT UNIQUE NOT NULL,
+		email TEXT UNIQUE,
 		password TEXT NOT NULL,
 		name TEXT NOT NULL,
 		total_points INTEGER DEFAULT 0,
@@ -92,6 +579,22 @@ func InitDB() error {
 		return err
 	}
 
+	// Phone-only accounts have no email
+	if err = makeUserEmailNullable(); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("users", "phone", "TEXT"); err != nil {
+		return err
+	}
+	DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_phone ON users(phone)`)
+	if err = addColumnIfMissing("users", "role", "TEXT DEFAULT 'user'"); err != nil {
+		return err
+	}
+	// Fraction of a point, in thousandths, carried to the user's next deposit
+	if err = addColumnIfMissing("users", "point_remainder", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
 	// Create transactions table
 	createTransactionsTable := `
 	CREATE TABLE IF NOT EXISTS transactions (
@@ -100,7 +603,7 @@ func InitDB() error {
 		type TEXT NOT NULL,
 		amount REAL DEFAULT 0,
 		item_type TEXT NOT NULL,
-		weight REAL NOT NULL,
+		weight_grams INTEGER NOT NULL,
 		points_earned INTEGER NOT NULL,
 		station_id INTEGER DEFAULT 1,
 		session_token TEXT,
@@ -113,6 +616,14 @@ func InitDB() error {
 		return err
 	}
 
+	if err = migrateWeightsToGrams("transactions"); err != nil {
+		return err
+	}
+	// Scale reading before calibration; weight_grams holds the corrected value
+	if err = addColumnIfMissing("transactions", "raw_weight_grams", "INTEGER"); err != nil {
+		return err
+	}
+
 	// Create redemptions table
 	createRedemptionsTable := `
 	CREATE TABLE IF NOT EXISTS redemptions (
@@ -182,6 +693,54 @@ func InitDB() error {
 		return err
 	}
 
+	// Shared secret used by station hardware to authenticate itself
+	if err = addColumnIfMissing("stations", "api_key", "TEXT"); err != nil {
+		return err
+	}
+	DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_station_api_key ON stations(api_key)`)
+
+	// Registry details
+	if err = addColumnIfMissing("stations", "address", "TEXT"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("stations", "timezone", "TEXT DEFAULT 'UTC'"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("stations", "operator", "TEXT"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("stations", "latitude", "REAL"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("stations", "longitude", "REAL"); err != nil {
+		return err
+	}
+
+	// Heartbeat tracking
+	if err = addColumnIfMissing("stations", "last_heartbeat", "DATETIME"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("stations", "connectivity", "TEXT DEFAULT 'unknown'"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("stations", "offline_alerted_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	// The key a station had before its last rotation, still accepted on
+	// offline deposits recorded before the rotation
+	if err = addColumnIfMissing("stations", "previous_api_key", "TEXT"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("stations", "key_rotated_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	// Bin emptying, kept apart from maintenance
+	if err = addColumnIfMissing("stations", "bins_emptied_at", "DATETIME"); err != nil {
+		return err
+	}
+
 	// Create station_sessions table for QR session management
 	createStationSessionsTable := `
 	CREATE TABLE IF NOT EXISTS station_sessions (
@@ -202,7 +761,758 @@ func InitDB() error {
 		return err
 	}
 
+	// Create user_cards table for RFID/NFC membership cards
+	createUserCardsTable := `
+	CREATE TABLE IF NOT EXISTS user_cards (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		card_uid TEXT UNIQUE NOT NULL,
+		label TEXT,
+		status TEXT DEFAULT 'active',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		blocked_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createUserCardsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create otp_codes table for phone login
+	createOTPCodesTable := `
+	CREATE TABLE IF NOT EXISTS otp_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		phone TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		purpose TEXT DEFAULT 'login',
+		attempts INTEGER DEFAULT 0,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		created_at DATETIME NOT NULL
+	);`
+
+	_, err = DB.Exec(createOTPCodesTable)
+	if err != nil {
+		return err
+	}
+
+	// Phones are stored with a leading "+". Older versions kept numbers as
+	// they were entered; a number already stored with the "+" is kept.
+	DB.Exec(`UPDATE OR IGNORE users SET phone = '+' || phone WHERE phone NOT LIKE '+%'`)
+	DB.Exec(`UPDATE otp_codes SET phone = '+' || phone WHERE phone NOT LIKE '+%'`)
+
+	// Create guest_deposits table for deposits made without signing in
+	createGuestDepositsTable := `
+	CREATE TABLE IF NOT EXISTS guest_deposits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_token TEXT NOT NULL,
+		item_type TEXT NOT NULL,
+		weight_grams INTEGER NOT NULL,
+		points_earned INTEGER NOT NULL,
+		station_id INTEGER NOT NULL,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err = DB.Exec(createGuestDepositsTable)
+	if err != nil {
+		return err
+	}
+	if err = migrateWeightsToGrams("guest_deposits"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("guest_deposits", "raw_weight_grams", "INTEGER"); err != nil {
+		return err
+	}
+
+	// Rate version and rate a deposit was credited at
+	for _, table := range []string{"transactions", "guest_deposits"} {
+		if err = addColumnIfMissing(table, "rate_version_id", "INTEGER"); err != nil {
+			return err
+		}
+		if err = addColumnIfMissing(table, "rate", "INTEGER"); err != nil {
+			return err
+		}
+		if err = addColumnIfMissing(table, "rate_multiplier", "REAL"); err != nil {
+			return err
+		}
+		// Exact value in thousandths of a point, before rounding
+		if err = addColumnIfMissing(table, "milli_points", "INTEGER"); err != nil {
+			return err
+		}
+	}
+
+	// Create guest_claims table for claim codes issued at the end of guest sessions
+	createGuestClaimsTable := `
+	CREATE TABLE IF NOT EXISTS guest_claims (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		claim_code TEXT UNIQUE NOT NULL,
+		session_token TEXT UNIQUE NOT NULL,
+		station_id INTEGER NOT NULL,
+		points INTEGER NOT NULL,
+		status TEXT DEFAULT 'open',
+		expires_at DATETIME NOT NULL,
+		claimed_by INTEGER,
+		claimed_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (claimed_by) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createGuestClaimsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create station_telemetry table for periodic station reports
+	createStationTelemetryTable := `
+	CREATE TABLE IF NOT EXISTS station_telemetry (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station_id INTEGER NOT NULL,
+		temperature REAL,
+		door_state TEXT,
+		error_codes TEXT,
+		recorded_at DATETIME NOT NULL,
+		received_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (station_id) REFERENCES stations(id)
+	);`
+
+	_, err = DB.Exec(createStationTelemetryTable)
+	if err != nil {
+		return err
+	}
+
+	// Create station_bin_levels table for per-bin fill readings
+	createStationBinLevelsTable := `
+	CREATE TABLE IF NOT EXISTS station_bin_levels (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		telemetry_id INTEGER NOT NULL,
+		station_id INTEGER NOT NULL,
+		material TEXT NOT NULL,
+		fill_percent REAL NOT NULL,
+		recorded_at DATETIME NOT NULL,
+		FOREIGN KEY (telemetry_id) REFERENCES station_telemetry(id),
+		FOREIGN KEY (station_id) REFERENCES stations(id)
+	);`
+
+	_, err = DB.Exec(createStationBinLevelsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create station_status_history table for connectivity transitions
+	createStationStatusHistoryTable := `
+	CREATE TABLE IF NOT EXISTS station_status_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station_id INTEGER NOT NULL,
+		from_state TEXT NOT NULL,
+		to_state TEXT NOT NULL,
+		reason TEXT,
+		changed_at DATETIME NOT NULL,
+		FOREIGN KEY (station_id) REFERENCES stations(id)
+	);`
+
+	_, err = DB.Exec(createStationStatusHistoryTable)
+	if err != nil {
+		return err
+	}
+
+	// Create config_versions table for global (station_id 0) and per-station configuration
+	createConfigVersionsTable := `
+	CREATE TABLE IF NOT EXISTS config_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station_id INTEGER NOT NULL DEFAULT 0,
+		version INTEGER NOT NULL,
+		document TEXT NOT NULL,
+		comment TEXT,
+		created_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (station_id, version)
+	);`
+
+	_, err = DB.Exec(createConfigVersionsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create maintenance_tickets table for station repairs and servicing
+	createMaintenanceTicketsTable := `
+	CREATE TABLE IF NOT EXISTS maintenance_tickets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station_id INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT,
+		kind TEXT NOT NULL DEFAULT 'fault',
+		source TEXT NOT NULL DEFAULT 'manual',
+		fault_code TEXT,
+		priority TEXT NOT NULL DEFAULT 'normal',
+		status TEXT NOT NULL DEFAULT 'open',
+		assigned_to INTEGER,
+		opened_by INTEGER,
+		resolution TEXT,
+		opened_at DATETIME NOT NULL,
+		closed_at DATETIME,
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY (station_id) REFERENCES stations(id),
+		FOREIGN KEY (assigned_to) REFERENCES users(id),
+		FOREIGN KEY (opened_by) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createMaintenanceTicketsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create ticket_notes table for notes and the status trail of tickets
+	createTicketNotesTable := `
+	CREATE TABLE IF NOT EXISTS ticket_notes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ticket_id INTEGER NOT NULL,
+		user_id INTEGER,
+		note TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (ticket_id) REFERENCES maintenance_tickets(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createTicketNotesTable)
+	if err != nil {
+		return err
+	}
+
+	// Create ticket_parts table for parts used on tickets
+	createTicketPartsTable := `
+	CREATE TABLE IF NOT EXISTS ticket_parts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ticket_id INTEGER NOT NULL,
+		part_name TEXT NOT NULL,
+		part_number TEXT,
+		quantity INTEGER NOT NULL DEFAULT 1,
+		added_by INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (ticket_id) REFERENCES maintenance_tickets(id),
+		FOREIGN KEY (added_by) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createTicketPartsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create holidays table for dates with special or no opening hours
+	createHolidaysTable := `
+	CREATE TABLE IF NOT EXISTS holidays (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station_id INTEGER NOT NULL DEFAULT 0,
+		date TEXT NOT NULL,
+		name TEXT NOT NULL,
+		hours TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (station_id, date)
+	);`
+
+	_, err = DB.Exec(createHolidaysTable)
+	if err != nil {
+		return err
+	}
+
+	// Create station_closures table for temporary closures
+	createStationClosuresTable := `
+	CREATE TABLE IF NOT EXISTS station_closures (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station_id INTEGER NOT NULL,
+		starts_at DATETIME NOT NULL,
+		ends_at DATETIME NOT NULL,
+		reason TEXT,
+		created_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (station_id) REFERENCES stations(id)
+	);`
+
+	_, err = DB.Exec(createStationClosuresTable)
+	if err != nil {
+		return err
+	}
+
+	// Create offline_deposits table for deposits uploaded by stations after an outage
+	createOfflineDepositsTable := `
+	CREATE TABLE IF NOT EXISTS offline_deposits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station_id INTEGER NOT NULL,
+		deposit_uuid TEXT UNIQUE NOT NULL,
+		session_token TEXT,
+		card_uid TEXT,
+		item_type TEXT NOT NULL,
+		weight_grams INTEGER NOT NULL,
+		points INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		reason TEXT,
+		user_id INTEGER,
+		transaction_id INTEGER,
+		recorded_at DATETIME NOT NULL,
+		received_at DATETIME NOT NULL,
+		resolved_by INTEGER,
+		resolved_at DATETIME,
+		FOREIGN KEY (station_id) REFERENCES stations(id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+	);`
+
+	_, err = DB.Exec(createOfflineDepositsTable)
+	if err != nil {
+		return err
+	}
+	if err = migrateWeightsToGrams("offline_deposits"); err != nil {
+		return err
+	}
+
+	// Item count and container size for materials counted per item
+	for _, table := range []string{"transactions", "guest_deposits", "offline_deposits"} {
+		if err = addColumnIfMissing(table, "item_count", "INTEGER"); err != nil {
+			return err
+		}
+		if err = addColumnIfMissing(table, "container_size_ml", "INTEGER"); err != nil {
+			return err
+		}
+	}
+
+	// Create station_commands table for the remote command queue and history
+	createStationCommandsTable := `
+	CREATE TABLE IF NOT EXISTS station_commands (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station_id INTEGER NOT NULL,
+		command TEXT NOT NULL,
+		payload TEXT NOT NULL DEFAULT '{}',
+		status TEXT NOT NULL DEFAULT 'queued',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		result TEXT,
+		issued_by INTEGER,
+		created_at DATETIME NOT NULL,
+		sent_at DATETIME,
+		completed_at DATETIME,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY (station_id) REFERENCES stations(id),
+		FOREIGN KEY (issued_by) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createStationCommandsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create scale_calibrations table for calibrations recorded during maintenance
+	createScaleCalibrationsTable := `
+	CREATE TABLE IF NOT EXISTS scale_calibrations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station_id INTEGER NOT NULL,
+		gain REAL NOT NULL,
+		offset_kg REAL NOT NULL,
+		readings TEXT NOT NULL,
+		max_error_kg REAL NOT NULL,
+		ticket_id INTEGER,
+		technician_id INTEGER,
+		notes TEXT,
+		calibrated_at DATETIME NOT NULL,
+		FOREIGN KEY (station_id) REFERENCES stations(id),
+		FOREIGN KEY (ticket_id) REFERENCES maintenance_tickets(id),
+		FOREIGN KEY (technician_id) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createScaleCalibrationsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create materials table for the material catalog
+	createMaterialsTable := `
+	CREATE TABLE IF NOT EXISTS materials (
+		code TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		unit TEXT NOT NULL DEFAULT 'kg',
+		rate INTEGER NOT NULL,
+		min_quantity REAL NOT NULL DEFAULT 0,
+		max_quantity REAL,
+		active BOOLEAN NOT NULL DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err = DB.Exec(createMaterialsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create material_rates table for effective-dated material rates
+	createMaterialRatesTable := `
+	CREATE TABLE IF NOT EXISTS material_rates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		material TEXT NOT NULL,
+		rate INTEGER NOT NULL,
+		effective_from DATETIME NOT NULL,
+		effective_to DATETIME,
+		comment TEXT,
+		created_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (material, effective_from),
+		FOREIGN KEY (material) REFERENCES materials(code)
+	);`
+
+	_, err = DB.Exec(createMaterialRatesTable)
+	if err != nil {
+		return err
+	}
+
+	// Create collection_runs table for hauler collection runs
+	createCollectionRunsTable := `
+	CREATE TABLE IF NOT EXISTS collection_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hauler_id INTEGER NOT NULL,
+		scheduled_for DATETIME NOT NULL,
+		status TEXT NOT NULL DEFAULT 'scheduled',
+		notes TEXT,
+		created_by INTEGER,
+		created_at DATETIME NOT NULL,
+		started_at DATETIME,
+		completed_at DATETIME,
+		FOREIGN KEY (hauler_id) REFERENCES users(id),
+		FOREIGN KEY (created_by) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createCollectionRunsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create collection_stops table for the stations on each run
+	createCollectionStopsTable := `
+	CREATE TABLE IF NOT EXISTS collection_stops (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id INTEGER NOT NULL,
+		station_id INTEGER NOT NULL,
+		sequence INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		skip_reason TEXT,
+		visited_at DATETIME,
+		UNIQUE (run_id, station_id),
+		FOREIGN KEY (run_id) REFERENCES collection_runs(id),
+		FOREIGN KEY (station_id) REFERENCES stations(id)
+	);`
+
+	_, err = DB.Exec(createCollectionStopsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create collection_pickups table for the per-bin pickup manifest
+	createCollectionPickupsTable := `
+	CREATE TABLE IF NOT EXISTS collection_pickups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id INTEGER NOT NULL,
+		station_id INTEGER NOT NULL,
+		material TEXT NOT NULL,
+		deposits INTEGER NOT NULL DEFAULT 0,
+		recorded_weight_kg REAL NOT NULL DEFAULT 0,
+		recorded_raw_kg REAL NOT NULL DEFAULT 0,
+		fill_percent REAL NOT NULL DEFAULT 0,
+		period_start DATETIME NOT NULL,
+		picked_up_at DATETIME NOT NULL,
+		depot_weight_kg REAL,
+		discrepancy_kg REAL,
+		discrepancy_pct REAL,
+		flagged BOOLEAN NOT NULL DEFAULT 0,
+		weighed_at DATETIME,
+		FOREIGN KEY (run_id) REFERENCES collection_runs(id),
+		FOREIGN KEY (station_id) REFERENCES stations(id)
+	);`
+
+	_, err = DB.Exec(createCollectionPickupsTable)
+	if err != nil {
+		return err
+	}
+
+	// Create deposits table for multi-item deposit headers
+	createDepositsTable := `
+	CREATE TABLE IF NOT EXISTS deposits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		station_id INTEGER NOT NULL,
+		session_token TEXT,
+		item_lines INTEGER NOT NULL,
+		points_earned INTEGER NOT NULL,
+		milli_points INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (station_id) REFERENCES stations(id)
+	);`
+
+	_, err = DB.Exec(createDepositsTable)
+	if err != nil {
+		return err
+	}
+
+	// Line items of a multi-item deposit point at their header
+	if err = addColumnIfMissing("transactions", "deposit_id", "INTEGER REFERENCES deposits(id)"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("transactions", "barcode", "TEXT"); err != nil {
+		return err
+	}
+
+	// Create products table for the barcode product catalog
+	createProductsTable := `
+	CREATE TABLE IF NOT EXISTS products (
+		gtin TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		brand TEXT NOT NULL DEFAULT '',
+		material TEXT NOT NULL,
+		expected_weight_kg REAL NOT NULL DEFAULT 0,
+		weight_tolerance_pct REAL NOT NULL DEFAULT 25,
+		container_size_ml INTEGER,
+		active BOOLEAN NOT NULL DEFAULT 1,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY (material) REFERENCES materials(code)
+	);`
+
+	_, err = DB.Exec(createProductsTable)
+	if err != nil {
+		return err
+	}
+
+	// Fraud scoring: per-material review quantities and the review queue
+	if err = addColumnIfMissing("materials", "review_quantity", "REAL"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("transactions", "fraud_score", "INTEGER"); err != nil {
+		return err
+	}
+	if err = addColumnIfMissing("transactions", "review_status", "TEXT"); err != nil {
+		return err
+	}
+	// Guest deposits are scored too; held ones are queued for review when claimed
+	if err = addColumnIfMissing("guest_deposits", "fraud_score", "INTEGER"); err != nil {
+		return err
+	}
+	for _, column := range []string{"review_status", "fraud_reasons"} {
+		if err = addColumnIfMissing("guest_deposits", column, "TEXT"); err != nil {
+			return err
+		}
+	}
+
+	createDepositReviewsTable := `
+	CREATE TABLE IF NOT EXISTS deposit_reviews (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		transaction_id INTEGER UNIQUE NOT NULL,
+		user_id INTEGER NOT NULL,
+		station_id INTEGER NOT NULL,
+		score INTEGER NOT NULL,
+		reasons TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		note TEXT,
+		created_at DATETIME NOT NULL,
+		reviewed_by INTEGER,
+		reviewed_at DATETIME,
+		FOREIGN KEY (transaction_id) REFERENCES transactions(id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (station_id) REFERENCES stations(id),
+		FOREIGN KEY (reviewed_by) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createDepositReviewsTable)
+	if err != nil {
+		return err
+	}
+
+	// Brand of deposits identified by barcode, for reporting
+	if err = addColumnIfMissing("transactions", "brand", "TEXT"); err != nil {
+		return err
+	}
+	for _, column := range []string{"barcode", "brand"} {
+		if err = addColumnIfMissing("guest_deposits", column, "TEXT"); err != nil {
+			return err
+		}
+	}
+	// Barcode scanned by a station while offline, classified when uploaded
+	if err = addColumnIfMissing("offline_deposits", "barcode", "TEXT"); err != nil {
+		return err
+	}
+
+	// Expected item weight, for counted deposits the station did not weigh
+	if err = addColumnIfMissing("materials", "item_weight_kg", "REAL NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err = estimateCountedWeights(); err != nil {
+		return err
+	}
+
+	// Staff adjustments: who made them and why, with two-person approval
+	if err = addColumnIfMissing("transactions", "reason", "TEXT"); err != nil {
+		return err
+	}
+	for _, column := range []string{"operator_id", "approved_by"} {
+		if err = addColumnIfMissing("transactions", column, "INTEGER"); err != nil {
+			return err
+		}
+	}
+
+	createPointAdjustmentsTable := `
+	CREATE TABLE IF NOT EXISTS point_adjustments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		points INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_by INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		resolved_by INTEGER,
+		resolved_at DATETIME,
+		note TEXT,
+		transaction_id INTEGER,
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (created_by) REFERENCES users(id),
+		FOREIGN KEY (resolved_by) REFERENCES users(id),
+		FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+	);`
+
+	_, err = DB.Exec(createPointAdjustmentsTable)
+	if err != nil {
+		return err
+	}
+
+	// Responses kept per Idempotency-Key and caller so retries are not applied
+	// twice; status_code is NULL while the first request is in progress
+	createIdempotencyKeysTable := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id INTEGER NOT NULL,
+		idempotency_key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status_code INTEGER,
+		response TEXT,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, idempotency_key),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createIdempotencyKeysTable)
+	if err != nil {
+		return err
+	}
+
+	// Double-entry points ledger. Each journal's entries add up to zero;
+	// users.total_points caches the balance of the user's wallet account.
+	createLedgerAccountsTable := `
+	CREATE TABLE IF NOT EXISTS ledger_accounts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		code TEXT UNIQUE NOT NULL,
+		user_id INTEGER UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+
+	_, err = DB.Exec(createLedgerAccountsTable)
+	if err != nil {
+		return err
+	}
+
+	createLedgerJournalsTable := `
+	CREATE TABLE IF NOT EXISTS ledger_journals (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		reference_type TEXT,
+		reference_id INTEGER,
+		memo TEXT,
+		created_at DATETIME NOT NULL
+	);`
+
+	_, err = DB.Exec(createLedgerJournalsTable)
+	if err != nil {
+		return err
+	}
+
+	createLedgerEntriesTable := `
+	CREATE TABLE IF NOT EXISTS ledger_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		journal_id INTEGER NOT NULL,
+		account_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		FOREIGN KEY (journal_id) REFERENCES ledger_journals(id),
+		FOREIGN KEY (account_id) REFERENCES ledger_accounts(id)
+	);`
+
+	_, err = DB.Exec(createLedgerEntriesTable)
+	if err != nil {
+		return err
+	}
+
+	// The ledger is append-only; mistakes are corrected with new journals
+	for _, trigger := range []string{
+		"ledger_journals_no_update BEFORE UPDATE ON ledger_journals",
+		"ledger_journals_no_delete BEFORE DELETE ON ledger_journals",
+		"ledger_entries_no_update BEFORE UPDATE ON ledger_entries",
+		"ledger_entries_no_delete BEFORE DELETE ON ledger_entries",
+	} {
+		_, err = DB.Exec(`CREATE TRIGGER IF NOT EXISTS ` + trigger + `
+			BEGIN SELECT RAISE(ABORT, 'the points ledger is append-only'); END`)
+		if err != nil {
+			return err
+		}
+	}
+
+	createLedgerReconciliationsTable := `
+	CREATE TABLE IF NOT EXISTS ledger_reconciliations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_at DATETIME NOT NULL,
+		users_checked INTEGER NOT NULL,
+		drifts TEXT NOT NULL,
+		unbalanced_journals TEXT NOT NULL,
+		missing_accounts TEXT NOT NULL DEFAULT '[]'
+	);`
+
+	_, err = DB.Exec(createLedgerReconciliationsTable)
+	if err != nil {
+		return err
+	}
+
+	// Reconciliation runs from before system accounts were checked
+	if err = addColumnIfMissing("ledger_reconciliations", "missing_accounts", "TEXT NOT NULL DEFAULT '[]'"); err != nil {
+		return err
+	}
+
+	// System accounts; user wallets are opened with the account, or on
+	// their first posting for users from before the ledger
+	DB.Exec(`INSERT OR IGNORE INTO ledger_accounts (code) VALUES ('issuance'), ('redemption_liability'), ('expiry')`)
+
+	// Redemptions are kept in redemptions and the ledger. Older databases
+	// also recorded each one as a transaction, at station 1.
+	DB.Exec(`DELETE FROM transactions WHERE type = 'redemption'`)
+
 	// Create index for better query performance
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ledger_entries_account ON ledger_entries(account_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ledger_entries_journal ON ledger_entries(journal_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_point_adjustments_status ON point_adjustments(status, created_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_transactions_deposit ON transactions(deposit_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_products_brand ON products(brand)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_deposit_reviews_status ON deposit_reviews(status, created_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_transactions_user_time ON transactions(user_id, timestamp)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_collection_runs_hauler ON collection_runs(hauler_id, status)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_collection_stops_run ON collection_stops(run_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_collection_pickups_run ON collection_pickups(run_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_collection_pickups_bin ON collection_pickups(station_id, material, picked_up_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_scale_calibrations_station ON scale_calibrations(station_id, calibrated_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_station_commands_station ON station_commands(station_id, status)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_offline_deposits_status ON offline_deposits(status, station_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_closures_station ON station_closures(station_id, ends_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_tickets_station ON maintenance_tickets(station_id, opened_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_tickets_assigned ON maintenance_tickets(assigned_to, status)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ticket_notes_ticket ON ticket_notes(ticket_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ticket_parts_ticket ON ticket_parts(ticket_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_status_history_station ON station_status_history(station_id, changed_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_telemetry_station ON station_telemetry(station_id, recorded_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_bin_levels_station ON station_bin_levels(station_id, material)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_bin_levels_recorded ON station_bin_levels(station_id, material, recorded_at)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_guest_deposits_session ON guest_deposits(session_token)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_otp_phone ON otp_codes(phone)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_user_cards_user ON user_cards(user_id)`)
 	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_session_token ON station_sessions(session_token)`)
 	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_session_status ON station_sessions(status)`)
 	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_session_expires ON station_sessions(expires_at)`)
@@ -210,6 +1520,14 @@ func InitDB() error {
 	// Insert default station if not exists
 	DB.Exec(`INSERT OR IGNORE INTO stations (id, location, status, capacity) VALUES (1, 'Main Station', 'active', 100)`)
 
+	// Give the default station a known API key for local development
+	result, err := DB.Exec(`UPDATE stations SET api_key = 'station-1-dev-key' WHERE id = 1 AND api_key IS NULL`)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Println("Default station API key set: station-1-dev-key")
+		}
+	}
+
 	// Insert dummy user if not exists
 	// Hash the password "dummy123"
 	dummyPasswordHash, err := bcrypt.GenerateFromPassword([]byte("dummy123"), bcrypt.DefaultCost)
@@ -219,6 +1537,18 @@ func InitDB() error {
 		log.Println("Dummy user created: dummy@trash2cash.com / dummy123")
 	}
 
+	// Seed the material catalog with the original rates
+	DB.Exec(`INSERT OR IGNORE INTO materials (code, name, unit, rate) VALUES
+		('plastic', 'Plastic', 'kg', 10),
+		('glass', 'Glass', 'kg', 8),
+		('metal', 'Metal', 'kg', 15),
+		('paper', 'Paper', 'kg', 5)`)
+
+	// Materials without rate versions start with their catalog rate
+	DB.Exec(`INSERT INTO material_rates (material, rate, effective_from)
+		SELECT code, rate, created_at FROM materials m
+		WHERE NOT EXISTS (SELECT 1 FROM material_rates r WHERE r.material = m.code)`)
+
 	// Insert demo user if not exists
 	// Hash the password "demo123"
 	demoPasswordHash, err := bcrypt.GenerateFromPassword([]byte("demo123"), bcrypt.DefaultCost)
@@ -228,10 +1558,174 @@ func InitDB() error {
 		log.Println("Demo user created: demo@trash2cash.com / demo123")
 	}
 
+	// Insert admin user if not exists
+	// Hash the password "admin123"
+	adminPasswordHash, err := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
+	if err == nil {
+		DB.Exec(`INSERT OR IGNORE INTO users (email, password, name, role, total_points)
+			VALUES ('admin@trash2cash.com', ?, 'Admin User', 'admin', 0)`, string(adminPasswordHash))
+		log.Println("Admin user created: admin@trash2cash.com / admin123")
+	}
+
+	// Insert technician user if not exists
+	// Hash the password "tech123"
+	techPasswordHash, err := bcrypt.GenerateFromPassword([]byte("tech123"), bcrypt.DefaultCost)
+	if err == nil {
+		DB.Exec(`INSERT OR IGNORE INTO users (email, password, name, role, total_points)
+			VALUES ('tech@trash2cash.com', ?, 'Technician User', 'technician', 0)`, string(techPasswordHash))
+		log.Println("Technician user created: tech@trash2cash.com / tech123")
+	}
+
+	// Insert hauler user if not exists
+	// Hash the password "hauler123"
+	haulerPasswordHash, err := bcrypt.GenerateFromPassword([]byte("hauler123"), bcrypt.DefaultCost)
+	if err == nil {
+		DB.Exec(`INSERT OR IGNORE INTO users (email, password, name, role, total_points)
+			VALUES ('hauler@trash2cash.com', ?, 'Hauler User', 'hauler', 0)`, string(haulerPasswordHash))
+		log.Println("Hauler user created: hauler@trash2cash.com / hauler123")
+	}
+
 	log.Println("Database initialized successfully")
 	return nil
 }
 
+// tableColumns returns the columns of a table mapped to whether they are NOT NULL
+func tableColumns(table string) (map[string]bool, error) {
+	rows, err := DB.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = notNull == 1
+	}
+	return columns, rows.Err()
+}
+
+// addColumnIfMissing adds a column to an existing table so databases created
+// by older versions pick up new fields
+func addColumnIfMissing(table, column, definition string) error {
+	columns, err := tableColumns(table)
+	if err != nil {
+		return err
+	}
+	if _, exists := columns[column]; exists {
+		return nil
+	}
+
+	_, err = DB.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// makeUserEmailNullable rebuilds a users table created by older versions,
+// where email was NOT NULL, so phone-only accounts can be stored
+func makeUserEmailNullable() error {
+	columns, err := tableColumns("users")
+	if err != nil {
+		return err
+	}
+	if !columns["email"] {
+		return nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE users_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT UNIQUE,
+			password TEXT NOT NULL,
+			name TEXT NOT NULL,
+			total_points INTEGER DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`INSERT INTO users_new (id, email, password, name, total_points, created_at, updated_at)
+			SELECT id, email, password, name, total_points, created_at, updated_at FROM users`,
+		`DROP TABLE users`,
+		`ALTER TABLE users_new RENAME TO users`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Migrated users table: email is now optional")
+	return tx.Commit()
+}
+
+// migrateWeightsToGrams converts the weight columns of a deposit table
+// created by older versions, which stored kg as REAL, to integer grams
+func migrateWeightsToGrams(table string) error {
+	columns, err := tableColumns(table)
+	if err != nil {
+		return err
+	}
+	if _, exists := columns["weight"]; !exists {
+		return nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"ALTER TABLE " + table + " ADD COLUMN weight_grams INTEGER NOT NULL DEFAULT 0",
+		"UPDATE " + table + " SET weight_grams = CAST(ROUND(weight * 1000) AS INTEGER)",
+		"ALTER TABLE " + table + " DROP COLUMN weight",
+	}
+	if _, exists := columns["raw_weight"]; exists {
+		statements = append(statements,
+			"ALTER TABLE "+table+" ADD COLUMN raw_weight_grams INTEGER",
+			"UPDATE "+table+" SET raw_weight_grams = CAST(ROUND(raw_weight * 1000) AS INTEGER) WHERE raw_weight IS NOT NULL",
+			"ALTER TABLE "+table+" DROP COLUMN raw_weight",
+		)
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Migrated %s table: weights are now stored in grams", table)
+	return tx.Commit()
+}
+
+// estimateCountedWeights gives counted deposits recorded without a weight
+// their count times the expected weight of one item: the product's, for
+// catalogued barcodes, or else the material's. Deposits stay at 0 while
+// neither is known.
+func estimateCountedWeights() error {
+	for _, table := range []string{"transactions", "guest_deposits"} {
+		_, err := DB.Exec(`
+			UPDATE ` + table + ` SET weight_grams = item_count * CAST(ROUND(1000 * COALESCE(
+				(SELECT p.expected_weight_kg FROM products p WHERE p.gtin = ` + table + `.barcode AND p.expected_weight_kg > 0),
+				(SELECT m.item_weight_kg FROM materials m WHERE m.code = ` + table + `.item_type),
+				0)) AS INTEGER)
+			WHERE item_count IS NOT NULL AND weight_grams = 0
+		`)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // CloseDB closes the database connection
 func CloseDB() {
 	if DB != nil {
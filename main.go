@@ -16,6 +16,9 @@ func main() {
 
 	log.Println("Database initialized successfully")
 
+	// Start periodic jobs (telemetry retention, heartbeat monitoring)
+	api.StartBackgroundJobs()
+
 	// Setup router
 	router := api.SetupRouter()
 